@@ -1,116 +1,451 @@
 /*
-counter package provides a thread-safe singleton counter implementation.
-The data is shared across the entire application, providing a simple counter
-that can be used across a distributed application to keep track of statistics.
+counter package provides thread-safe counter registries. The data in a
+registry is shared by everything holding it, providing a simple counter that
+can be used across a distributed application to keep track of statistics.
+
+The package-level functions use the Default registry, which is shared across
+the entire application. Code which wants counters of its own, like a test or a
+tool which reports only its own statistics, creates a registry with
+NewRegistry.
+
+Counters can be grouped under a prefix with Prefix, and a counter split by
+labels is a series named with Series, e.g. http.status{code=200}. Registries
+also hold gauges and histograms, which Export flattens in among the counters,
+and recent rates of the counters, which ExportWithRates adds.
+
+Counting takes no locks and, once a counter exists, allocates nothing: every
+counter is a set of atomic stripes, and the map of names to counters is
+copied whenever a name is added, so lookups never wait for writers. A Get or
+Export sees every increment made before it was called; increments made while
+an Export runs may or may not be in it.
 */
 package counter
 
 import (
-// "fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var (
-	commands chan *Action
-	counts   map[string]int
-)
+// PREFIX_SEPARATOR joins a registry's prefix to the keys under it.
+const PREFIX_SEPARATOR = "."
 
-type Action struct {
-	key           string
-	action        Command
-	valueReceiver chan int
-	copyReceiver  chan map[string]int
-}
+// Action was a request sent to the goroutine which kept a registry's counts.
+//
+// Deprecated: counters are atomic, and nothing is sent to a registry.
+type Action struct{}
 
+// Command was the kind of an Action.
+//
+// Deprecated: counters are atomic, and nothing is sent to a registry.
 type Command int
 
-const (
-	getCmd = iota
-	incrementCmd
-	resetCmd
-	exportCmd
-	clearCmd
-)
-
+// DEF_CHAN_CAP was how many Actions a registry queued.
+//
+// Deprecated: counters are atomic, and nothing is queued.
 const DEF_CHAN_CAP = 1000
 
+// Default is the registry the package-level functions use.
+var Default *Registry
+
 func init() {
-	commands = make(chan *Action, DEF_CHAN_CAP)
-	counts = make(map[string]int)
-	go semaphore()
+	Default = NewRegistry()
 }
 
-func newAction(key string, cmd Command) *Action {
-	return &Action{
-		key:           key,
-		action:        cmd,
-		valueReceiver: make(chan int),
-		copyReceiver:  make(chan map[string]int),
-	}
+/*
+Registry is an independent set of counters. A registry made by Prefix is a
+view of another, sharing its counters, which reads and writes only the keys
+under its prefix, and names them without it.
+*/
+type Registry struct {
+	data *store
+	// prefix is prepended to every key, including its separator. Empty for
+	// the registry itself.
+	prefix string
 }
 
-// Increment adds one to the value of the specified key.
-func Increment(key string) {
-	incr := newAction(key, incrementCmd)
-	commands <- incr
+// store is the data of a registry, shared by its views.
+type store struct {
+	// lock is held to change the index, which is only ever replaced, never
+	// changed in place, so readers just load it.
+	lock    sync.Mutex
+	index   atomic.Value // *index
+	stripes int
+	rates   *rates
+	// stop is closed by Close to stop the sampling of rates. Nil if nothing
+	// samples them.
+	stop      chan bool
+	closeOnce sync.Once
 }
 
-func Get(key string) int {
-	get := newAction(key, getCmd)
-	commands <- get
-	return <-get.valueReceiver
+// index is every name in a registry, by kind.
+type index struct {
+	counts     map[string]*cell
+	gauges     map[string]*cell
+	gaugeFuncs map[string]func() int
+	histograms map[string]*histogram
+	help       map[string]string
 }
 
-// Reset changes the value of the specified key to zero.
-func Reset(key string) {
-	reset := newAction(key, resetCmd)
-	commands <- reset
+// NewRegistry creates an empty registry, keeping rates over the
+// DEFAULT_RATE_WINDOWS.
+func NewRegistry() *Registry {
+	return NewRegistryWithOptions(Options{})
 }
 
-// Clear sets all data for every key to zero.
-func Clear() {
-	clear := newAction("", clearCmd)
-	commands <- clear
+// NewRegistryWithOptions creates an empty registry, keeping rates as opts
+// says. A registry samples its rates until it is closed.
+func NewRegistryWithOptions(opts Options) *Registry {
+	r := newRegistry(opts, time.Now)
+	r.data.stop = make(chan bool)
+	go r.data.sampleEvery(r.data.rates.resolution, r.data.stop)
+	return r
 }
 
-// Export returns a copy of the counter data map.
-func Export() map[string]int {
-	export := newAction("", exportCmd)
-	commands <- export
-	return <-export.copyReceiver
+/*
+Close stops the registry sampling the rates of its counters, which otherwise
+goes on for as long as the process runs. The registry can still be used, but
+its rates stop moving. Closing a view closes the registry it is a view of.
+Closing a registry more than once is harmless.
+*/
+func (r *Registry) Close() {
+	if r.data.stop != nil {
+		r.data.closeOnce.Do(func() { close(r.data.stop) })
+	}
+}
+
+// newRegistry creates a registry whose rates tell the time with now. Nothing
+// samples its rates until sampleEvery is started, so tests can sample them
+// by hand.
+func newRegistry(opts Options, now func() time.Time) *Registry {
+	data := &store{stripes: stripeCount(), rates: newRates(opts, now)}
+	data.index.Store(&index{
+		counts:     make(map[string]*cell),
+		gauges:     make(map[string]*cell),
+		gaugeFuncs: make(map[string]func() int),
+		histograms: make(map[string]*histogram),
+		help:       make(map[string]string),
+	})
+	return &Registry{data: data}
+}
+
+// Prefix returns a view of the registry's counters under prefix, so that
+// r.Prefix("http").Increment("gets") increments http.gets.
+func (r *Registry) Prefix(prefix string) *Registry {
+	return &Registry{data: r.data, prefix: r.prefix + prefix + PREFIX_SEPARATOR}
 }
 
 /*
-semphore is a goroutine who implements the access to the data store.
+Series returns the name of the counter for name split by labels, with the
+labels in sorted order so the same labels always name the same counter:
+
+	Series("status", map[string]string{"code": "200"}) == "status{code=200}"
 */
-func semaphore() {
-	for {
-		cmd := <-commands
-
-		switch cmd.action {
-		case getCmd:
-			cmd.valueReceiver <- counts[cmd.key]
-		case incrementCmd:
-			counts[cmd.key]++
-		case resetCmd:
-			counts[cmd.key] = 0
-		case clearCmd:
-			clearData()
-		case exportCmd:
-			cmd.copyReceiver <- copy()
+func Series(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = key + "=" + labels[key]
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (data *store) load() *index {
+	return data.index.Load().(*index)
+}
+
+/*
+update replaces the index with a copy changed by change. Names are added far
+less often than they are counted, so copying every map is cheaper than making
+each lookup take a lock.
+*/
+func (data *store) update(change func(ix *index)) {
+	data.lock.Lock()
+	defer data.lock.Unlock()
+	old := data.load()
+	ix := &index{
+		counts:     make(map[string]*cell, len(old.counts)),
+		gauges:     make(map[string]*cell, len(old.gauges)),
+		gaugeFuncs: make(map[string]func() int, len(old.gaugeFuncs)),
+		histograms: make(map[string]*histogram, len(old.histograms)),
+		help:       make(map[string]string, len(old.help)),
+	}
+	for key, c := range old.counts {
+		ix.counts[key] = c
+	}
+	for key, c := range old.gauges {
+		ix.gauges[key] = c
+	}
+	for key, fn := range old.gaugeFuncs {
+		ix.gaugeFuncs[key] = fn
+	}
+	for key, h := range old.histograms {
+		ix.histograms[key] = h
+	}
+	for key, help := range old.help {
+		ix.help[key] = help
+	}
+	change(ix)
+	data.index.Store(ix)
+}
+
+// counter returns the counter key, creating it if it doesn't exist.
+func (r *Registry) counter(key string) *cell {
+	if c := r.data.load().counts[r.prefix+key]; c != nil {
+		return c
+	}
+	var c *cell
+	r.data.update(func(ix *index) {
+		if c = ix.counts[r.prefix+key]; c == nil {
+			c = newCell(r.data.stripes)
+			r.data.rates.track(c)
+			ix.counts[r.prefix+key] = c
 		}
+	})
+	return c
+}
+
+// gauge returns the gauge key, creating it if it doesn't exist.
+func (r *Registry) gauge(key string) *cell {
+	if c := r.data.load().gauges[r.prefix+key]; c != nil {
+		return c
+	}
+	var c *cell
+	r.data.update(func(ix *index) {
+		if c = ix.gauges[r.prefix+key]; c == nil {
+			c = newCell(r.data.stripes)
+			ix.gauges[r.prefix+key] = c
+		}
+	})
+	return c
+}
+
+// Increment adds one to the value of the specified key.
+func (r *Registry) Increment(key string) {
+	r.counter(key).add(1)
+}
+
+func (r *Registry) Get(key string) int {
+	if c := r.data.load().counts[r.prefix+key]; c != nil {
+		return c.get()
+	}
+	return 0
+}
+
+// Add adds delta, which may be negative, to the value of the specified key.
+// A key which has had a negative delta added is no longer monotonic.
+func (r *Registry) Add(key string, delta int) {
+	c := r.counter(key)
+	if delta < 0 {
+		c.fall()
+	}
+	c.add(delta)
+}
+
+// Decrement subtracts one from the value of the specified key, which is no
+// longer monotonic.
+func (r *Registry) Decrement(key string) {
+	c := r.counter(key)
+	c.fall()
+	c.add(-1)
+}
+
+// Reset changes the value of the specified key to zero, after which it is no
+// longer monotonic.
+func (r *Registry) Reset(key string) {
+	r.Set(key, 0)
+}
+
+// Set changes the value of the specified key to value, after which it is no
+// longer monotonic. Like Reset, it doesn't count towards the key's rates,
+// which only Add and its kin move.
+func (r *Registry) Set(key string, value int) {
+	c := r.counter(key)
+	c.fall()
+	c.set(value)
+}
+
+// Delete forgets the specified key and its rates, so it isn't exported until
+// it is counted again.
+func (r *Registry) Delete(key string) {
+	if r.data.load().counts[r.prefix+key] == nil {
+		return
 	}
+	r.data.update(func(ix *index) {
+		delete(ix.counts, r.prefix+key)
+	})
+}
+
+// Clear forgets the counters, their rates and the gauges in the registry, and
+// empties the histograms. Gauge funcs and histogram buckets stay defined.
+func (r *Registry) Clear() {
+	r.data.update(func(ix *index) {
+		for key, _ := range ix.counts {
+			if strings.HasPrefix(key, r.prefix) {
+				delete(ix.counts, key)
+			}
+		}
+		for key, _ := range ix.gauges {
+			if strings.HasPrefix(key, r.prefix) {
+				delete(ix.gauges, key)
+			}
+		}
+		for key, h := range ix.histograms {
+			if strings.HasPrefix(key, r.prefix) {
+				h.reset()
+			}
+		}
+	})
+}
+
+// Export returns a copy of the counter data map, with the gauges and
+// histograms flattened into it.
+func (r *Registry) Export() map[string]int {
+	return flattenSnapshot(r.ExportSnapshot())
 }
 
-func clearData() {
-	for key, _ := range counts {
-		delete(counts, key)
+// flattenSnapshot puts every value of snapshot in one map, as Export does.
+func flattenSnapshot(snapshot Snapshot) map[string]int {
+	data := make(map[string]int)
+	for key, value := range snapshot.Counters {
+		data[key] = value
 	}
+	for key, value := range snapshot.Gauges {
+		data[key] = value
+	}
+	for key, histogram := range snapshot.Histograms {
+		histogram.flatten(key, data)
+	}
+	return data
+}
+
+// ExportSnapshot returns a copy of every value in the registry, by kind,
+// without the rates.
+func (r *Registry) ExportSnapshot() Snapshot {
+	return r.snapshot(false, false)
 }
 
-func copy() map[string]int {
-	dataCopy := make(map[string]int)
-	for key, value := range counts {
-		dataCopy[key] = value
+// snapshot returns a copy of every value in the registry, zeroing the
+// counters and histograms as it goes if reset is set, and working out the
+// rates of the counters if withRates is.
+func (r *Registry) snapshot(reset bool, withRates bool) Snapshot {
+	ix := r.data.load()
+	snapshot := Snapshot{
+		Counters:   make(map[string]int),
+		Gauges:     make(map[string]int),
+		Histograms: make(map[string]HistogramSnapshot),
+		Help:       make(map[string]string),
+		Rates:      make(map[string]float64),
+		Falling:    make(map[string]bool),
+	}
+	for key, c := range ix.counts {
+		if strings.HasPrefix(key, r.prefix) {
+			name := strings.TrimPrefix(key, r.prefix)
+			if reset {
+				snapshot.Counters[name] = c.take()
+			} else {
+				snapshot.Counters[name] = c.get()
+			}
+			if c.fallen() {
+				snapshot.Falling[name] = true
+			}
+			if withRates {
+				r.data.rates.export(name, c, snapshot.Rates)
+			}
+		}
+	}
+	for key, c := range ix.gauges {
+		if strings.HasPrefix(key, r.prefix) {
+			snapshot.Gauges[strings.TrimPrefix(key, r.prefix)] = c.get()
+		}
 	}
-	return dataCopy
+	for key, fn := range ix.gaugeFuncs {
+		if strings.HasPrefix(key, r.prefix) {
+			snapshot.Gauges[strings.TrimPrefix(key, r.prefix)] = fn()
+		}
+	}
+	for key, help := range ix.help {
+		if strings.HasPrefix(key, r.prefix) {
+			snapshot.Help[strings.TrimPrefix(key, r.prefix)] = help
+		}
+	}
+	for key, h := range ix.histograms {
+		if strings.HasPrefix(key, r.prefix) {
+			if reset {
+				snapshot.Histograms[strings.TrimPrefix(key, r.prefix)] = h.take()
+			} else {
+				snapshot.Histograms[strings.TrimPrefix(key, r.prefix)] = h.snapshot()
+			}
+		}
+	}
+	return snapshot
+}
+
+// Describe sets the help text of name, which is a counter, gauge or
+// histogram, or the name all the series of one have in common.
+func (r *Registry) Describe(name string, help string) {
+	r.data.update(func(ix *index) {
+		ix.help[r.prefix+name] = help
+	})
+}
+
+// Increment adds one to the value of the specified key in the Default
+// registry.
+func Increment(key string) {
+	Default.Increment(key)
+}
+
+func Get(key string) int {
+	return Default.Get(key)
+}
+
+// Add adds delta to the value of the specified key in the Default registry.
+func Add(key string, delta int) {
+	Default.Add(key, delta)
+}
+
+// Decrement subtracts one from the value of the specified key in the Default
+// registry.
+func Decrement(key string) {
+	Default.Decrement(key)
+}
+
+// Reset changes the value of the specified key to zero.
+func Reset(key string) {
+	Default.Reset(key)
+}
+
+// Set changes the value of the specified key in the Default registry to
+// value.
+func Set(key string, value int) {
+	Default.Set(key, value)
+}
+
+// Delete forgets the specified key in the Default registry.
+func Delete(key string) {
+	Default.Delete(key)
+}
+
+// Clear sets all data for every key to zero.
+func Clear() {
+	Default.Clear()
+}
+
+// Export returns a copy of the counter data map.
+func Export() map[string]int {
+	return Default.Export()
+}
+
+// Describe sets the help text of name in the Default registry.
+func Describe(name string, help string) {
+	Default.Describe(name, help)
 }
@@ -1,8 +1,14 @@
 package counter
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"runtime"
 	"sync"
 	tst "testing"
+	"time"
 )
 
 var expectedCounts map[string]int
@@ -34,7 +40,6 @@ func TestConcurrentCount(t *tst.T) {
 	controller := make(chan bool)
 	incrementer := func(key string, times int) {
 		for i := 0; i < times; i++ {
-			i = i
 			Increment(key)
 		}
 		controller <- true
@@ -77,6 +82,498 @@ func TestReset(t *tst.T) {
 	}
 }
 
+func TestRegistry(t *tst.T) {
+	r := NewRegistry()
+	r.Increment("requests")
+	if Get("requests") != 0 {
+		t.Errorf("a registry's counter showed up in the default registry")
+	}
+
+	http := r.Prefix("http")
+	ok := Series("status", map[string]string{"code": "200"})
+	http.Increment(ok)
+	http.Increment(ok)
+	http.Increment(Series("status", map[string]string{"method": "GET", "code": "404"}))
+	if got := r.Get("http.status{code=200}"); got != 2 {
+		t.Errorf("http.status{code=200} is %d, expected 2", got)
+	}
+	if got := http.Export(); len(got) != 2 || got["status{code=404,method=GET}"] != 1 {
+		t.Errorf("the http view exported %v", got)
+	}
+	if got := http.Prefix("server").Prefix("errors"); got.prefix != "http.server.errors." {
+		t.Errorf("nested prefix %q", got.prefix)
+	}
+
+	// clearing a view leaves the rest of the registry alone.
+	http.Clear()
+	if got := r.Export(); len(got) != 1 || got["requests"] != 1 {
+		t.Errorf("after clearing the http view the registry has %v", got)
+	}
+}
+
+func TestAddSetDelete(t *tst.T) {
+	c := &clock{now: time.Unix(1000, 0)}
+	r := newRegistry(Options{RateWindows: []time.Duration{10 * time.Second}}, c.Now)
+	r.Add("bytes", 1500)
+	r.Add("bytes", 500)
+	r.Increment("sessions")
+	r.Increment("sessions")
+	r.Decrement("sessions")
+	r.Add("sessions", -3)
+	r.Set("batch", 40)
+	r.Increment("batch")
+	r.Increment("gone")
+	r.Delete("gone")
+	r.Delete("never")
+
+	expected := map[string]int{"bytes": 2000, "sessions": -2, "batch": 41}
+	if got := r.Export(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("exported %v, expected %v", got, expected)
+	}
+	// the rate is the net change counted, not where Set put the value.
+	if got := r.Rate("batch", 10*time.Second); got != 0.1 {
+		t.Errorf("batch rate %v, expected 0.1", got)
+	}
+	if got := r.Rate("sessions", 10*time.Second); got != -0.2 {
+		t.Errorf("sessions rate %v, expected -0.2", got)
+	}
+
+	// a deleted key starts again from zero.
+	r.Increment("gone")
+	if got := r.Get("gone"); got != 1 {
+		t.Errorf("gone is %d after being deleted and incremented", got)
+	}
+}
+
+func TestGaugesAndHistograms(t *tst.T) {
+	r := NewRegistry()
+	inflight := r.NewGauge("inflight")
+	inflight.Inc()
+	inflight.Inc()
+	inflight.Dec()
+	r.NewGauge("users").Set(7)
+	size := 3
+	// a gauge func may use the registry it is in.
+	r.GaugeFunc("size", func() int { return size + r.Get("extra") })
+	r.Increment("extra")
+
+	latency := r.NewHistogram("latency-ms", []int{10, 100})
+	for _, ms := range []int{5, 10, 50, 500} {
+		latency.Observe(ms)
+	}
+	latency.ObserveDuration(20 * time.Millisecond)
+
+	data := r.Export()
+	expected := map[string]int{
+		"inflight":            1,
+		"users":               7,
+		"size":                4,
+		"extra":               1,
+		"latency-ms{le=10}":   2,
+		"latency-ms{le=100}":  4,
+		"latency-ms{le=+Inf}": 5,
+		"latency-ms.count":    5,
+		"latency-ms.sum":      585,
+	}
+	if !reflect.DeepEqual(data, expected) {
+		t.Errorf("exported %v, expected %v", data, expected)
+	}
+
+	snapshot := r.ExportSnapshot()
+	histogram := snapshot.Histograms["latency-ms"]
+	if histogram.Count != 5 || len(histogram.Buckets) != 2 ||
+		histogram.Buckets[1] != (Bucket{UpperBound: 100, Count: 4}) {
+		t.Errorf("histogram snapshot %+v", histogram)
+	}
+	if snapshot.Gauges["size"] != 4 || snapshot.Counters["extra"] != 1 {
+		t.Errorf("snapshot %+v", snapshot)
+	}
+	raw, _ := json.Marshal(histogram)
+	if string(raw) != `{"count":5,"sum":585,"buckets":[{"le":10,"count":2},{"le":100,"count":4}]}` {
+		t.Errorf("histogram json %s", raw)
+	}
+
+	// clearing empties histograms without forgetting their buckets.
+	r.Clear()
+	latency.Observe(1000)
+	if got := r.Export(); got["latency-ms{le=100}"] != 0 || got["latency-ms.count"] != 1 {
+		t.Errorf("after clearing exported %v", got)
+	}
+}
+
+func TestWritePrometheus(t *tst.T) {
+	r := NewRegistry()
+	http := r.Prefix("http")
+	http.Describe("status", "Responses by status code.")
+	http.Increment(Series("status", map[string]string{"code": "404"}))
+	http.Increment(Series("status", map[string]string{"code": "200"}))
+	http.NewGauge("inflight").Set(2)
+	http.NewHistogram("latency-ms", []int{10, 100}).Observe(50)
+	r.Increment(`odd"label{path=a"b}`)
+	r.Increment("sessions")
+	r.Decrement("sessions")
+	// one series going down makes its whole family a gauge.
+	http.Increment(Series("conns", map[string]string{"state": "open"}))
+	http.Set(Series("conns", map[string]string{"state": "idle"}), 3)
+
+	var out bytes.Buffer
+	if err := r.ExportSnapshot().WritePrometheus(&out); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP http_conns The http.conns gauge.
+# TYPE http_conns gauge
+http_conns{state="idle"} 3
+http_conns{state="open"} 1
+# HELP http_inflight The http.inflight gauge.
+# TYPE http_inflight gauge
+http_inflight 2
+# HELP http_latency_ms The http.latency-ms histogram.
+# TYPE http_latency_ms histogram
+http_latency_ms_bucket{le="10"} 0
+http_latency_ms_bucket{le="100"} 1
+http_latency_ms_bucket{le="+Inf"} 1
+http_latency_ms_sum 50
+http_latency_ms_count 1
+# HELP http_status Responses by status code.
+# TYPE http_status counter
+http_status{code="200"} 1
+http_status{code="404"} 1
+# HELP odd_label The odd"label counter.
+# TYPE odd_label counter
+odd_label{path="a\"b"} 1
+# HELP sessions The sessions gauge.
+# TYPE sessions gauge
+sessions 0
+`
+	if out.String() != expected {
+		t.Errorf("wrote\n%s\nexpected\n%s", out.String(), expected)
+	}
+}
+
+// clock is a time that tests move by hand.
+type clock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func (c *clock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.lock.Lock()
+	c.now = c.now.Add(d)
+	c.lock.Unlock()
+}
+
+func TestRates(t *tst.T) {
+	c := &clock{now: time.Unix(1000, 0)}
+	r := newRegistry(Options{
+		RateWindows: []time.Duration{10 * time.Second, time.Minute},
+	}, c.Now)
+
+	// 5 a second for 10 seconds, then 1 a second for 50, sampled at the
+	// start of every second as the registry's ticker would.
+	for second := 0; second < 60; second++ {
+		if second > 0 {
+			c.Advance(time.Second)
+		}
+		r.data.sample()
+		n := 1
+		if second < 10 {
+			n = 5
+		}
+		for i := 0; i < n; i++ {
+			r.Increment("requests")
+		}
+	}
+	if got := r.Rate("requests", 10*time.Second); got != 1 {
+		t.Errorf("10s rate %v, expected 1", got)
+	}
+	if got := r.Rate("requests", time.Minute); got != 100.0/60 {
+		t.Errorf("1m rate %v, expected %v", got, 100.0/60)
+	}
+	// windows past the longest are cut down to it.
+	if got := r.Rate("requests", time.Hour); got != 100.0/60 {
+		t.Errorf("1h rate %v, expected %v", got, 100.0/60)
+	}
+	if got := r.Rate("missing", time.Minute); got != 0 {
+		t.Errorf("rate of a missing key %v", got)
+	}
+
+	// old samples drop out as the ring comes round again.
+	for i := 0; i < 45; i++ {
+		c.Advance(time.Second)
+		r.data.sample()
+	}
+	r.Increment("requests")
+	if got := r.Rate("requests", time.Minute); got != 16.0/60 {
+		t.Errorf("1m rate after 45s %v, expected %v", got, 16.0/60)
+	}
+
+	r.Prefix("http").Increment(Series("status", map[string]string{"code": "200"}))
+	data := r.ExportWithRates()
+	expected := map[string]float64{
+		"requests":                              101,
+		"requests.rate{window=10s}":             0.1,
+		"requests.rate{window=1m}":              16.0 / 60,
+		"http.status{code=200}":                 1,
+		"http.status.rate{code=200,window=10s}": 0.1,
+		"http.status.rate{code=200,window=1m}":  1.0 / 60,
+	}
+	if !reflect.DeepEqual(data, expected) {
+		t.Errorf("exported %v, expected %v", data, expected)
+	}
+	// only the rates variants work the rates out.
+	if got := r.ExportSnapshot().Rates; len(got) != 0 {
+		t.Errorf("ExportSnapshot has rates %v", got)
+	}
+	if got := r.ExportSnapshotWithRates().Rates; len(got) != 4 {
+		t.Errorf("ExportSnapshotWithRates has rates %v", got)
+	}
+
+	r.Clear()
+	if got := r.ExportWithRates(); len(got) != 0 {
+		t.Errorf("after clearing exported %v", got)
+	}
+}
+
+func TestClose(t *tst.T) {
+	before := runtime.NumGoroutine()
+	registries := make([]*Registry, 10)
+	for i := range registries {
+		registries[i] = NewRegistry()
+	}
+	for _, r := range registries {
+		r.Prefix("http").Close()
+		r.Close()
+		r.Increment("requests")
+	}
+	// the samplers stop soon after they are told to, not necessarily before
+	// Close returns.
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := runtime.NumGoroutine(); got > before {
+		t.Errorf("%d goroutines after closing the registries, %d before", got, before)
+	}
+}
+
+func TestExportAndReset(t *tst.T) {
+	r := NewRegistry()
+	r.Add("bytes", 100)
+	r.NewGauge("inflight").Set(3)
+	latency := r.NewHistogram("latency-ms", []int{10})
+	latency.Observe(5)
+	latency.Observe(50)
+
+	expected := map[string]int{
+		"bytes":               100,
+		"inflight":            3,
+		"latency-ms{le=10}":   1,
+		"latency-ms{le=+Inf}": 2,
+		"latency-ms.count":    2,
+		"latency-ms.sum":      55,
+	}
+	if got := r.ExportAndReset(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("first export %v, expected %v", got, expected)
+	}
+	r.Increment("bytes")
+	expected = map[string]int{
+		"bytes":               1,
+		"inflight":            3,
+		"latency-ms{le=10}":   0,
+		"latency-ms{le=+Inf}": 0,
+		"latency-ms.count":    0,
+		"latency-ms.sum":      0,
+	}
+	if got := r.ExportAndReset(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("second export %v, expected %v", got, expected)
+	}
+
+	// nothing counted while exporting is lost.
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 10000; i++ {
+			r.Increment("racing")
+		}
+		done <- true
+	}()
+	total := 0
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		total += r.ExportAndReset()["racing"]
+	}
+	if total != 10000 {
+		t.Errorf("exports added up to %d of 10000 increments", total)
+	}
+}
+
+func TestDeltas(t *tst.T) {
+	r := NewRegistry()
+	deltas := NewDeltas(r, time.Hour)
+	r.Add("requests", 10)
+	r.NewGauge("inflight").Set(2)
+
+	a := deltas.Export("a")
+	if a.Seq != 1 || !a.Start.Equal(Started) || a.Values["requests"] != 10 ||
+		a.Gauges["inflight"] != 2 {
+		t.Errorf("a's first delta %+v", a)
+	}
+	r.Add("requests", 5)
+	if a = deltas.Export("a"); a.Seq != 2 || a.Values["requests"] != 5 {
+		t.Errorf("a's second delta %+v", a)
+	}
+	// each scraper has its own baseline.
+	if b := deltas.Export("b"); b.Seq != 1 || b.Values["requests"] != 15 {
+		t.Errorf("b's first delta %+v", b)
+	}
+	if a = deltas.Export("a"); a.Seq != 3 || a.Values["requests"] != 0 ||
+		a.Gauges["inflight"] != 2 {
+		t.Errorf("a's third delta %+v", a)
+	}
+
+	// a forgotten scraper starts again from the totals.
+	forgetful := NewDeltas(r, time.Nanosecond)
+	forgetful.Export("a")
+	time.Sleep(time.Millisecond)
+	forgetful.Export("b")
+	if a = forgetful.Export("a"); a.Seq != 1 || a.Values["requests"] != 15 {
+		t.Errorf("a's delta after being forgotten %+v", a)
+	}
+
+	// however many scrapers there are, only MAX_SCRAPERS are remembered,
+	// and the one which scraped longest ago is forgotten first.
+	deltas.Export("b")
+	for i := 0; i < 2*MAX_SCRAPERS; i++ {
+		deltas.Export(fmt.Sprint("made-up-", i))
+	}
+	if count := len(deltas.scrapers); count != MAX_SCRAPERS {
+		t.Errorf("remembered %d scrapers, expected %d", count, MAX_SCRAPERS)
+	}
+	if b := deltas.Export("b"); b.Seq != 1 {
+		t.Errorf("b's delta after being forgotten %+v", b)
+	}
+}
+
+func TestIncrementAllocs(t *tst.T) {
+	r := NewRegistry()
+	http := r.Prefix("http")
+	r.Increment("requests")
+	http.Increment("gets")
+	allocs := tst.AllocsPerRun(1000, func() {
+		r.Increment("requests")
+		http.Increment("gets")
+		r.Get("requests")
+	})
+	if allocs != 0 {
+		t.Errorf("counting allocated %v times per run", allocs)
+	}
+}
+
+// channelCounter is the counter as it was before the stripes: every call is
+// an action sent to one goroutine which owns the map, kept to benchmark
+// against.
+type channelCounter struct {
+	commands chan *channelAction
+}
+
+type channelAction struct {
+	key            string
+	get            bool
+	valueReceiver  chan int
+	exportReceiver chan map[string]int
+}
+
+func newChannelCounter() *channelCounter {
+	c := &channelCounter{commands: make(chan *channelAction, 1000)}
+	go func() {
+		counts := make(map[string]int)
+		for cmd := range c.commands {
+			if cmd.get {
+				cmd.valueReceiver <- counts[cmd.key]
+			} else {
+				counts[cmd.key]++
+			}
+		}
+	}()
+	return c
+}
+
+func (c *channelCounter) newAction(key string) *channelAction {
+	return &channelAction{
+		key:            key,
+		valueReceiver:  make(chan int),
+		exportReceiver: make(chan map[string]int),
+	}
+}
+
+func (c *channelCounter) Increment(key string) {
+	c.commands <- c.newAction(key)
+}
+
+func (c *channelCounter) Get(key string) int {
+	get := c.newAction(key)
+	get.get = true
+	c.commands <- get
+	return <-get.valueReceiver
+}
+
+type benchCounter interface {
+	Increment(key string)
+	Get(key string) int
+}
+
+// runCounts runs a parallel workload over keys where one call in getEvery
+// is a Get and the rest are Increments, approximating LogRequest with the
+// occasional /monitor.
+func runCounts(b *tst.B, c benchCounter, keys []string, getEvery int) {
+	b.ReportAllocs()
+	b.RunParallel(func(pb *tst.PB) {
+		i := 0
+		for pb.Next() {
+			key := keys[i%len(keys)]
+			if i%getEvery == getEvery-1 {
+				c.Get(key)
+			} else {
+				c.Increment(key)
+			}
+			i++
+		}
+	})
+}
+
+func benchmarkCounts(b *tst.B, keys []string, getEvery int) {
+	b.Run("channel", func(b *tst.B) {
+		runCounts(b, newChannelCounter(), keys, getEvery)
+	})
+	b.Run("striped", func(b *tst.B) {
+		runCounts(b, NewRegistry(), keys, getEvery)
+	})
+}
+
+func BenchmarkIncrementOneKey(b *tst.B) {
+	benchmarkCounts(b, []string{"http.status{code=200}"}, 1000)
+}
+
+func BenchmarkIncrementManyKeys(b *tst.B) {
+	keys := make([]string, 64)
+	for i := range keys {
+		keys[i] = Series("status", map[string]string{"code": fmt.Sprint(200 + i)})
+	}
+	benchmarkCounts(b, keys, 1000)
+}
+
+func BenchmarkIncrementReadHeavy(b *tst.B) {
+	benchmarkCounts(b, []string{"http.status{code=200}"}, 2)
+}
+
 // Professors Tests ====
 
 const (
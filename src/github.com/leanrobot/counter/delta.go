@@ -0,0 +1,143 @@
+package counter
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+Export gives totals since the process started, so a consumer that samples it
+works out deltas itself, and a restarted process looks like its counters went
+backwards. There are two ways to read changes instead.
+
+ExportAndReset reads the counters and histograms and zeroes them, for a
+registry with a single consumer, since every call takes what the last one left.
+
+Deltas serves many scrapers, each named by an id, and gives each the changes
+since its own last scrape without touching the registry. Its Delta carries
+the time the process started and the scraper's sequence number, so a scraper
+can tell a restart (a new start time) or a forgotten baseline (the sequence
+going back to one) from counts which really went down. It remembers at most
+MAX_SCRAPERS scrapers, so ids made up by the request can't make it grow
+without bound.
+*/
+
+// Started is roughly when the process started: when this package was
+// initialised.
+var Started = time.Now()
+
+// DEFAULT_SCRAPER_TTL is how long Deltas remembers a scraper which hasn't
+// scraped, if it isn't told.
+const DEFAULT_SCRAPER_TTL = time.Hour
+
+// MAX_SCRAPERS is the most scrapers Deltas remembers. A new scraper beyond it
+// makes Deltas forget the one which scraped longest ago.
+const MAX_SCRAPERS = 100
+
+/*
+ExportAndReset returns what Export does, but zeroes the counters and empties
+the histograms as it reads them, so each call returns what was counted since
+the last. Gauges are levels rather than counts, so they are returned as they
+are. No increment racing with it is lost; it is in this call or the next.
+*/
+func (r *Registry) ExportAndReset() map[string]int {
+	return flattenSnapshot(r.snapshot(true, false))
+}
+
+// ExportAndReset returns a copy of the Default registry's data, zeroing its
+// counters and histograms.
+func ExportAndReset() map[string]int {
+	return Default.ExportAndReset()
+}
+
+// Delta is what a scraper is given by Deltas.
+type Delta struct {
+	// Start is when the process started.
+	Start time.Time `json:"start"`
+	// Seq counts the scraper's scrapes, from one.
+	Seq int `json:"seq"`
+	// Values holds the change in every counter and histogram value since the
+	// scraper's last scrape, named as Export names them.
+	Values map[string]int `json:"values"`
+	// Gauges holds the gauges as they are, since they are levels rather
+	// than counts.
+	Gauges map[string]int `json:"gauges"`
+}
+
+// Deltas works out the changes in a registry since each scraper last asked.
+// It is safe for concurrent use.
+type Deltas struct {
+	r   *Registry
+	ttl time.Duration
+
+	lock     sync.Mutex
+	scrapers map[string]*scraper
+}
+
+// scraper is what a scraper saw last.
+type scraper struct {
+	seq  int
+	seen time.Time
+	last map[string]int
+}
+
+// NewDeltas creates a Deltas for r, which forgets scrapers which haven't
+// scraped for ttl.
+func NewDeltas(r *Registry, ttl time.Duration) *Deltas {
+	if ttl <= 0 {
+		ttl = DEFAULT_SCRAPER_TTL
+	}
+	return &Deltas{r: r, ttl: ttl, scrapers: make(map[string]*scraper)}
+}
+
+// Export returns the changes since the scraper id last called it. A scraper
+// Deltas hasn't seen, or has forgotten, gets the values since the start.
+func (d *Deltas) Export(id string) Delta {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	now := time.Now()
+	for other, s := range d.scrapers {
+		if now.Sub(s.seen) > d.ttl {
+			delete(d.scrapers, other)
+		}
+	}
+
+	snapshot := d.r.ExportSnapshot()
+	current := make(map[string]int)
+	for key, value := range snapshot.Counters {
+		current[key] = value
+	}
+	for key, histogram := range snapshot.Histograms {
+		histogram.flatten(key, current)
+	}
+
+	s, exists := d.scrapers[id]
+	if !exists {
+		if len(d.scrapers) >= MAX_SCRAPERS {
+			d.forgetOldest()
+		}
+		s = &scraper{last: make(map[string]int)}
+		d.scrapers[id] = s
+	}
+	s.seq++
+	s.seen = now
+	delta := Delta{Start: Started, Seq: s.seq, Values: make(map[string]int),
+		Gauges: snapshot.Gauges}
+	for key, value := range current {
+		delta.Values[key] = value - s.last[key]
+	}
+	s.last = current
+	return delta
+}
+
+// forgetOldest forgets the scraper which scraped longest ago.
+func (d *Deltas) forgetOldest() {
+	var oldest string
+	var seen time.Time
+	for id, s := range d.scrapers {
+		if seen.IsZero() || s.seen.Before(seen) {
+			oldest, seen = id, s.seen
+		}
+	}
+	delete(d.scrapers, oldest)
+}
@@ -0,0 +1,236 @@
+package counter
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Besides counters, a registry holds gauges, which are set to a value rather
+than counted, and histograms, which count observed values into buckets.
+
+Export flattens them all into one map, so every value has a name:
+
+	<gauge>                 the gauge's value
+	<histogram>{le=<bound>} how many observations were at most bound
+	<histogram>{le=+Inf}    how many observations there were
+	<histogram>.count       the same, under a plainer name
+	<histogram>.sum         the sum of every observation
+
+ExportSnapshot returns the same values kept apart by kind.
+*/
+
+// DEFAULT_LATENCY_BUCKETS are log-linear bucket bounds for latencies in
+// milliseconds, from a millisecond to ten seconds.
+var DEFAULT_LATENCY_BUCKETS = []int{
+	1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000, 10000,
+}
+
+// Snapshot is every value in a registry, by kind.
+type Snapshot struct {
+	Counters   map[string]int               `json:"counters"`
+	Gauges     map[string]int               `json:"gauges"`
+	Histograms map[string]HistogramSnapshot `json:"histograms"`
+	// Help is the text given to Describe for each name described.
+	Help map[string]string `json:"help,omitempty"`
+	// Rates are the rates of the counters over the registry's windows, named
+	// as ExportWithRates names them. Only ExportSnapshotWithRates works them
+	// out.
+	Rates map[string]float64 `json:"rates,omitempty"`
+	// Falling names the counters which are not monotonic: which have been
+	// decremented, had a negative delta added, or been set or reset.
+	Falling map[string]bool `json:"falling,omitempty"`
+}
+
+// HistogramSnapshot is the state of a histogram.
+type HistogramSnapshot struct {
+	Count int `json:"count"`
+	Sum   int `json:"sum"`
+	// Buckets count the observations at most each bound, so each includes
+	// the ones before it. Observations above the last bound are only in
+	// Count.
+	Buckets []Bucket `json:"buckets"`
+}
+
+type Bucket struct {
+	UpperBound int `json:"le"`
+	Count      int `json:"count"`
+}
+
+// Gauge is a value which can go up and down, like the number of requests in
+// flight.
+type Gauge struct {
+	r   *Registry
+	key string
+}
+
+// Histogram counts observations into buckets, like request latencies.
+type Histogram struct {
+	h *histogram
+}
+
+/*
+histogram is the state of a Histogram. Its buckets are counted atomically,
+and read one at a time, so a snapshot taken while values are being observed
+may have the count of one bucket from just before another.
+*/
+type histogram struct {
+	// sum is first so it is 64-bit aligned for atomic access.
+	sum    int64
+	bounds []int
+	// counts holds the observations in each bucket, and those above the
+	// last bound at the end.
+	counts []int64
+}
+
+func newHistogram(bounds []int) *histogram {
+	return &histogram{
+		bounds: append([]int(nil), bounds...),
+		counts: make([]int64, len(bounds)+1),
+	}
+}
+
+func (h *histogram) observe(value int) {
+	i := 0
+	for i < len(h.bounds) && value > h.bounds[i] {
+		i++
+	}
+	atomic.AddInt64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(value))
+}
+
+func (h *histogram) reset() {
+	for i := range h.counts {
+		atomic.StoreInt64(&h.counts[i], 0)
+	}
+	atomic.StoreInt64(&h.sum, 0)
+}
+
+// take returns the histogram's state and empties it, losing no observation
+// racing with it.
+func (h *histogram) take() HistogramSnapshot {
+	snapshot := HistogramSnapshot{
+		Sum:     int(atomic.SwapInt64(&h.sum, 0)),
+		Buckets: make([]Bucket, len(h.bounds)),
+	}
+	for i, bound := range h.bounds {
+		snapshot.Count += int(atomic.SwapInt64(&h.counts[i], 0))
+		snapshot.Buckets[i] = Bucket{UpperBound: bound, Count: snapshot.Count}
+	}
+	snapshot.Count += int(atomic.SwapInt64(&h.counts[len(h.bounds)], 0))
+	return snapshot
+}
+
+func (h *histogram) snapshot() HistogramSnapshot {
+	snapshot := HistogramSnapshot{
+		Sum:     int(atomic.LoadInt64(&h.sum)),
+		Buckets: make([]Bucket, len(h.bounds)),
+	}
+	for i, bound := range h.bounds {
+		snapshot.Count += int(atomic.LoadInt64(&h.counts[i]))
+		snapshot.Buckets[i] = Bucket{UpperBound: bound, Count: snapshot.Count}
+	}
+	snapshot.Count += int(atomic.LoadInt64(&h.counts[len(h.bounds)]))
+	return snapshot
+}
+
+// flatten adds the histogram's values to data under the names Export gives
+// them.
+func (snapshot HistogramSnapshot) flatten(name string, data map[string]int) {
+	for _, bucket := range snapshot.Buckets {
+		le := map[string]string{"le": strconv.Itoa(bucket.UpperBound)}
+		data[Series(name, le)] = bucket.Count
+	}
+	data[Series(name, map[string]string{"le": "+Inf"})] = snapshot.Count
+	data[name+".count"] = snapshot.Count
+	data[name+".sum"] = snapshot.Sum
+}
+
+// NewGauge returns the gauge name, which starts at zero.
+func (r *Registry) NewGauge(name string) *Gauge {
+	return &Gauge{r: r, key: name}
+}
+
+// Set sets the gauge to value.
+func (g *Gauge) Set(value int) {
+	g.r.gauge(g.key).set(value)
+}
+
+// Add adds delta to the gauge.
+func (g *Gauge) Add(delta int) {
+	g.r.gauge(g.key).add(delta)
+}
+
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+/*
+GaugeFunc makes name a gauge whose value is whatever fn returns when the
+registry is exported, for values kept somewhere else, like the size of a map.
+fn is called without the registry locked, so it may use the registry.
+*/
+func (r *Registry) GaugeFunc(name string, fn func() int) {
+	r.data.update(func(ix *index) {
+		ix.gaugeFuncs[r.prefix+name] = fn
+	})
+}
+
+/*
+NewHistogram returns the histogram name, with buckets for observations up to
+each of bounds, which must be in increasing order. If the histogram already
+exists it keeps the buckets it has.
+*/
+func (r *Registry) NewHistogram(name string, bounds []int) *Histogram {
+	var h *histogram
+	r.data.update(func(ix *index) {
+		if h = ix.histograms[r.prefix+name]; h == nil {
+			h = newHistogram(bounds)
+			ix.histograms[r.prefix+name] = h
+		}
+	})
+	return &Histogram{h: h}
+}
+
+// Observe counts value into the histogram.
+func (h *Histogram) Observe(value int) {
+	h.h.observe(value)
+}
+
+// ObserveDuration counts d into the histogram in milliseconds.
+func (h *Histogram) ObserveDuration(d time.Duration) {
+	h.Observe(int(d / time.Millisecond))
+}
+
+// ObserveSince counts the time since start into the histogram in
+// milliseconds.
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.ObserveDuration(time.Since(start))
+}
+
+// NewGauge returns the gauge name in the Default registry.
+func NewGauge(name string) *Gauge {
+	return Default.NewGauge(name)
+}
+
+// GaugeFunc makes name a gauge in the Default registry whose value is
+// whatever fn returns.
+func GaugeFunc(name string, fn func() int) {
+	Default.GaugeFunc(name, fn)
+}
+
+// NewHistogram returns the histogram name in the Default registry.
+func NewHistogram(name string, bounds []int) *Histogram {
+	return Default.NewHistogram(name, bounds)
+}
+
+// ExportSnapshot returns a copy of every value in the Default registry, by
+// kind.
+func ExportSnapshot() Snapshot {
+	return Default.ExportSnapshot()
+}
@@ -0,0 +1,149 @@
+package counter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// PROMETHEUS_CONTENT_TYPE is the content type of the Prometheus text
+// exposition format WritePrometheus writes.
+const PROMETHEUS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+/*
+WritePrometheus writes the snapshot in the Prometheus text exposition format.
+
+Names are made valid Prometheus names by replacing every character which
+isn't a letter, digit, underscore or colon with an underscore, so
+http.latency-ms becomes http_latency_ms. The series of a name, like
+http.status{code=200}, are written as one metric family with labels. Every
+family has a HELP line, from Describe if the name was described, and a TYPE
+line. A Prometheus counter only goes up, so a counter which has fallen, and
+any family with a series which has, is typed as a gauge.
+*/
+func (snapshot Snapshot) WritePrometheus(w io.Writer) error {
+	families := make(map[string]*family)
+	get := func(key string, kind string) (*family, []label) {
+		name, labels := parseSeries(key)
+		f, exists := families[name]
+		if !exists {
+			f = &family{name: name, kind: kind, help: snapshot.Help[name]}
+			families[name] = f
+		}
+		return f, labels
+	}
+	for key, value := range snapshot.Counters {
+		f, labels := get(key, "counter")
+		if snapshot.Falling[key] {
+			f.kind = "gauge"
+		}
+		f.add("", labels, fmt.Sprint(value))
+	}
+	for key, value := range snapshot.Gauges {
+		f, labels := get(key, "gauge")
+		f.add("", labels, fmt.Sprint(value))
+	}
+	for key, h := range snapshot.Histograms {
+		f, labels := get(key, "histogram")
+		for _, bucket := range h.Buckets {
+			le := append(labels, label{"le", fmt.Sprint(bucket.UpperBound)})
+			f.add("_bucket", le, fmt.Sprint(bucket.Count))
+		}
+		f.add("_bucket", append(labels, label{"le", "+Inf"}), fmt.Sprint(h.Count))
+		f.add("_sum", labels, fmt.Sprint(h.Sum))
+		f.add("_count", labels, fmt.Sprint(h.Count))
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := bufio.NewWriter(w)
+	for _, name := range names {
+		families[name].write(out)
+	}
+	return out.Flush()
+}
+
+type label struct {
+	name  string
+	value string
+}
+
+// family is the samples of a metric, and what it is.
+type family struct {
+	name    string
+	kind    string
+	help    string
+	samples []string
+}
+
+func (f *family) add(suffix string, labels []label, value string) {
+	sample := promName(f.name) + suffix
+	if len(labels) > 0 {
+		pairs := make([]string, len(labels))
+		for i, l := range labels {
+			pairs[i] = promName(l.name) + `="` + escapeLabel(l.value) + `"`
+		}
+		sample += "{" + strings.Join(pairs, ",") + "}"
+	}
+	f.samples = append(f.samples, sample+" "+value)
+}
+
+func (f *family) write(out *bufio.Writer) {
+	help := f.help
+	if help == "" {
+		help = fmt.Sprintf("The %s %s.", f.name, f.kind)
+	}
+	name := promName(f.name)
+	fmt.Fprintf(out, "# HELP %s %s\n", name, escapeHelp(help))
+	fmt.Fprintf(out, "# TYPE %s %s\n", name, f.kind)
+	// histogram samples are already in order; the others are by labels.
+	if f.kind != "histogram" {
+		sort.Strings(f.samples)
+	}
+	for _, sample := range f.samples {
+		fmt.Fprintln(out, sample)
+	}
+}
+
+// parseSeries splits a key named by Series back into its name and labels.
+func parseSeries(key string) (string, []label) {
+	open := strings.IndexByte(key, '{')
+	if open < 0 || !strings.HasSuffix(key, "}") {
+		return key, nil
+	}
+	var labels []label
+	for _, pair := range strings.Split(key[open+1:len(key)-1], ",") {
+		if eq := strings.IndexByte(pair, '='); eq > 0 {
+			labels = append(labels, label{pair[:eq], pair[eq+1:]})
+		}
+	}
+	return key[:open], labels
+}
+
+// promName makes name a valid Prometheus metric or label name.
+func promName(name string) string {
+	valid := []byte(name)
+	for i, c := range valid {
+		letter := 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '_' || c == ':'
+		if !letter && !('0' <= c && c <= '9' && i > 0) {
+			valid[i] = '_'
+		}
+	}
+	return string(valid)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
@@ -0,0 +1,240 @@
+package counter
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+Besides its total, a registry keeps how fast each counter has been counting
+lately, so consumers don't have to work out deltas themselves. Once every
+Resolution the registry samples the total of every counter into a ring, which
+holds enough samples to cover the longest of the registry's windows. The rate
+over a window is how much the counter has gone up since the sample at the
+start of it, per second. Counting never touches the rings, so keeping rates
+costs increments nothing.
+
+ExportWithRates adds the rate over each window to what Export returns, as a
+series of the counter's name with .rate after it:
+
+	http.status.rate{code=200,window=10s}
+*/
+
+// DEFAULT_RATE_WINDOWS are the windows a registry exports rates over if its
+// Options give none.
+var DEFAULT_RATE_WINDOWS = []time.Duration{
+	10 * time.Second, time.Minute, 5 * time.Minute,
+}
+
+// DEFAULT_RATE_RESOLUTION is how often a registry samples its counters if its
+// Options give no resolution.
+const DEFAULT_RATE_RESOLUTION = time.Second
+
+// Options configures the rates of a registry created by NewRegistryWithOptions.
+type Options struct {
+	// RateWindows are the windows ExportWithRates exports rates over. Rate
+	// may be asked for any window, but no more than the longest of them is
+	// kept.
+	RateWindows []time.Duration
+	// RateResolution is how often the counters are sampled, so rates move
+	// in steps of it.
+	RateResolution time.Duration
+}
+
+// rates is how a registry keeps its rates.
+type rates struct {
+	windows    []time.Duration
+	resolution time.Duration
+	// size is the number of samples in each ring.
+	size int
+	now  func() time.Time
+	// lock guards the rings of every counter.
+	lock sync.Mutex
+}
+
+func newRates(opts Options, now func() time.Time) *rates {
+	rs := &rates{
+		windows:    opts.RateWindows,
+		resolution: opts.RateResolution,
+		now:        now,
+	}
+	if len(rs.windows) == 0 {
+		rs.windows = DEFAULT_RATE_WINDOWS
+	}
+	if rs.resolution <= 0 {
+		rs.resolution = DEFAULT_RATE_RESOLUTION
+	}
+	var longest time.Duration
+	for _, window := range rs.windows {
+		if window > longest {
+			longest = window
+		}
+	}
+	// one more than the longest window, for the sample at its start.
+	rs.size = rs.ticks(longest) + 1
+	return rs
+}
+
+// ticks returns how many samples window covers, at least one and at most
+// what a ring holds once the rings are sized.
+func (rs *rates) ticks(window time.Duration) int {
+	n := int((window + rs.resolution - 1) / rs.resolution)
+	if n < 1 {
+		n = 1
+	}
+	if rs.size > 0 && n > rs.size-1 {
+		n = rs.size - 1
+	}
+	return n
+}
+
+func (rs *rates) tick() int64 {
+	return rs.now().UnixNano() / int64(rs.resolution)
+}
+
+// track gives c, a new counter, a ring, starting from zero now.
+func (rs *rates) track(c *cell) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	c.ring = &ring{totals: make([]int, rs.size), ticks: make([]int64, rs.size)}
+	c.ring.record(rs.tick(), 0)
+}
+
+// sampleEvery samples the registry's counters every resolution, until stop
+// is closed.
+func (data *store) sampleEvery(resolution time.Duration, stop chan bool) {
+	ticker := time.NewTicker(resolution)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			data.sample()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// sample records the total of every counter at this tick.
+func (data *store) sample() {
+	ix := data.load()
+	rs := data.rates
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	tick := rs.tick()
+	for _, c := range ix.counts {
+		c.ring.record(tick, c.total())
+	}
+}
+
+// rate returns how much c went up per second over window. A window longer
+// than the ring is cut down to it.
+func (rs *rates) rate(c *cell, window time.Duration) float64 {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	n := rs.ticks(window)
+	since := c.ring.at(rs.tick() - int64(n) + 1)
+	return float64(c.total()-since) / (time.Duration(n) * rs.resolution).Seconds()
+}
+
+// export puts the rate of c, the counter key, over each window in data.
+func (rs *rates) export(key string, c *cell, data map[string]float64) {
+	for _, window := range rs.windows {
+		data[rs.series(key, window)] = rs.rate(c, window)
+	}
+}
+
+// series returns the name ExportWithRates gives the rate of key over window.
+func (rs *rates) series(key string, window time.Duration) string {
+	name, labels := parseSeries(key)
+	pairs := map[string]string{"window": windowName(window)}
+	for _, l := range labels {
+		pairs[l.name] = l.value
+	}
+	return Series(name+".rate", pairs)
+}
+
+// windowName writes window as briefly as it goes, e.g. 10s, 1m or 1h.
+func windowName(window time.Duration) string {
+	switch {
+	case window%time.Hour == 0:
+		return fmt.Sprintf("%dh", window/time.Hour)
+	case window%time.Minute == 0:
+		return fmt.Sprintf("%dm", window/time.Minute)
+	case window%time.Second == 0:
+		return fmt.Sprintf("%ds", window/time.Second)
+	}
+	return window.String()
+}
+
+/*
+ring is the samples of one counter. A slot is reused once the ring comes round
+to it again, so each remembers the tick it was sampled at.
+*/
+type ring struct {
+	totals []int
+	ticks  []int64
+}
+
+func (r *ring) record(tick int64, total int) {
+	i := int(tick % int64(len(r.totals)))
+	r.ticks[i] = tick
+	r.totals[i] = total
+}
+
+// at returns the total at the start of tick: the latest sample no later
+// than it, or zero if the counter is newer than that. Slots never written
+// read as tick zero with a total of zero, which is the same thing.
+func (r *ring) at(tick int64) int {
+	latest, total := int64(-1), 0
+	for i, t := range r.ticks {
+		if t <= tick && t > latest {
+			latest, total = t, r.totals[i]
+		}
+	}
+	return total
+}
+
+// Rate returns how much key went up per second over the last window,
+// including the part of a resolution not yet sampled. Decrements count
+// against it; Set and Reset don't count at all.
+func (r *Registry) Rate(key string, window time.Duration) float64 {
+	if c := r.data.load().counts[r.prefix+key]; c != nil {
+		return r.data.rates.rate(c, window)
+	}
+	return 0
+}
+
+// ExportSnapshotWithRates returns what ExportSnapshot does, with the rate of
+// every counter over each of the registry's windows. Working out the rates
+// reads every counter's samples, so Export and ExportSnapshot leave them out.
+func (r *Registry) ExportSnapshotWithRates() Snapshot {
+	return r.snapshot(false, true)
+}
+
+// ExportWithRates returns what Export does, with the rate of every counter
+// over each of the registry's windows.
+func (r *Registry) ExportWithRates() map[string]float64 {
+	snapshot := r.ExportSnapshotWithRates()
+	data := make(map[string]float64)
+	for key, value := range flattenSnapshot(snapshot) {
+		data[key] = float64(value)
+	}
+	for key, rate := range snapshot.Rates {
+		data[key] = rate
+	}
+	return data
+}
+
+// Rate returns how much key went up per second over the last window in the
+// Default registry.
+func Rate(key string, window time.Duration) float64 {
+	return Default.Rate(key, window)
+}
+
+// ExportWithRates returns a copy of the Default registry's data, with the
+// rates of its counters.
+func ExportWithRates() map[string]float64 {
+	return Default.ExportWithRates()
+}
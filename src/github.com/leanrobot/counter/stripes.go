@@ -0,0 +1,123 @@
+package counter
+
+import (
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MAX_STRIPES caps how many stripes each counter is split into, however many
+// processors there are.
+const MAX_STRIPES = 32
+
+// CACHE_LINE is the size stripes are padded to, so that processors counting
+// on neighbouring stripes don't fight over one line.
+const CACHE_LINE = 64
+
+/*
+stripe is one part of a counter. Incrementing a single word from every
+processor makes them all queue for its cache line, so a counter is split into
+stripes, each increment goes to one picked at random, and reading the counter
+adds them up.
+*/
+type stripe struct {
+	n int64
+	_ [CACHE_LINE - 8]byte
+}
+
+/*
+cell is a counter or gauge. Its value is the sum of its stripes less base,
+which is how Reset and Set change the value without stopping increments:
+the stripes only ever have deltas added, so the sum of them is also every
+change there has ever been, which the rates are worked out from.
+*/
+type cell struct {
+	// base is first so it is 64-bit aligned for atomic access.
+	base    int64
+	stripes []stripe
+	// ring is the samples of a counter's rates, guarded by its registry's
+	// rates lock. Gauges have none.
+	ring *ring
+	// falls is set to one once a counter has gone down, or been set, so it
+	// can't be exported as a counter which only goes up.
+	falls int32
+}
+
+// stripeCount returns how many stripes a new registry's counters get: the
+// number of processors, rounded up to a power of two so a stripe can be
+// picked with a mask.
+func stripeCount() int {
+	n := 1
+	for n < runtime.GOMAXPROCS(0) && n < MAX_STRIPES {
+		n *= 2
+	}
+	return n
+}
+
+func newCell(stripes int) *cell {
+	return &cell{stripes: make([]stripe, stripes)}
+}
+
+/*
+sources are the random sources stripes are picked with. math/rand's top-level
+functions share one source behind a lock, which every processor would queue
+for, so each processor gets a source of its own from the pool, seeded
+differently, and picking a stripe neither locks nor allocates.
+*/
+var sources = sync.Pool{New: func() interface{} {
+	return rand.New(rand.NewSource(time.Now().UnixNano() + int64(atomic.AddUint32(&seeds, 1))))
+}}
+
+// seeds counts the sources made, so sources made at once still differ.
+var seeds uint32
+
+// add adds delta to the cell, on a random stripe.
+func (c *cell) add(delta int) {
+	source := sources.Get().(*rand.Rand)
+	i := int(source.Uint32()) & (len(c.stripes) - 1)
+	sources.Put(source)
+	atomic.AddInt64(&c.stripes[i].n, int64(delta))
+}
+
+// fall marks the cell as having gone down, or been set.
+func (c *cell) fall() {
+	atomic.StoreInt32(&c.falls, 1)
+}
+
+func (c *cell) fallen() bool {
+	return atomic.LoadInt32(&c.falls) != 0
+}
+
+// total returns the sum of the stripes.
+func (c *cell) total() int {
+	var sum int64
+	for i := range c.stripes {
+		sum += atomic.LoadInt64(&c.stripes[i].n)
+	}
+	return int(sum)
+}
+
+func (c *cell) get() int {
+	return c.total() - int(atomic.LoadInt64(&c.base))
+}
+
+// take returns the cell's value and makes it zero. Unlike a get then a set,
+// no add racing with it is lost: each lands either in what is returned or in
+// what is left.
+func (c *cell) take() int {
+	for {
+		base := atomic.LoadInt64(&c.base)
+		total := int64(c.total())
+		if atomic.CompareAndSwapInt64(&c.base, base, total) {
+			return int(total - base)
+		}
+	}
+}
+
+// set makes the cell's value value. An add racing with it may land either
+// side of it.
+func (c *cell) set(value int) {
+	atomic.StoreInt64(&c.base, int64(c.total()-value))
+}
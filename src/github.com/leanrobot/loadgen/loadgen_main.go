@@ -16,6 +16,8 @@ var (
 	Url     string
 
 	client http.Client
+	// stats counts the responses, by century.
+	stats = counter.NewRegistry()
 )
 
 const (
@@ -61,13 +63,13 @@ func main() {
 	time.Sleep(Timeout * 2)
 
 	// report the statistics
-	stats := counter.Export()
+	counts := stats.Export()
 	keys := []string{
 		"total", "100s", "200s", "300s", "400s", "500s", "error",
 	}
 
 	for _, key := range keys {
-		fmt.Printf("%s:\t%d\n", key, stats[key])
+		fmt.Printf("%s:\t%d\n", key, counts[key])
 	}
 }
 
@@ -100,11 +102,11 @@ takes the status code from the response and counts them up by century using
 the counter.
 */
 func worker() {
-	counter.Increment("total")
+	stats.Increment("total")
 
 	resp, err := client.Get(Url)
 	if err != nil {
-		counter.Increment("error")
+		stats.Increment("error")
 		return
 	}
 	defer resp.Body.Close()
@@ -114,5 +116,5 @@ func worker() {
 	statusKey := fmt.Sprintf("%ds", status)
 
 	// increment the status variable.
-	counter.Increment(statusKey)
+	stats.Increment(statusKey)
 }
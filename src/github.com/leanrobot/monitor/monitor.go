@@ -5,9 +5,12 @@ import (
 	"flag"
 	"fmt"
 	log "github.com/cihub/seelog"
+	"github.com/leanrobot/counter"
 	"io/ioutil"
 	"math"
 	"net/http"
+	"net/url"
+	"os"
 	"strings"
 	"time"
 )
@@ -31,18 +34,29 @@ var (
 
 	dataSet map[string]map[string][]Sample
 
+	// delta is set to sample the changes since the last sample rather than
+	// totals, as the scraper id.
+	delta bool
+	id    string
+	// lastDeltas are the last deltas from each target, to spot restarts.
+	lastDeltas map[string]counter.Delta
+
 	client  *http.Client
 	timeout time.Duration
 )
 
 func initFlags() {
 	targetStr := flag.String("targets", DEF_TARGET_STR, "comma separated list of urls to sample")
-	targets = strings.Split(*targetStr, ",")
 
 	flag.DurationVar(&runtime, "runtime", DEF_RUNTIME, "time to run the monitoring service")
 	flag.DurationVar(&sampleInterval, "sample-interval", DEF_SAMPLE_INTERVAL,
 		"the interval at which to sample")
+	flag.BoolVar(&delta, "delta", false,
+		"sample the changes since the last sample, rather than totals")
+	flag.StringVar(&id, "id", fmt.Sprintf("monitor-%d", os.Getpid()),
+		"the scraper id to sample deltas as")
 	flag.Parse()
+	targets = strings.Split(*targetStr, ",")
 }
 
 func initClient() {
@@ -58,6 +72,7 @@ func initStructure() {
 	for _, t := range targets {
 		dataSet[t] = make(map[string][]Sample)
 	}
+	lastDeltas = make(map[string]counter.Delta)
 }
 
 func main() {
@@ -124,6 +139,10 @@ func recordResults(target string, data map[string]int) error {
 }
 
 func requestData(target string) (map[string]int, error) {
+	if delta {
+		return requestDelta(target)
+	}
+
 	// make http request.
 	resp, err := client.Get(target)
 	if err != nil {
@@ -146,3 +165,41 @@ func requestData(target string) (map[string]int, error) {
 
 	return data, nil
 }
+
+// requestDelta requests the changes at target since the last sample, warning
+// if they aren't since the last sample after all.
+func requestDelta(target string) (map[string]int, error) {
+	separator := "?"
+	if strings.Contains(target, "?") {
+		separator = "&"
+	}
+	resp, err := client.Get(target + separator + "delta=1&id=" + url.QueryEscape(id))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var current counter.Delta
+	err = json.NewDecoder(resp.Body).Decode(&current)
+	if err != nil {
+		return nil, err
+	}
+
+	last, seen := lastDeltas[target]
+	switch {
+	case seen && !current.Start.Equal(last.Start):
+		log.Warnf("%s restarted at %s; changes since its last sample are lost",
+			target, current.Start)
+	case seen && current.Seq == 1:
+		log.Warnf("%s forgot this monitor; the values are totals since it started",
+			target)
+	case seen && current.Seq != last.Seq+1:
+		log.Warnf("%s sent sample %d after %d; the changes in the ones between are lost",
+			target, current.Seq, last.Seq)
+	case !seen && current.Seq != 1:
+		log.Warnf("%s has seen the id %s before; the first values are since then",
+			target, id)
+	}
+	lastDeltas[target] = current
+	return current.Values, nil
+}
@@ -1,50 +1,152 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	log "github.com/cihub/seelog"
 	"github.com/leanrobot/counter"
 	cmap "github.com/leanrobot/timeserver/concurrentmap"
 	"github.com/leanrobot/timeserver/config"
+	"github.com/leanrobot/timeserver/raft"
+	"github.com/leanrobot/timeserver/record"
+	"github.com/leanrobot/timeserver/replication"
 	"github.com/leanrobot/timeserver/server"
+	"github.com/leanrobot/timeserver/store"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 )
 
 const (
 	AUTH_KEY string = "cookie"
-	NAME_KEY string = "name"
+
+	// how stale a session's last seen time may get before /get updates it.
+	LAST_SEEN_RESOLUTION = time.Minute
+
+	// how long a shutdown waits for the requests in flight.
+	SHUTDOWN_TIMEOUT = 5 * time.Second
 )
 
 var (
-	users *cmap.CMap
+	users store.Store
+	// node replicates users to followers, or from the primary, if the
+	// authserver replicates.
+	node *replication.Node
+	// cluster is this authserver's node of a consensus cluster, if it is
+	// in one, in which case it is users.
+	cluster *raft.Node
 )
 
 func main() {
-	// initialize the concurrent map.
-	users = cmap.New()
+	dumpFormat, err := cmap.ParseFormat(config.DumpFormat)
+	if err != nil {
+		log.Critical(err)
+		log.Flush()
+		os.Exit(1)
+	}
+	keyring, err := loadKeyring()
+	if err != nil {
+		log.Criticalf("could not load dumpfile keys: %s", err)
+		log.Flush()
+		os.Exit(1)
+	}
 
-	// if dumpfile is specified, load the dumpfile.
-	if config.DumpFile != "" {
-		log.Info("Loading from dumpfile...")
-		loadUsers, err := cmap.LoadFromDisk(config.DumpFile)
+	// open the session store. sessions expire after the session ttl, and
+	// the least recently used are evicted once the map is full.
+	storeOpts := store.Options{
+		Path: config.DumpFile,
+		Map: cmap.Options{
+			DefaultTTL:      config.SessionTTL,
+			ReapInterval:    config.SessionReapInterval,
+			MaxEntries:      config.MaxSessions,
+			MaxBytes:        config.MaxSessionBytes,
+			EvictionCounter: "session-evictions",
+			Format:          dumpFormat,
+			Keyring:         keyring,
+			Stats:           cmap.NewStats("sessions"),
+		},
+		CompactInterval: time.Duration(config.CheckpointInterval) * time.Millisecond,
+		Retention: cmap.Retention{
+			Generations: config.SnapshotGenerations,
+			MaxAge:      config.SnapshotMaxAge,
+		},
+	}
+	counter.GaugeFunc("sessions", storeOpts.Map.Stats.Size)
+	counter.Describe("sessions", "Unexpired sessions in the session store.")
+	kind := config.StoreKind
+	if kind == "" {
+		kind = store.MEMORY
+		if config.DumpFile != "" {
+			kind = store.JSON
+		}
+	}
+
+	if config.Cluster != "" {
+		if config.ReplicateFrom != "" || config.RestoreFrom != "" || keyring != nil {
+			log.Critical("a cluster can't replicate, restore or encrypt its sessions")
+			log.Flush()
+			os.Exit(1)
+		}
+		kind = "cluster"
+	}
+
+	if keyring != nil {
+		if kind != store.JSON {
+			log.Criticalf("the %s store can't be encrypted, only the json store", kind)
+			log.Flush()
+			os.Exit(1)
+		}
+		log.Infof("Encrypting dumpfile with key %s", keyring.PrimaryID())
+	}
+
+	if config.RestoreFrom != "" {
+		if kind != store.JSON {
+			log.Criticalf("the %s store has no generations to restore, only the json store", kind)
+			log.Flush()
+			os.Exit(1)
+		}
+		generation, err := cmap.RestoreGeneration(config.DumpFile,
+			config.RestoreFrom, storeOpts.Map)
 		if err != nil {
-			// couldn't load the dumpfile, it must be corrupted or not exist.
-			// write over it with the empty map.
-			err = cmap.WriteToDisk(config.DumpFile, users)
-			if err != nil {
-				// well i dunno what to do here. panic!!!
-				panic(err)
-			}
-			loadUsers, _ = cmap.LoadFromDisk(config.DumpFile)
+			log.Criticalf("could not restore %s: %s", config.RestoreFrom, err)
+			log.Flush()
+			os.Exit(1)
 		}
-		users = loadUsers
+		log.Warnf("Restored sessions from generation %d, written %s",
+			generation.Number, generation.Time.Format(time.RFC3339))
+	}
 
-		if config.CheckpointInterval != config.DEFAULT_CHECKPOINT_INTERVAL {
-			// if checkpoint interval is specified, setup backup process.
-			go cmap.BackupAtInterval(users, config.DumpFile,
-				time.Duration(config.CheckpointInterval)*time.Millisecond)
+	log.Infof("Opening %s session store...", kind)
+	if config.Cluster != "" {
+		cluster, err = openCluster(storeOpts.Map)
+		users = cluster
+	} else {
+		users, err = store.Open(kind, storeOpts)
+	}
+	if err != nil {
+		// the store exists but couldn't be read. refuse to start rather
+		// than write over user data.
+		log.Criticalf("could not open %s store %s: %s", kind, config.DumpFile, err)
+		log.Flush()
+		os.Exit(1)
+	}
+	// a cluster never loads a dumpfile, and a follower replaces its store
+	// with the primary's, so neither can hold values from before records
+	// existed.
+	if cluster == nil && config.ReplicateFrom == "" {
+		migrated, err := record.Migrate(users)
+		if err != nil {
+			log.Criticalf("could not migrate sessions to records: %s", err)
+			log.Flush()
+			os.Exit(1)
+		}
+		if migrated > 0 {
+			log.Infof("Migrated %d sessions stored as bare usernames to records", migrated)
 		}
 	}
 
@@ -54,29 +156,114 @@ func main() {
 	vh.HandlePattern("/get", getName)
 	vh.HandlePattern("/set", setName)
 	vh.HandlePattern("/clear", clearName)
-	vh.HandlePattern("/monitor", server.MonitorHandler)
+
+	if cluster != nil {
+		vh.HandlePattern("/monitor", server.MonitorHandlerWith(cluster.Stats,
+			storeOpts.Map.Stats.Export))
+		vh.HandlePattern("/metrics", server.MetricsHandlerWith(cluster.Stats,
+			storeOpts.Map.Stats.Export))
+		vh.HandlePattern(raft.VOTE_PATH, cluster.ServeVote)
+		vh.HandlePattern(raft.APPEND_PATH, cluster.ServeAppend)
+		vh.HandlePattern(raft.INSTALL_SNAPSHOT_PATH, cluster.ServeInstallSnapshot)
+	} else if config.Replicate || config.ReplicateFrom != "" {
+		secret, err := loadSecret(config.ReplicationSecretFile,
+			config.REPLICATION_SECRET_ENV)
+		if err == nil && secret == "" {
+			err = fmt.Errorf("-replication-secret-file or $%s is required",
+				config.REPLICATION_SECRET_ENV)
+		}
+		if err != nil {
+			log.Criticalf("could not load the replication secret: %s", err)
+			log.Flush()
+			os.Exit(1)
+		}
+		opts := replication.Options{Secret: secret}
+		if config.ReplicateFrom != "" {
+			log.Infof("Following primary %s", config.ReplicateFrom)
+			node = replication.NewFollower(users, config.ReplicateFrom, opts)
+		} else {
+			node = replication.NewPrimary(users, opts)
+		}
+		users = node
+		vh.HandlePattern("/monitor", server.MonitorHandlerWith(node.Stats,
+			storeOpts.Map.Stats.Export))
+		vh.HandlePattern("/metrics", server.MetricsHandlerWith(node.Stats,
+			storeOpts.Map.Stats.Export))
+		vh.HandlePattern(replication.SNAPSHOT_PATH, node.ServeSnapshot)
+		vh.HandlePattern(replication.STREAM_PATH, node.ServeStream)
+		vh.HandlePattern(replication.PROMOTE_PATH, node.ServePromote)
+	} else {
+		vh.HandlePattern("/monitor", server.MonitorHandlerWith(
+			storeOpts.Map.Stats.Export))
+		vh.HandlePattern("/metrics", server.MetricsHandlerWith(
+			storeOpts.Map.Stats.Export))
+	}
 
 	portString := fmt.Sprintf(":%d", config.AuthPort)
+	httpServer := &http.Server{Addr: portString, Handler: vh}
+	stopped := make(chan bool)
+	go shutdownOnSignal(httpServer, stopped)
 
 	log.Infof("authserver listening on port %d", config.AuthPort)
-	err := http.ListenAndServe(portString, vh)
+	err = httpServer.ListenAndServe()
 
-	if err != nil {
+	if err == http.ErrServerClosed {
+		// let the requests in flight finish before closing the store.
+		<-stopped
+	} else if err != nil {
 		log.Critical("authserver Failure: ", err)
 	}
 
+	// closing the store writes its last checkpoint.
+	if err := users.Close(); err != nil {
+		log.Errorf("could not close the session store: %s", err)
+	}
 	log.Info("authserver exiting..")
+	log.Flush()
 }
 
-// View for /get
+// shutdownOnSignal shuts httpServer down on SIGINT or SIGTERM, giving the
+// requests in flight SHUTDOWN_TIMEOUT to finish, then closes stopped.
+func shutdownOnSignal(httpServer *http.Server, stopped chan bool) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	log.Infof("authserver shutting down on %s", <-signals)
+
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		// a replication stream is never idle, so cut off what's left.
+		httpServer.Close()
+	}
+	close(stopped)
+}
+
+// View for /get. Responds with the session record as JSON, or an empty body
+// if the session doesn't exist.
 func getName(res http.ResponseWriter, req *http.Request) {
 	defer server.LogRequest(req, http.StatusOK)
 	counter.Increment("get-cookie")
 
 	uuid := req.FormValue(AUTH_KEY)
-	if len(uuid) > 0 { // valid request path, return 200 and username
-		name, _ := users.Get(uuid)
-		io.WriteString(res, name)
+	if len(uuid) > 0 { // valid request path, return 200 and session
+		value, ok, err := users.Get(uuid)
+		if err != nil {
+			log.Errorf("could not get session %s: %s", uuid, err)
+			server.Error500(res, req)
+			return
+		}
+		if !ok {
+			return
+		}
+		session, err := record.Decode(value)
+		if err != nil {
+			log.Errorf("bad session record for %s: %s", uuid, err)
+			return
+		}
+		touch(uuid, value, session)
+
+		res.Header().Set("Content-Type", "application/json")
+		io.WriteString(res, session.Encode())
 		return
 	}
 
@@ -84,27 +271,134 @@ func getName(res http.ResponseWriter, req *http.Request) {
 	server.Error400(res, req)
 }
 
-// View for /set
-func setName(res http.ResponseWriter, req *http.Request) {
-	defer server.LogRequest(req, http.StatusOK)
-	counter.Increment("set-cookie")
+/*
+touch updates the last seen time of a session, at most once every
+LAST_SEEN_RESOLUTION so page views don't turn into writes.
+*/
+func touch(uuid string, value string, session *record.Session) {
+	now := time.Now().UTC()
+	if now.Sub(session.LastSeen) < LAST_SEEN_RESOLUTION {
+		return
+	}
+	session.LastSeen = now
+	// only store the update if the session hasn't changed or been cleared
+	// since it was read.
+	// followers can't, but the primary or leader updates them anyway.
+	_, err := users.CompareAndSwap(uuid, value, session.Encode())
+	if _, notLeader := err.(raft.ErrNotLeader); notLeader {
+		return
+	}
+	if err != nil && err != replication.ErrReadOnly {
+		log.Errorf("could not update session %s: %s", uuid, err)
+	}
+}
 
+// View for /set. The session record is built from the record form values.
+// An existing session is never replaced; setting one responds with 409.
+func setName(res http.ResponseWriter, req *http.Request) {
 	uuid := req.FormValue(AUTH_KEY)
-	name := req.FormValue(NAME_KEY)
-	if len(name) > 0 && len(uuid) > 0 { // valid request path, return 200
-		users.Set(uuid, name)
-	} else { // non-valid request, return 400
+	session := record.FromForm(req.Form)
+	if len(session.Username) == 0 || len(uuid) == 0 { // non-valid request, return 400
 		server.Error400(res, req)
+		return
 	}
+	stored, err := users.SetIfAbsent(uuid, session.Encode())
+	if err != nil {
+		storeError(res, req, "could not set session "+uuid, err)
+		return
+	}
+	if !stored { // id taken, return 409
+		counter.Increment("set-cookie-conflict")
+		server.Error409(res, req)
+		return
+	}
+	// valid request path, return 200
+	server.LogRequest(req, http.StatusOK)
+	counter.Increment("set-cookie")
 }
 
 // View for /clear
 func clearName(res http.ResponseWriter, req *http.Request) {
 	defer server.LogRequest(req, http.StatusOK)
-	uuid := req.FormValue("uuid")
+	uuid := req.FormValue(AUTH_KEY)
 	if len(uuid) > 0 {
-		users.Del(uuid)
+		if err := users.Del(uuid); err != nil {
+			storeError(res, req, "could not clear session "+uuid, err)
+		}
 	} else { // non-valid request, return 400
 		server.Error400(res, req)
 	}
 }
+
+/*
+storeError responds to a failed write to the store: 503 on a read only
+follower, so the client knows to try the primary, and 500 otherwise. A cluster
+node which isn't the leader redirects the write to the leader, or responds
+503 while there is none.
+*/
+func storeError(res http.ResponseWriter, req *http.Request, what string, err error) {
+	if notLeader, ok := err.(raft.ErrNotLeader); ok {
+		if notLeader.Leader == "" {
+			server.Error502(res, req)
+			return
+		}
+		server.Redirect307(res, req, notLeader.Leader+req.URL.RequestURI())
+		return
+	}
+	if err == replication.ErrReadOnly {
+		server.Error502(res, req)
+		return
+	}
+	log.Errorf("%s: %s", what, err)
+	server.Error500(res, req)
+}
+
+// openCluster joins the consensus cluster of the authservers in -cluster.
+func openCluster(opts cmap.Options) (*raft.Node, error) {
+	self := config.ClusterSelf
+	if self == "" {
+		self = fmt.Sprintf("http://localhost:%d", config.AuthPort)
+	}
+	dir := config.ClusterDir
+	if dir == "" {
+		dir = fmt.Sprintf("cluster-%d", config.AuthPort)
+	}
+	secret, err := loadSecret(config.ClusterSecretFile, config.CLUSTER_SECRET_ENV)
+	if err != nil {
+		return nil, err
+	}
+	if secret == "" {
+		return nil, fmt.Errorf("-cluster-secret-file or $%s is required",
+			config.CLUSTER_SECRET_ENV)
+	}
+	peers := strings.Split(config.Cluster, ",")
+	for i := range peers {
+		peers[i] = strings.TrimRight(strings.TrimSpace(peers[i]), "/")
+	}
+	log.Infof("Joining cluster %v as %s", peers, self)
+	return raft.Open(raft.Config{
+		ID: self, Peers: peers, Dir: dir, Map: opts, Secret: secret,
+	})
+}
+
+// loadKeyring loads the dumpfile keys from the key file, or from the
+// environment if there is no key file. It returns nil if there are no keys.
+func loadKeyring() (*cmap.Keyring, error) {
+	if config.DumpKeyFile != "" {
+		return cmap.LoadKeyring(config.DumpKeyFile)
+	}
+	if keys := os.Getenv(config.DUMPFILE_KEY_ENV); keys != "" {
+		return cmap.ParseKeyring(keys)
+	}
+	return nil, nil
+}
+
+// loadSecret reads a shared secret from file, or from the environment
+// variable env if there is no file. It is empty if neither is set.
+func loadSecret(file string, env string) (string, error) {
+	if file == "" {
+		return os.Getenv(env), nil
+	}
+	raw, err := ioutil.ReadFile(file)
+	return strings.TrimSpace(string(raw)), err
+}
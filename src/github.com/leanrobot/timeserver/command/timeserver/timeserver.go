@@ -25,6 +25,14 @@ const (
 	MILITARY_TIME_LAYOUT = "15:04:05"
 )
 
+// sleeps is how long timeHandler sleeps to simulate load, in milliseconds.
+var sleeps = counter.NewHistogram("time.sleep-ms", counter.DEFAULT_LATENCY_BUCKETS)
+
+func init() {
+	counter.Describe("time.sleep-ms",
+		"Time /time slept to simulate load, in milliseconds.")
+}
+
 var templates = map[string]*template.Template{
 	"index.html":       nil,
 	"time.html":        nil,
@@ -51,6 +59,7 @@ func main() {
 	vh.HandlePattern("/logout/", logoutHandler)
 	vh.HandlePattern("/about/", aboutHandler)
 	vh.HandlePattern("/monitor/", server.MonitorHandler)
+	vh.HandlePattern("/metrics/", server.MetricsHandler)
 	vh.ServeStaticFile("/css/style.css", config.TemplatesDir+"/style.css")
 
 	log.Infof("Timeserver listening on 0.0.0.0%s", portString)
@@ -100,7 +109,7 @@ func loginHandler(res http.ResponseWriter, req *http.Request) {
 	if len(username) < 1 {
 		renderBaseTemplate(res, "login_error.html", nil)
 	} else {
-		err := session.Create(res, username)
+		err := session.Create(req, res, username)
 		if err != nil {
 			log.Error(err)
 		}
@@ -137,6 +146,7 @@ func timeHandler(res http.ResponseWriter, req *http.Request) {
 		wait = 0
 	}
 	time.Sleep(time.Duration(wait) * time.Millisecond)
+	sleeps.Observe(wait)
 	log.Infof("sleep duration is %d", wait)
 
 	if username, err := session.Username(req); err == nil {
@@ -0,0 +1,174 @@
+package concurrentmap
+
+import (
+	"container/list"
+	"github.com/leanrobot/counter"
+	"sync/atomic"
+)
+
+// DEFAULT_EVICTION_COUNTER is the counter incremented for every entry evicted
+// to stay within capacity, unless Options.EvictionCounter is set.
+const DEFAULT_EVICTION_COUNTER = "cmap-evictions"
+
+/*
+A CMap with a MaxEntries or MaxBytes limit evicts its least recently used
+entries to stay within them. The map counts its entries and bytes as a whole,
+so the limits hold however the keys fall across the shards. Each shard keeps
+its own recency order, every use stamped from a counter the shards share, and
+an eviction takes the oldest of the shards' least recently used entries. The
+shards are looked at one at a time, so a write racing with an eviction can
+make it choose the second oldest instead; least recently used is otherwise
+exact.
+
+Entries are evicted once the write which went over a limit has unlocked its
+shard, since the entry evicted is usually in another shard, and a writer
+holding one shard lock while it waited for another could deadlock. Until
+then the map may be over its limits by one entry for each write in progress.
+
+Since a Get changes the recency order, Get write locks its shard on a bounded
+map, and concurrent lookups of keys in the same shard no longer run in
+parallel.
+*/
+
+// recent is a key in a shard's recency order, and when it was last used.
+type recent struct {
+	key  string
+	used uint64
+}
+
+// bounded reports whether the shard has a capacity limit.
+func (s *shard) bounded() bool {
+	return s.recency != nil
+}
+
+// entrySize is the number of bytes an entry counts against MaxBytes.
+func entrySize(key string, e entry) int {
+	return len(key) + len(e.value)
+}
+
+// limit makes the shard keep a recency order if the map has capacity limits.
+func (s *shard) limit(opts Options) {
+	if opts.MaxEntries <= 0 && opts.MaxBytes <= 0 {
+		return
+	}
+	s.recency = list.New()
+	s.elements = make(map[string]*list.Element)
+}
+
+// reset forgets every entry in s, which must be write locked.
+func (cm *CMap) reset(s *shard) {
+	if s.bounded() {
+		atomic.AddInt64(&cm.entries, -int64(len(s.values)))
+		atomic.AddInt64(&cm.bytes, -int64(s.bytes))
+		s.recency.Init()
+		s.elements = make(map[string]*list.Element)
+	}
+	s.values = make(map[string]entry)
+	s.bytes = 0
+}
+
+// touch marks key as the most recently used key in s.
+func (cm *CMap) touch(s *shard, key string) {
+	if element, ok := s.elements[key]; ok {
+		element.Value.(*recent).used = atomic.AddUint64(&cm.uses, 1)
+		s.recency.MoveToFront(element)
+	}
+}
+
+// track records that key was set to e in s, replacing old if it existed.
+func (cm *CMap) track(s *shard, key string, old entry, existed bool, e entry) {
+	if !s.bounded() {
+		return
+	}
+	size := entrySize(key, e)
+	if existed {
+		size -= entrySize(key, old)
+	} else {
+		atomic.AddInt64(&cm.entries, 1)
+	}
+	s.bytes += size
+	atomic.AddInt64(&cm.bytes, int64(size))
+	if _, ok := s.elements[key]; ok {
+		cm.touch(s, key)
+	} else {
+		use := &recent{key: key, used: atomic.AddUint64(&cm.uses, 1)}
+		s.elements[key] = s.recency.PushFront(use)
+	}
+}
+
+// untrack records that key, holding old, was removed from s.
+func (cm *CMap) untrack(s *shard, key string, old entry) {
+	if !s.bounded() {
+		return
+	}
+	s.bytes -= entrySize(key, old)
+	atomic.AddInt64(&cm.entries, -1)
+	atomic.AddInt64(&cm.bytes, -int64(entrySize(key, old)))
+	if element, ok := s.elements[key]; ok {
+		s.recency.Remove(element)
+		delete(s.elements, key)
+	}
+}
+
+// over reports whether the map holds more than its capacity.
+func (cm *CMap) over() bool {
+	return (cm.opts.MaxEntries > 0 &&
+		atomic.LoadInt64(&cm.entries) > int64(cm.opts.MaxEntries)) ||
+		(cm.opts.MaxBytes > 0 &&
+			atomic.LoadInt64(&cm.bytes) > int64(cm.opts.MaxBytes))
+}
+
+/*
+evict removes least recently used entries until the map is back within
+capacity. It must be called with no shard locked. keep, the key just written,
+is never evicted, so a single entry larger than MaxBytes is still stored.
+*/
+func (cm *CMap) evict(keep string) {
+	for cm.over() {
+		s, key := cm.oldest(keep)
+		if s == nil {
+			return
+		}
+		s.lock.Lock()
+		// the key may have been used, or removed, since it was found.
+		if use := leastRecent(s, keep); use != nil && use.key == key {
+			cm.delLocked(s, key, OpEvict)
+			counter.Increment(cm.evictionCounter())
+		}
+		s.lock.Unlock()
+	}
+}
+
+// oldest returns the least recently used key other than keep, and its shard,
+// or a nil shard if there is none.
+func (cm *CMap) oldest(keep string) (*shard, string) {
+	var found *shard
+	var key string
+	var used uint64
+	for _, s := range cm.shards {
+		s.lock.RLock()
+		if use := leastRecent(s, keep); use != nil && (found == nil || use.used < used) {
+			found, key, used = s, use.key, use.used
+		}
+		s.lock.RUnlock()
+	}
+	return found, key
+}
+
+// leastRecent returns the least recently used key in s other than keep, nil
+// if there is none. s must be locked.
+func leastRecent(s *shard, keep string) *recent {
+	for element := s.recency.Back(); element != nil; element = element.Prev() {
+		if use := element.Value.(*recent); use.key != keep {
+			return use
+		}
+	}
+	return nil
+}
+
+func (cm *CMap) evictionCounter() string {
+	if len(cm.opts.EvictionCounter) > 0 {
+		return cm.opts.EvictionCounter
+	}
+	return DEFAULT_EVICTION_COUNTER
+}
@@ -0,0 +1,91 @@
+package concurrentmap
+
+/*
+The methods in this file read and write a key as a single step, holding the
+key's shard write locked throughout, so no other write to the key can happen
+in between. Values they store expire after the map's DefaultTTL, like Set.
+*/
+
+// SetIfAbsent sets key to value only if key isn't already in the map. It
+// reports whether value was stored.
+func (cm *CMap) SetIfAbsent(key string, value string) bool {
+	defer cm.evict(key)
+	s := cm.shardFor(key)
+	start := cm.opts.Stats.lock(&s.lock, true)
+	defer cm.opts.Stats.unlock(&s.lock, true, start, opCas)
+
+	if _, ok := s.live(key, cm.now()); ok {
+		return false
+	}
+	cm.setLocked(s, key, cm.newEntry(value))
+	return true
+}
+
+// CompareAndSwap sets key to new only if its current value is old. It reports
+// whether new was stored.
+func (cm *CMap) CompareAndSwap(key string, old string, new string) bool {
+	defer cm.evict(key)
+	s := cm.shardFor(key)
+	start := cm.opts.Stats.lock(&s.lock, true)
+	defer cm.opts.Stats.unlock(&s.lock, true, start, opCas)
+
+	if current, ok := s.live(key, cm.now()); !ok || current.value != old {
+		return false
+	}
+	cm.setLocked(s, key, cm.newEntry(new))
+	return true
+}
+
+// CompareAndDelete deletes key only if its current value is old. It reports
+// whether key was deleted.
+func (cm *CMap) CompareAndDelete(key string, old string) bool {
+	s := cm.shardFor(key)
+	start := cm.opts.Stats.lock(&s.lock, true)
+	defer cm.opts.Stats.unlock(&s.lock, true, start, opCas)
+
+	if current, ok := s.live(key, cm.now()); !ok || current.value != old {
+		return false
+	}
+	cm.delLocked(s, key, OpDel)
+	return true
+}
+
+/*
+Update replaces the value of key with the result of fn. fn is given the
+current value and whether key exists; if it returns false as its second result
+key is deleted instead. Update returns the value and existence of key once fn
+has been applied.
+
+fn runs with the key's shard locked, so it must be quick and must not use the
+map.
+*/
+func (cm *CMap) Update(key string, fn func(old string, ok bool) (string, bool)) (string, bool) {
+	defer cm.evict(key)
+	s := cm.shardFor(key)
+	start := cm.opts.Stats.lock(&s.lock, true)
+	defer cm.opts.Stats.unlock(&s.lock, true, start, opCas)
+
+	current, ok := s.live(key, cm.now())
+	value, keep := fn(current.value, ok)
+	if !keep {
+		cm.delLocked(s, key, OpDel)
+		return "", false
+	}
+	cm.setLocked(s, key, cm.newEntry(value))
+	return value, true
+}
+
+// live returns the entry for key if it exists and hasn't expired at time now.
+// The shard must be locked.
+func (s *shard) live(key string, now int64) (entry, bool) {
+	e, ok := s.values[key]
+	if !ok || e.expired(now) {
+		return entry{}, false
+	}
+	return e, true
+}
+
+// newEntry creates an entry expiring after the map's DefaultTTL.
+func (cm *CMap) newEntry(value string) entry {
+	return entry{value: value, expires: cm.expiresAt(cm.opts.DefaultTTL)}
+}
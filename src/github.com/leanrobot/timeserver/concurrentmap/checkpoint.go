@@ -0,0 +1,204 @@
+package concurrentmap
+
+import (
+	"context"
+	log "github.com/cihub/seelog"
+	"github.com/leanrobot/counter"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DEFAULT_CHECKPOINT_INTERVAL is used by a Checkpointer whose options
+	// have no Interval.
+	DEFAULT_CHECKPOINT_INTERVAL = time.Minute
+	// DEFAULT_CHECKPOINT_COUNTER prefixes the counters of a Checkpointer
+	// whose options don't name one.
+	DEFAULT_CHECKPOINT_COUNTER = "checkpoint"
+)
+
+// CheckpointOptions configures a Checkpointer.
+type CheckpointOptions struct {
+	// Interval is how often the map is checkpointed once started. Zero uses
+	// DEFAULT_CHECKPOINT_INTERVAL.
+	Interval time.Duration
+
+	// OnError is called with every checkpoint that fails. Nil logs the
+	// error.
+	OnError func(err error)
+
+	/*
+		Counter prefixes the counters the checkpointer increments: Counter
+		+ "-writes" for every checkpoint written, "-skips" for every
+		checkpoint skipped because the map was unchanged, and "-errors"
+		for every one that failed. Empty uses DEFAULT_CHECKPOINT_COUNTER.
+	*/
+	Counter string
+
+	// Retention is how many generations of the dumpfile are kept. The zero
+	// value keeps none.
+	Retention Retention
+}
+
+/*
+Checkpointer periodically writes a CMap to disk, skipping the write when the
+map hasn't changed since the last one. It replaces looping over WriteToDisk by
+hand: errors are reported rather than fatal, and Stop writes any last changes
+before returning.
+*/
+type Checkpointer struct {
+	data *CMap
+	path string
+	opts CheckpointOptions
+	// write persists the map, however the checkpointer was created.
+	write func() error
+
+	// writeLock serializes checkpoints, and guards written and wroteOnce.
+	writeLock sync.Mutex
+	// written is the change count of the map as of the last checkpoint.
+	written   uint64
+	wroteOnce bool
+	// sealed is set once every generation is encrypted, if the map has a
+	// Keyring.
+	sealed bool
+
+	// stop is closed to stop the loop, which sends the error of its final
+	// checkpoint on done. Both are nil unless the loop is running.
+	runLock sync.Mutex
+	stop    chan bool
+	done    chan error
+}
+
+// NewCheckpointer creates a checkpointer which writes data to the dumpfile
+// at path with WriteToDisk.
+func NewCheckpointer(data *CMap, path string, opts CheckpointOptions) *Checkpointer {
+	return newCheckpointer(data, path, opts, func() error {
+		return WriteToDisk(path, data.Copy())
+	})
+}
+
+// NewCheckpointer creates a checkpointer which compacts the journal into its
+// dumpfile.
+func (j *Journal) NewCheckpointer(opts CheckpointOptions) *Checkpointer {
+	return newCheckpointer(j.data, j.snapshotPath, opts, j.Compact)
+}
+
+func newCheckpointer(data *CMap, path string, opts CheckpointOptions,
+	write func() error) *Checkpointer {
+	if opts.Interval <= 0 {
+		opts.Interval = DEFAULT_CHECKPOINT_INTERVAL
+	}
+	if opts.Counter == "" {
+		opts.Counter = DEFAULT_CHECKPOINT_COUNTER
+	}
+	if opts.OnError == nil {
+		opts.OnError = func(err error) {
+			log.Errorf("checkpoint failed: %s", err)
+		}
+	}
+	return &Checkpointer{data: data, path: path, opts: opts, write: write}
+}
+
+/*
+Checkpoint writes the map now, unless it hasn't changed since the last
+checkpoint. The first checkpoint is always written, so the dumpfile exists and
+matches the map. Every checkpoint written is kept as a generation of the
+dumpfile, if the Retention keeps any. The first checkpoint of a map with a
+Keyring encrypts any generations kept unencrypted, from before encryption was
+turned on. A failed checkpoint is counted and passed to OnError as well as
+returned, and is retried by the next one.
+*/
+func (c *Checkpointer) Checkpoint() error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	// read the count before writing: a write racing with the checkpoint
+	// leaves the map dirty, so the next checkpoint is sure to include it.
+	changes := atomic.LoadUint64(&c.data.changes)
+	if c.wroteOnce && changes == c.written {
+		counter.Increment(c.opts.Counter + "-skips")
+		return nil
+	}
+	if err := c.write(); err != nil {
+		counter.Increment(c.opts.Counter + "-errors")
+		c.opts.OnError(err)
+		return err
+	}
+	counter.Increment(c.opts.Counter + "-writes")
+	c.written = changes
+	c.wroteOnce = true
+
+	var err error
+	if c.opts.Retention.Generations > 0 {
+		_, err = keepGeneration(c.path)
+		if err == nil {
+			err = pruneGenerations(c.path, c.opts.Retention)
+		}
+	}
+	if err == nil && c.data.opts.Keyring != nil && !c.sealed {
+		if err = sealGenerations(c.path, c.data.opts); err == nil {
+			c.sealed = true
+		}
+	}
+	if err != nil {
+		// the dumpfile itself is written, so don't retry the checkpoint.
+		counter.Increment(c.opts.Counter + "-errors")
+		c.opts.OnError(err)
+		return err
+	}
+	return nil
+}
+
+// Start checkpoints the map immediately and then every Interval, until Stop
+// is called. Starting a running checkpointer is a no-op.
+func (c *Checkpointer) Start() {
+	c.runLock.Lock()
+	defer c.runLock.Unlock()
+
+	if c.stop != nil {
+		return
+	}
+	c.stop = make(chan bool)
+	c.done = make(chan error, 1)
+	go c.loop(c.stop, c.done)
+}
+
+func (c *Checkpointer) loop(stop chan bool, done chan error) {
+	c.Checkpoint()
+	ticker := time.NewTicker(c.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.Checkpoint()
+		case <-stop:
+			done <- c.Checkpoint()
+			return
+		}
+	}
+}
+
+/*
+Stop stops the checkpoint loop and writes a final checkpoint of any changes,
+returning its error. If ctx is done first, Stop returns ctx.Err() and the final
+checkpoint finishes in the background. Stopping a checkpointer that was never
+started only writes the final checkpoint.
+*/
+func (c *Checkpointer) Stop(ctx context.Context) error {
+	c.runLock.Lock()
+	stop, done := c.stop, c.done
+	c.stop, c.done = nil, nil
+	c.runLock.Unlock()
+
+	if stop == nil {
+		return c.Checkpoint()
+	}
+	close(stop)
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -1,73 +1,411 @@
 package concurrentmap
 
 import (
+	"container/list"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// DEFAULT_SHARD_COUNT is the number of shards used by New.
+const DEFAULT_SHARD_COUNT = 32
+
 type CMap struct {
-	values map[string]string
-	lock   *sync.Mutex
+	// changes counts every write to the map, so a checkpointer can tell
+	// whether the map changed since it was last written. First so it is
+	// 64-bit aligned for atomic access.
+	changes uint64
+	// entries and bytes count the entries of a bounded map and the bytes
+	// they hold, against its MaxEntries and MaxBytes. uses stamps each use
+	// of a key in a bounded map, for its shard's recency order.
+	entries int64
+	bytes   int64
+	uses    uint64
+
+	shards []*shard
+	opts   Options
+
+	// closed when the reaper should stop. nil if no reaper is running.
+	stopReaper chan bool
+	reaperLock sync.Mutex
+
+	// journal records every Set and Del, if the map is journaled. Only
+	// changed with every shard locked.
+	journal *Journal
+
+	watchLock    sync.RWMutex
+	watchers     []*Watcher
+	watcherCount int32
+}
+
+// shard is one independently locked partition of a CMap.
+type shard struct {
+	values map[string]entry
+	lock   sync.RWMutex
+
+	// bytes is the size of every entry, only kept if the shard is bounded.
+	bytes int
+	// recency orders keys, as *recent, from most to least recently used,
+	// and elements finds a key in it. Both are nil unless the shard is
+	// bounded.
+	recency  *list.List
+	elements map[string]*list.Element
+}
+
+// entry is a value along with the time it expires.
+type entry struct {
+	value string
+	// expires is the expiry time in Unix nanoseconds, zero if the entry
+	// never expires.
+	expires int64
+}
+
+// expired reports whether the entry has expired at time now, given in Unix
+// nanoseconds.
+func (e entry) expired(now int64) bool {
+	return e.expires != 0 && e.expires <= now
+}
+
+// Options configures a CMap created with NewWithOptions. The zero value is
+// equivalent to calling New.
+type Options struct {
+	// Shards is the number of independently locked partitions keys are
+	// hashed across. Values less than one use DEFAULT_SHARD_COUNT.
+	Shards int
+
+	// DefaultTTL is the time to live given to entries stored with Set.
+	// Zero means entries stored with Set never expire.
+	DefaultTTL time.Duration
+
+	// ReapInterval is how often the background reaper evicts expired
+	// entries. Zero means no reaper is started; expired entries are still
+	// never returned, but stay in memory until overwritten.
+	ReapInterval time.Duration
+
+	// MaxEntries and MaxBytes limit the number of entries in the map and
+	// the total length of their keys and values. Once a limit is reached
+	// the least recently used entries are evicted. Zero means no limit.
+	MaxEntries int
+	MaxBytes   int
+
+	// EvictionCounter is the counter incremented for every eviction.
+	// Empty uses DEFAULT_EVICTION_COUNTER.
+	EvictionCounter string
+	// Format is how WriteToDisk writes the map.
+	Format Format
+	// Keyring encrypts the map's dumpfile and journal. Nil leaves them
+	// unencrypted.
+	Keyring *Keyring
+	// Stats records the map's operations and lock contention. Nil records
+	// nothing.
+	Stats *Stats
+	// Clock tells the map the time, which entries expire by. Nil uses the
+	// system clock. Maps which must agree on what has expired, like the
+	// copies of a replicated state machine, share a clock of their own.
+	Clock func() time.Time
 }
 
 // New creates a new CMap and returns a pointer.
 func New() *CMap {
-	return &CMap{
-		values: make(map[string]string),
-		lock:   new(sync.Mutex),
+	return NewWithOptions(Options{})
+}
+
+// NewWithOptions creates a new CMap configured by opts and returns a pointer.
+func NewWithOptions(opts Options) *CMap {
+	count := opts.Shards
+	if count < 1 {
+		count = DEFAULT_SHARD_COUNT
+	}
+	opts.Shards = count
+	cm := &CMap{
+		shards: make([]*shard, count),
+		opts:   opts,
 	}
+	for i := range cm.shards {
+		cm.shards[i] = &shard{
+			values: make(map[string]entry),
+		}
+		cm.shards[i].limit(opts)
+	}
+	if opts.ReapInterval > 0 {
+		cm.StartReaper(opts.ReapInterval)
+	}
+	opts.Stats.attach(cm)
+	return cm
 }
 
-// Get retrieves values given a key. Safe for concurrent use.
+// Get retrieves values given a key. Safe for concurrent use. Expired entries
+// are treated as missing.
 func (cm *CMap) Get(key string) (value string, ok bool) {
-	cm.lock.Lock()
-	defer cm.lock.Unlock()
+	s := cm.shardFor(key)
+	// the lookup changes the recency order of a bounded shard.
+	write := s.bounded()
+	start := cm.opts.Stats.lock(&s.lock, write)
+	defer cm.opts.Stats.unlock(&s.lock, write, start, opGet)
+	if write {
+		cm.touch(s, key)
+	}
 
-	value, ok = cm.values[key]
-	return value, ok
+	e, ok := s.live(key, cm.now())
+	return e.value, ok
+}
+
+// GetWithExpiry is Get, also returning when the entry expires, the zero time
+// if it never does.
+func (cm *CMap) GetWithExpiry(key string) (value string, expires time.Time, ok bool) {
+	s := cm.shardFor(key)
+	write := s.bounded()
+	start := cm.opts.Stats.lock(&s.lock, write)
+	defer cm.opts.Stats.unlock(&s.lock, write, start, opGet)
+	if write {
+		cm.touch(s, key)
+	}
+
+	e, ok := s.live(key, cm.now())
+	if ok && e.expires != 0 {
+		expires = time.Unix(0, e.expires)
+	}
+	return e.value, expires, ok
 }
 
 // Set sets an appropriate key-value in the backing map. If the key already
-// exists it will be overridden.
+// exists it will be overridden. The entry expires after the map's DefaultTTL,
+// if there is one.
 func (cm *CMap) Set(key string, value string) {
-	cm.lock.Lock()
-	defer cm.lock.Unlock()
+	cm.SetWithTTL(key, value, cm.opts.DefaultTTL)
+}
+
+// SetWithTTL is like Set, but the entry expires once ttl has passed. A ttl of
+// zero or less means the entry never expires.
+func (cm *CMap) SetWithTTL(key string, value string, ttl time.Duration) {
+	defer cm.evict(key)
+	s := cm.shardFor(key)
+	start := cm.opts.Stats.lock(&s.lock, true)
+	defer cm.opts.Stats.unlock(&s.lock, true, start, opSet)
 
-	cm.values[key] = value
+	cm.setLocked(s, key, entry{value: value, expires: cm.expiresAt(ttl)})
+}
+
+// SetWithExpiry is like Set, but the entry expires at expires, or never if it
+// is the zero time. It copies an entry from another map as it was, rather
+// than starting its time to live over.
+func (cm *CMap) SetWithExpiry(key string, value string, expires time.Time) {
+	defer cm.evict(key)
+	s := cm.shardFor(key)
+	start := cm.opts.Stats.lock(&s.lock, true)
+	defer cm.opts.Stats.unlock(&s.lock, true, start, opSet)
+
+	e := entry{value: value}
+	if !expires.IsZero() {
+		e.expires = expires.UnixNano()
+	}
+	cm.setLocked(s, key, e)
 }
 
 // Delete removes a key-value from the map. If the key doesn't exist,
 // Delete is a no-op.
 func (cm *CMap) Del(key string) {
-	cm.lock.Lock()
-	defer cm.lock.Unlock()
+	s := cm.shardFor(key)
+	start := cm.opts.Stats.lock(&s.lock, true)
+	defer cm.opts.Stats.unlock(&s.lock, true, start, opDel)
+
+	cm.delLocked(s, key, OpDel)
+}
+
+/*
+setLocked stores e under key in s, which must be write locked. Every write to
+the map goes through setLocked or delLocked, which journal the write and
+notify watchers while the shard is still locked, so both see the writes to a
+key in the order they were made. Whoever calls setLocked calls evict once the
+shard is unlocked.
+*/
+func (cm *CMap) setLocked(s *shard, key string, e entry) {
+	old, existed := s.values[key]
+	s.values[key] = e
+	cm.track(s, key, old, existed, e)
+	atomic.AddUint64(&cm.changes, 1)
+	if cm.journal != nil {
+		cm.journal.append(journalRecord{
+			Op: journalSet, Key: key, Value: e.value, ExpiresAt: e.expires,
+		})
+	}
+	if existed && old.expired(cm.now()) {
+		existed = false
+	}
+	cm.notify(OpSet, key, old, existed, e)
+}
 
-	delete(cm.values, key)
+// delLocked removes key from s, which must be write locked. op is OpDel for
+// deletes made by callers, OpEvict for entries evicted to stay within
+// capacity, or OpExpire when the reaper removes the entry, which is not
+// journaled since replay drops expired entries anyway.
+func (cm *CMap) delLocked(s *shard, key string, op Op) {
+	old, existed := s.values[key]
+	if !existed {
+		return
+	}
+	delete(s.values, key)
+	cm.untrack(s, key, old)
+	atomic.AddUint64(&cm.changes, 1)
+	if cm.journal != nil && op != OpExpire {
+		cm.journal.append(journalRecord{Op: journalDel, Key: key})
+	}
+	if op == OpDel && old.expired(cm.now()) {
+		// already gone as far as anyone reading the map could tell.
+		return
+	}
+	cm.notify(op, key, old, true, entry{})
 }
 
-// Creates a copy of the CMap and returns a pointer to the copy.
+// Creates a copy of the CMap and returns a pointer to the copy. Every shard
+// is read locked for the duration of the copy, so the copy is a consistent
+// point-in-time view of the whole map. Expiry times are copied, but the copy
+// never runs a reaper of its own. The copy of a map with a Clock keeps the
+// time of the copy, so nothing more expires in it.
 func (cm *CMap) Copy() *CMap {
-	cm.lock.Lock()
-	defer cm.lock.Unlock()
+	cm.rlockAll()
+	defer cm.runlockAll()
 
-	copy := New()
-	for key, value := range cm.values {
-		copy.values[key] = value
+	opts := cm.opts
+	opts.ReapInterval = 0
+	if opts.Clock != nil {
+		at := opts.Clock()
+		opts.Clock = func() time.Time { return at }
+	}
+	// the copy's operations aren't the map's.
+	opts.Stats = nil
+	copy := NewWithOptions(opts)
+	for i, s := range cm.shards {
+		copyShard := copy.shards[i]
+		for key, e := range s.values {
+			copyShard.values[key] = e
+			copy.track(copyShard, key, entry{}, false, e)
+		}
 	}
 	return copy
 }
 
+// Equals reports whether both maps hold exactly the same unexpired
+// key-values with the same expiry times. Each map is compared as a consistent
+// snapshot.
 func (cm *CMap) Equals(other *CMap) bool {
-	for key, otherValue := range other.values {
-		value, exists := cm.values[key]
-		if !exists || value != otherValue {
-			return false
-		}
+	if cm == other {
+		return true
+	}
+	entries := cm.snapshot()
+	otherEntries := other.snapshot()
+	if len(entries) != len(otherEntries) {
+		return false
 	}
-	for key, value := range cm.values {
-		otherValue, exists := other.values[key]
-		if !exists || value != otherValue {
+	for key, e := range entries {
+		otherEntry, exists := otherEntries[key]
+		if !exists || e != otherEntry {
 			return false
 		}
 	}
 	return true
 }
+
+// snapshot returns a consistent copy of every unexpired entry as a plain map.
+func (cm *CMap) snapshot() map[string]entry {
+	cm.rlockAll()
+	defer cm.runlockAll()
+
+	current := cm.now()
+	entries := make(map[string]entry)
+	for _, s := range cm.shards {
+		for key, e := range s.values {
+			if !e.expired(current) {
+				entries[key] = e
+			}
+		}
+	}
+	return entries
+}
+
+// load replaces the contents of the map with entries, leaving out those which
+// have expired.
+func (cm *CMap) load(entries map[string]entry) {
+	defer cm.evict("")
+	cm.lockAll()
+	defer cm.unlockAll()
+
+	for _, s := range cm.shards {
+		cm.reset(s)
+	}
+	current := cm.now()
+	for key, e := range entries {
+		if e.expired(current) {
+			continue
+		}
+		s := cm.shardFor(key)
+		s.values[key] = e
+		cm.track(s, key, entry{}, false, e)
+	}
+}
+
+// attachJournal makes j record every following Set and Del. A nil journal
+// stops recording.
+func (cm *CMap) attachJournal(j *Journal) {
+	cm.lockAll()
+	defer cm.unlockAll()
+
+	cm.journal = j
+}
+
+// applyRecord replays a journal record. It is only used before a journal is
+// attached to the map, so the record isn't journaled again.
+func (cm *CMap) applyRecord(record journalRecord) {
+	defer cm.evict(record.Key)
+	s := cm.shardFor(record.Key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	e := entry{value: record.Value, expires: record.ExpiresAt}
+	if record.Op == journalSet && !e.expired(cm.now()) {
+		cm.setLocked(s, record.Key, e)
+	} else {
+		cm.delLocked(s, record.Key, OpDel)
+	}
+}
+
+// shardFor returns the shard responsible for key, using 32 bit FNV-1a.
+func (cm *CMap) shardFor(key string) *shard {
+	const (
+		offset32 = 2166136261
+		prime32  = 16777619
+	)
+	hash := uint32(offset32)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= prime32
+	}
+	return cm.shards[hash%uint32(len(cm.shards))]
+}
+
+// Shards are always locked in index order so that whole-map operations can
+// never deadlock with each other.
+
+func (cm *CMap) rlockAll() {
+	for _, s := range cm.shards {
+		s.lock.RLock()
+	}
+}
+
+func (cm *CMap) runlockAll() {
+	for _, s := range cm.shards {
+		s.lock.RUnlock()
+	}
+}
+
+func (cm *CMap) lockAll() {
+	for _, s := range cm.shards {
+		s.lock.Lock()
+	}
+}
+
+func (cm *CMap) unlockAll() {
+	for _, s := range cm.shards {
+		s.lock.Unlock()
+	}
+}
@@ -0,0 +1,991 @@
+package concurrentmap
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/leanrobot/counter"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	tst "testing"
+	"time"
+)
+
+func TestSetGetDel(t *tst.T) {
+	cm := New()
+	cm.Set("foo", "bar")
+	if value, ok := cm.Get("foo"); !ok || value != "bar" {
+		t.Errorf("Get(foo) = %q, %v, expected %q, true", value, ok, "bar")
+	}
+	cm.Del("foo")
+	if _, ok := cm.Get("foo"); ok {
+		t.Errorf("Get(foo) found a deleted key")
+	}
+}
+
+func TestCopyEqualsAcrossShards(t *tst.T) {
+	cm := NewWithOptions(Options{Shards: 7})
+	for i := 0; i < 500; i++ {
+		cm.Set(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+	}
+	copy := cm.Copy()
+	if !cm.Equals(copy) || !copy.Equals(cm) {
+		t.Errorf("copy is not equal to the original")
+	}
+
+	// equality doesn't depend on shard count.
+	other := NewWithOptions(Options{Shards: 3})
+	other.load(cm.snapshot())
+	if !cm.Equals(other) {
+		t.Errorf("maps with different shard counts are not equal")
+	}
+
+	copy.Set("key1", "changed")
+	if cm.Equals(copy) {
+		t.Errorf("maps with different values are equal")
+	}
+	copy.Set("key1", "value1")
+	copy.Del("key2")
+	if cm.Equals(copy) || copy.Equals(cm) {
+		t.Errorf("maps with different keys are equal")
+	}
+}
+
+func TestConcurrentAccess(t *tst.T) {
+	cm := New()
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := fmt.Sprintf("%d-%d", w, i)
+				cm.Set(key, key)
+				cm.Get(key)
+				if i%2 == 0 {
+					cm.Del(key)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if count := len(cm.snapshot()); count != 8*500 {
+		t.Errorf("got %d keys, expected %d", count, 8*500)
+	}
+}
+
+// Benchmarks ====
+
+// mutexMap is the original single sync.Mutex design, kept here as the
+// baseline the sharded CMap is measured against.
+type mutexMap struct {
+	values map[string]string
+	lock   sync.Mutex
+}
+
+func (mm *mutexMap) Get(key string) (string, bool) {
+	mm.lock.Lock()
+	defer mm.lock.Unlock()
+	value, ok := mm.values[key]
+	return value, ok
+}
+
+func (mm *mutexMap) Set(key string, value string) {
+	mm.lock.Lock()
+	defer mm.lock.Unlock()
+	mm.values[key] = value
+}
+
+type benchMap interface {
+	Get(key string) (string, bool)
+	Set(key string, value string)
+}
+
+const benchKeys = 4096
+
+var benchShardCounts = []int{1, 4, 16, 32, 64, 256}
+
+func benchKeySet() []string {
+	keys := make([]string, benchKeys)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%032x", i*2654435761)
+	}
+	return keys
+}
+
+// runMixed runs a parallel workload where one operation in writeEvery is a
+// Set and the rest are Gets, approximating authserver session lookups.
+func runMixed(b *tst.B, m benchMap, writeEvery int) {
+	keys := benchKeySet()
+	for _, key := range keys {
+		m.Set(key, "username")
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *tst.PB) {
+		i := 0
+		for pb.Next() {
+			key := keys[i%benchKeys]
+			if i%writeEvery == 0 {
+				m.Set(key, "username")
+			} else {
+				m.Get(key)
+			}
+			i++
+		}
+	})
+}
+
+func benchmarkWorkload(b *tst.B, writeEvery int) {
+	b.Run("mutex", func(b *tst.B) {
+		runMixed(b, &mutexMap{values: make(map[string]string)}, writeEvery)
+	})
+	for _, shards := range benchShardCounts {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *tst.B) {
+			runMixed(b, NewWithOptions(Options{Shards: shards}), writeEvery)
+		})
+	}
+}
+
+func BenchmarkReadHeavy(b *tst.B) {
+	benchmarkWorkload(b, 100)
+}
+
+func BenchmarkMixed(b *tst.B) {
+	benchmarkWorkload(b, 4)
+}
+
+func BenchmarkWriteOnly(b *tst.B) {
+	benchmarkWorkload(b, 1)
+}
+
+// setClock replaces the package clock with a fixed time for the duration of a
+// test, returning a function which advances it.
+func setClock(t *tst.T) func(d time.Duration) {
+	current := time.Now().UnixNano()
+	original := now
+	now = func() int64 { return current }
+	t.Cleanup(func() { now = original })
+	return func(d time.Duration) { current += int64(d) }
+}
+
+func TestExpiry(t *tst.T) {
+	advance := setClock(t)
+	cm := NewWithOptions(Options{DefaultTTL: time.Minute})
+	cm.Set("default", "a")
+	cm.SetWithTTL("short", "b", time.Second)
+	cm.SetWithTTL("forever", "c", 0)
+
+	advance(2 * time.Second)
+	if _, ok := cm.Get("short"); ok {
+		t.Errorf("Get returned an expired entry")
+	}
+	if _, ok := cm.Get("default"); !ok {
+		t.Errorf("Get didn't return an unexpired entry")
+	}
+
+	advance(time.Hour)
+	cm.Reap()
+	if count := len(cm.shardFor("default").values); count != 0 {
+		t.Errorf("reap left %d entries in the shard for default", count)
+	}
+	if value, ok := cm.Get("forever"); !ok || value != "c" {
+		t.Errorf("Get(forever) = %q, %v, expected %q, true", value, ok, "c")
+	}
+}
+
+func TestClock(t *tst.T) {
+	at := time.Unix(1000, 0)
+	clock := func() time.Time { return at }
+	cm := NewWithOptions(Options{DefaultTTL: time.Minute, Clock: clock})
+	cm.Set("a", "1")
+	if _, ok := cm.Get("a"); !ok {
+		t.Fatalf("Get didn't return an entry set by the map's clock")
+	}
+	cm.RangeWithExpiry(func(key string, value string, expires time.Time) bool {
+		if !expires.Equal(at.Add(time.Minute)) {
+			t.Errorf("%s expires at %s, expected a minute after the clock", key, expires)
+		}
+		return true
+	})
+
+	// an entry copied with its expiry keeps it, whatever the DefaultTTL.
+	cm.SetWithExpiry("b", "2", at.Add(time.Second))
+	cm.SetWithExpiry("c", "3", time.Time{})
+	if _, expires, ok := cm.GetWithExpiry("b"); !ok || !expires.Equal(at.Add(time.Second)) {
+		t.Errorf("GetWithExpiry(b) expires %s, %v, expected a second after the clock", expires, ok)
+	}
+	if _, expires, ok := cm.GetWithExpiry("c"); !ok || !expires.IsZero() {
+		t.Errorf("GetWithExpiry(c) expires %s, %v, expected never", expires, ok)
+	}
+	cm.Del("b")
+	cm.Del("c")
+
+	// the copy keeps the time it was made.
+	copy := cm.Copy()
+	at = at.Add(time.Hour)
+	if _, ok := cm.Get("a"); ok {
+		t.Errorf("Get returned an entry expired by the map's clock")
+	}
+	if _, ok := copy.Get("a"); !ok {
+		t.Errorf("the copy's entry expired after the copy was made")
+	}
+
+	// what has expired is up to the clock of the map loaded into.
+	path := filepath.Join(t.TempDir(), "dump")
+	if err := WriteToDisk(path, copy); err != nil {
+		t.Fatal(err)
+	}
+	at = time.Unix(1000, 0)
+	loaded, err := LoadFromDiskWithOptions(path, Options{Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := loaded.Get("a"); !ok {
+		t.Errorf("loading dropped an entry live by the map's clock")
+	}
+}
+
+func TestDiskExpiry(t *tst.T) {
+	advance := setClock(t)
+	path := filepath.Join(t.TempDir(), "dump.json")
+
+	cm := New()
+	cm.SetWithTTL("short", "a", time.Second)
+	cm.SetWithTTL("long", "b", time.Hour)
+	cm.Set("forever", "c")
+	if err := WriteToDisk(path, cm); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadFromDisk(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cm.Equals(loaded) {
+		t.Errorf("loaded map differs from the map written")
+	}
+
+	advance(time.Minute)
+	loaded, err = LoadFromDisk(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := loaded.shardFor("short").values["short"]; ok {
+		t.Errorf("an entry which expired on disk was loaded")
+	}
+	if _, ok := loaded.Get("long"); !ok {
+		t.Errorf("an unexpired entry was not loaded")
+	}
+}
+
+func TestLoadLegacyDumpfile(t *tst.T) {
+	path := filepath.Join(t.TempDir(), "dump.json")
+	if err := ioutil.WriteFile(path, []byte(`{"abc":"tom"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cm, err := LoadFromDisk(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := cm.Get("abc"); !ok || value != "tom" {
+		t.Errorf("Get(abc) = %q, %v, expected %q, true", value, ok, "tom")
+	}
+}
+
+func TestJournalReplay(t *tst.T) {
+	path := filepath.Join(t.TempDir(), "dump.json")
+	cm, j, err := OpenJournaled(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm.Set("a", "1")
+	cm.Set("b", "2")
+	if err := j.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	cm.Set("a", "3")
+	cm.Del("b")
+	cm.Set("c", "4")
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a crash part way through appending a record.
+	file, err := os.OpenFile(path+".journal", os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`1234abcd {"op":"set","key":"d"`)
+	file.Close()
+
+	reopened, j, err := OpenJournaled(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if !cm.Equals(reopened) {
+		t.Errorf("replayed map %v, expected %v",
+			reopened.snapshot(), cm.snapshot())
+	}
+
+	// records appended after the torn one must still replay.
+	reopened.Set("e", "5")
+	j.Close()
+	again, j, err := OpenJournaled(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if value, ok := again.Get("e"); !ok || value != "5" {
+		t.Errorf("Get(e) = %q, %v, expected %q, true", value, ok, "5")
+	}
+	j.Close()
+
+	// a corrupt record with more after it is not a torn write.
+	raw, err := ioutil.ReadFile(path + ".journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := bytes.Replace(raw, []byte(`"key":"e"`), []byte(`"key":"f"`), 1)
+	ioutil.WriteFile(path+".journal", append(corrupt, raw...), 0600)
+	if _, _, err := OpenJournaled(path, Options{}); err == nil {
+		t.Errorf("opened a journal corrupt before its last record")
+	}
+}
+
+func TestCompactAfterFailure(t *tst.T) {
+	path := filepath.Join(t.TempDir(), "dump.json")
+	cm, j, err := OpenJournaled(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm.Set("a", "1")
+	if err := j.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a backup which can't be replaced makes writing the snapshot fail,
+	// leaving b only in the old journal.
+	os.MkdirAll(filepath.Join(path+".bak", "blocked"), 0700)
+	cm.Set("b", "2")
+	if err := j.Compact(); err == nil {
+		t.Fatalf("compacted without writing the snapshot")
+	}
+	// the next compaction mustn't replace the old journal with the new.
+	cm.Set("c", "3")
+	if err := j.Compact(); err == nil {
+		t.Fatalf("compacted without writing the snapshot")
+	}
+	j.Close()
+
+	os.RemoveAll(path + ".bak")
+	reopened, j, err := OpenJournaled(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if !reopened.Equals(cm) {
+		t.Errorf("reopened map %v, expected %v", reopened.snapshot(), cm.snapshot())
+	}
+}
+
+func TestRecoverFromDisk(t *tst.T) {
+	path := filepath.Join(t.TempDir(), "dump.json")
+	if _, err := RecoverFromDisk(path, Options{}); !os.IsNotExist(err) {
+		t.Errorf("expected a not exist error, got %v", err)
+	}
+
+	cm := New()
+	cm.Set("first", "1")
+	if err := WriteToDisk(path, cm); err != nil {
+		t.Fatal(err)
+	}
+	cm.Set("second", "2")
+	if err := WriteToDisk(path, cm); err != nil {
+		t.Fatal(err)
+	}
+
+	// flip a byte in the payload of the dumpfile.
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[len(raw)-2] ^= 0xff
+	if err := ioutil.WriteFile(path, raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadFromDisk(path); err == nil {
+		t.Errorf("loaded a dumpfile with a bad checksum")
+	}
+
+	recovered, err := RecoverFromDisk(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := recovered.Get("first"); !ok {
+		t.Errorf("backup dumpfile was not recovered")
+	}
+
+	// with both files damaged, recovery must fail rather than start empty.
+	if err := ioutil.WriteFile(path+".bak", raw[:5], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RecoverFromDisk(path, Options{}); err == nil || os.IsNotExist(err) {
+		t.Errorf("expected a recovery error, got %v", err)
+	}
+}
+
+func TestIteration(t *tst.T) {
+	advance := setClock(t)
+	cm := New()
+	cm.Set("user:b", "2")
+	cm.Set("user:a", "1")
+	cm.Set("admin:c", "3")
+	cm.SetWithTTL("user:expired", "4", time.Second)
+	advance(time.Minute)
+
+	if cm.Len() != 3 {
+		t.Errorf("Len() = %d, expected 3", cm.Len())
+	}
+	if keys := fmt.Sprint(cm.Keys()); keys != "[admin:c user:a user:b]" {
+		t.Errorf("Keys() = %s", keys)
+	}
+	if users := cm.ScanPrefix("user:"); len(users) != 2 || users["user:a"] != "1" {
+		t.Errorf("ScanPrefix(user:) = %v", users)
+	}
+
+	// writes made during iteration are not visible to it.
+	var seen []string
+	cm.Range(func(key string, value string) bool {
+		cm.Del("user:b")
+		cm.Set("user:z", "26")
+		seen = append(seen, key+"="+value)
+		return true
+	})
+	if fmt.Sprint(seen) != "[admin:c=3 user:a=1 user:b=2]" {
+		t.Errorf("Range saw %v", seen)
+	}
+
+	count := 0
+	cm.Range(func(key string, value string) bool {
+		count++
+		return false
+	})
+	if count != 1 {
+		t.Errorf("Range called fn %d times after it returned false", count)
+	}
+}
+
+func TestWatch(t *tst.T) {
+	advance := setClock(t)
+	cm := New()
+	w := cm.Watch(10, Block)
+
+	cm.Set("a", "1")
+	cm.Set("a", "2")
+	cm.Del("a")
+	cm.Del("missing")
+	cm.SetWithTTL("b", "3", time.Second)
+	advance(time.Minute)
+	cm.Reap()
+	w.Stop()
+
+	expected := []string{
+		"set a  -> 1", "set a 1 -> 2", "del a 2 -> ", "set b  -> 3",
+		"expire b 3 -> ",
+	}
+	var got []string
+	for event := range w.C {
+		got = append(got, fmt.Sprintf("%s %s %s -> %s",
+			event.Op, event.Key, event.OldValue, event.NewValue))
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("got events %q, expected %q", got, expected)
+	}
+}
+
+func TestWatchOverflow(t *tst.T) {
+	cm := New()
+	dropping := cm.Watch(2, Drop)
+	for i := 0; i < 5; i++ {
+		cm.Set("key", fmt.Sprint(i))
+	}
+	if dropping.Dropped() != 3 || len(dropping.C) != 2 {
+		t.Errorf("dropped %d and kept %d events, expected 3 and 2",
+			dropping.Dropped(), len(dropping.C))
+	}
+	dropping.Stop()
+
+	// changes a watcher doesn't watch don't fill its buffer.
+	deletes := cm.Watch(1, Drop, OpDel)
+	for i := 0; i < 5; i++ {
+		cm.Set("key", fmt.Sprint(i))
+	}
+	cm.Del("key")
+	if event := <-deletes.C; deletes.Dropped() != 0 || event.Op != OpDel {
+		t.Errorf("watching deletes got %s and dropped %d", event.Op, deletes.Dropped())
+	}
+	deletes.Stop()
+
+	// a blocked writer is released when the watcher stops.
+	blocking := cm.Watch(1, Block)
+	done := make(chan bool)
+	go func() {
+		cm.Set("key", "first")
+		cm.Set("key", "second")
+		done <- true
+	}()
+	select {
+	case <-done:
+		t.Fatalf("writer did not block on a full watcher")
+	case <-time.After(50 * time.Millisecond):
+	}
+	blocking.Stop()
+	<-done
+}
+
+func TestCompareAndSwap(t *tst.T) {
+	cm := New()
+	if !cm.SetIfAbsent("a", "1") || cm.SetIfAbsent("a", "2") {
+		t.Errorf("SetIfAbsent stored over an existing key")
+	}
+	if cm.CompareAndSwap("a", "2", "3") || !cm.CompareAndSwap("a", "1", "3") {
+		t.Errorf("CompareAndSwap compared incorrectly")
+	}
+	if cm.CompareAndSwap("missing", "", "1") {
+		t.Errorf("CompareAndSwap stored a missing key")
+	}
+	if cm.CompareAndDelete("a", "1") || !cm.CompareAndDelete("a", "3") {
+		t.Errorf("CompareAndDelete compared incorrectly")
+	}
+	if _, ok := cm.Get("a"); ok {
+		t.Errorf("CompareAndDelete didn't delete")
+	}
+}
+
+func TestConcurrentUpdate(t *tst.T) {
+	cm := New()
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				cm.Update("count", func(old string, ok bool) (string, bool) {
+					var count int
+					fmt.Sscan(old, &count)
+					return fmt.Sprint(count + 1), true
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	if value, _ := cm.Get("count"); value != "4000" {
+		t.Errorf("got count %s, expected 4000", value)
+	}
+
+	value, ok := cm.Update("count", func(old string, ok bool) (string, bool) {
+		return "", false
+	})
+	if _, exists := cm.Get("count"); ok || value != "" || exists {
+		t.Errorf("Update didn't delete the key")
+	}
+}
+
+func TestCapacity(t *tst.T) {
+	counter.Reset("test-evictions")
+	cm := NewWithOptions(Options{
+		Shards: 1, MaxEntries: 3, EvictionCounter: "test-evictions",
+	})
+	cm.Set("a", "1")
+	cm.Set("b", "2")
+	cm.Set("c", "3")
+	cm.Get("a") // b is now the least recently used.
+	cm.Set("d", "4")
+
+	if keys := fmt.Sprint(cm.Keys()); keys != "[a c d]" {
+		t.Errorf("Keys() = %s, expected [a c d]", keys)
+	}
+	if count := counter.Get("test-evictions"); count != 1 {
+		t.Errorf("counted %d evictions, expected 1", count)
+	}
+
+	// keys and values of 2 bytes each, so 3 entries fit in 12 bytes.
+	cm = NewWithOptions(Options{Shards: 1, MaxBytes: 12})
+	for _, key := range []string{"k1", "k2", "k3", "k4"} {
+		cm.Set(key, "vv")
+	}
+	if keys := fmt.Sprint(cm.Keys()); keys != "[k2 k3 k4]" {
+		t.Errorf("Keys() = %s, expected [k2 k3 k4]", keys)
+	}
+	cm.Set("k2", "a much longer value")
+	if keys := fmt.Sprint(cm.Keys()); keys != "[k2]" {
+		t.Errorf("Keys() = %s, expected [k2]", keys)
+	}
+
+	// the limits are the map's, however many shards the keys fall across,
+	// and the least recently used key goes whichever shard it is in.
+	cm = NewWithOptions(Options{MaxEntries: 3})
+	for i := 0; i < 100; i++ {
+		cm.Set(fmt.Sprint("key", i), "v")
+		if i == 97 {
+			cm.Get("key0") // evicted long since, so this is a no-op.
+			cm.Get("key95")
+		}
+	}
+	if keys := fmt.Sprint(cm.Keys()); keys != "[key95 key98 key99]" {
+		t.Errorf("Keys() = %s, expected [key95 key98 key99]", keys)
+	}
+	if count := cm.Len(); count != 3 {
+		t.Errorf("Len() = %d, expected 3", count)
+	}
+
+	// 7 bytes an entry, so 5 fit in 40 bytes.
+	cm = NewWithOptions(Options{MaxBytes: 40})
+	for i := 0; i < 100; i++ {
+		cm.SetIfAbsent(fmt.Sprint("key", i), "vv")
+	}
+	if keys := fmt.Sprint(cm.Keys()); keys != "[key95 key96 key97 key98 key99]" {
+		t.Errorf("Keys() = %s, expected [key95 key96 key97 key98 key99]", keys)
+	}
+}
+
+func TestDumpfileFormats(t *tst.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"json", "json+gzip", "gob", "gob+gzip"} {
+		format, err := ParseFormat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if format.String() != name {
+			t.Errorf("ParseFormat(%s).String() = %s", name, format)
+		}
+		cm := NewWithOptions(Options{Format: format})
+		cm.Set("a", "1")
+		cm.SetWithTTL("b", "2", time.Hour)
+
+		path := filepath.Join(dir, name)
+		if err := WriteToDisk(path, cm); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := LoadFromDisk(path)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if !cm.Equals(loaded) {
+			t.Errorf("%s: loaded %v, expected %v", name,
+				loaded.snapshot(), cm.snapshot())
+		}
+	}
+
+	// a version 1 dumpfile: a header with no codec, and a JSON payload.
+	payload := []byte(`{"entries":{"a":{"value":"1"}}}`)
+	v1 := append([]byte("CMAP\x01"), 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(v1[5:], crc32.Checksum(payload, castagnoli))
+	path := filepath.Join(dir, "v1")
+	if err := ioutil.WriteFile(path, append(v1, payload...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if cm, err := LoadFromDisk(path); err != nil {
+		t.Error(err)
+	} else if value, _ := cm.Get("a"); value != "1" {
+		t.Errorf("version 1 dumpfile loaded a=%q", value)
+	}
+
+	if _, err := ParseFormat("xml+zip"); err == nil {
+		t.Errorf("parsed an unknown format")
+	}
+}
+
+func TestEncryption(t *tst.T) {
+	dir := t.TempDir()
+	oldKeys, err := ParseKeyring(strings.Repeat("ab", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey := []byte("0123456789abcdef0123456789abcdef")
+	rotated, err := ParseKeyring(base64.StdEncoding.EncodeToString(newKey) +
+		"\n" + strings.Repeat("ab", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "dump")
+	cm, j, err := OpenJournaled(path, Options{Keyring: oldKeys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm.Set("session", "secret")
+	j.Compact()
+	cm.Set("journaled", "secret")
+	j.Close()
+	for _, name := range []string{path, path + ".journal"} {
+		raw, _ := ioutil.ReadFile(name)
+		if strings.Contains(string(raw), "secret") {
+			t.Errorf("%s holds plaintext: %s", name, raw)
+		}
+	}
+
+	if _, err := LoadFromDisk(path); err == nil {
+		t.Errorf("loaded an encrypted dumpfile without a key")
+	}
+	wrong, _ := NewKeyring(newKey)
+	_, err = LoadFromDiskWithOptions(path, Options{Keyring: wrong})
+	if err == nil || !strings.Contains(err.Error(), "isn't in the keyring") {
+		t.Errorf("expected an unknown key error, got %v", err)
+	}
+
+	// rotate: the old key still reads, and compaction re-encrypts.
+	reopened, j, err := OpenJournaled(path, Options{Keyring: rotated})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cm.Equals(reopened) {
+		t.Errorf("decrypted %v, expected %v", reopened.snapshot(), cm.snapshot())
+	}
+	if err := j.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+	loaded, err := LoadFromDiskWithOptions(path, Options{Keyring: wrong})
+	if err != nil {
+		t.Fatalf("dumpfile wasn't re-encrypted with the new key: %s", err)
+	}
+	if !cm.Equals(loaded) {
+		t.Errorf("loaded %v, expected %v", loaded.snapshot(), cm.snapshot())
+	}
+}
+
+func TestEncryptionTurnedOn(t *tst.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dump")
+	keyring, err := ParseKeyring(strings.Repeat("ab", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a map written unencrypted, with a backup and generations.
+	retention := CheckpointOptions{Retention: Retention{Generations: 5}}
+	cm, j, err := OpenJournaled(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpoints := j.NewCheckpointer(retention)
+	for _, value := range []string{"secret1", "secret2"} {
+		cm.Set("session", value)
+		if err := checkpoints.Checkpoint(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	j.Close()
+
+	// the first encrypted checkpoint leaves no plaintext behind.
+	cm, j, err = OpenJournaled(path, Options{Keyring: keyring})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm.Set("session", "secret3")
+	if err := j.NewCheckpointer(retention).Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	cm.Set("journaled", "secret4")
+	j.Close()
+	names, _ := filepath.Glob(path + "*")
+	if len(names) < 5 {
+		t.Errorf("expected the dumpfile, its backup, journal and generations, found %v", names)
+	}
+	for _, name := range names {
+		raw, _ := ioutil.ReadFile(name)
+		if strings.Contains(string(raw), "secret") {
+			t.Errorf("%s holds plaintext: %s", name, raw)
+		}
+	}
+	if _, err := RestoreGeneration(path, "1", Options{Keyring: keyring}); err != nil {
+		t.Errorf("couldn't restore an encrypted generation: %s", err)
+	}
+
+	// once there is a keyring, an unencrypted journal record is refused.
+	file, _ := os.OpenFile(path+".journal", os.O_WRONLY|os.O_APPEND, 0600)
+	payload := `{"op":"set","key":"session","value":"forged"}`
+	fmt.Fprintf(file, "%08x %s\n", crc32.ChecksumIEEE([]byte(payload)), payload)
+	file.Close()
+	if _, _, err := OpenJournaled(path, Options{Keyring: keyring}); !errors.Is(err, ErrUnsealed) {
+		t.Errorf("opened a journal with an unencrypted record: %v", err)
+	}
+
+	// an unencrypted copy which can't be read is reported, not removed.
+	unreadable := filepath.Join(dir, "unreadable.bak")
+	ioutil.WriteFile(unreadable, []byte("not a dumpfile"), 0600)
+	if err := sealDumpfile(unreadable, Options{Keyring: keyring}); err == nil {
+		t.Errorf("sealed an unreadable dumpfile")
+	}
+	if raw, err := ioutil.ReadFile(unreadable); err != nil || string(raw) != "not a dumpfile" {
+		t.Errorf("an unreadable dumpfile was changed to %q, %v", raw, err)
+	}
+}
+
+func TestCheckpointer(t *tst.T) {
+	counter.Reset("test-checkpoint-writes")
+	counter.Reset("test-checkpoint-skips")
+	counter.Reset("test-checkpoint-errors")
+	path := filepath.Join(t.TempDir(), "dump")
+	cm := New()
+	cm.Set("a", "1")
+	c := NewCheckpointer(cm, path, CheckpointOptions{
+		Interval: time.Hour, Counter: "test-checkpoint",
+	})
+	for i := 0; i < 3; i++ {
+		if err := c.Checkpoint(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if writes, skips := counter.Get("test-checkpoint-writes"),
+		counter.Get("test-checkpoint-skips"); writes != 1 || skips != 2 {
+		t.Errorf("unchanged map: %d writes, %d skips, expected 1 and 2",
+			writes, skips)
+	}
+
+	// Stop flushes changes made since the last checkpoint.
+	c.Start()
+	cm.Set("b", "2")
+	if err := c.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := LoadFromDisk(path); err != nil || !cm.Equals(loaded) {
+		t.Errorf("final checkpoint not written: %v", err)
+	}
+
+	var reported error
+	broken := NewCheckpointer(cm, filepath.Join(path, "not-a-dir"),
+		CheckpointOptions{
+			Counter: "test-checkpoint",
+			OnError: func(err error) { reported = err },
+		})
+	if err := broken.Checkpoint(); err == nil || err != reported {
+		t.Errorf("expected the error %v to be reported, got %v", err, reported)
+	}
+	if counter.Get("test-checkpoint-errors") != 1 {
+		t.Errorf("failed checkpoint wasn't counted")
+	}
+}
+
+func TestGenerations(t *tst.T) {
+	advance := setClock(t)
+	path := filepath.Join(t.TempDir(), "dump")
+	cm, j, err := OpenJournaled(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := j.NewCheckpointer(CheckpointOptions{
+		Retention: Retention{Generations: 3, MaxAge: time.Hour},
+	})
+	for i := 1; i <= 5; i++ {
+		cm.Set("a", fmt.Sprint(i))
+		if err := c.Checkpoint(); err != nil {
+			t.Fatal(err)
+		}
+		advance(time.Minute)
+	}
+	generations, err := Generations(path)
+	if err != nil || len(generations) != 3 || generations[0].Number != 3 {
+		t.Fatalf("expected generations 3 to 5, got %v, %v", generations, err)
+	}
+	second := generations[1]
+	advance(2 * time.Hour)
+	cm.Set("a", "6")
+	c.Checkpoint()
+	if generations, _ = Generations(path); len(generations) != 1 {
+		t.Errorf("generations older than the max age were kept: %v", generations)
+	}
+	sixth := time.Unix(0, now()).Format(time.RFC3339Nano)
+	advance(time.Minute)
+	cm.Set("a", "7")
+	c.Stop(context.Background())
+	j.Close()
+
+	// roll back to the newest generation at a time, the 6th.
+	if _, err := RestoreGeneration(path, "2", Options{}); err == nil {
+		t.Errorf("restored a pruned generation")
+	}
+	if generation, err := RestoreGeneration(path, sixth, Options{}); err != nil {
+		t.Fatal(err)
+	} else if generation.Number != 6 {
+		t.Errorf("restored generation %d, expected 6", generation.Number)
+	}
+	// the map before the restore is kept, so the restore can be undone.
+	if generation, err := FindGeneration(path, "8"); err != nil {
+		t.Errorf("the map before the restore wasn't kept: %s", err)
+	} else if before, err := LoadFromDisk(generation.Path); err != nil {
+		t.Error(err)
+	} else if value, _ := before.Get("a"); value != "7" {
+		t.Errorf("kept a=%q from before the restore, expected 7", value)
+	}
+	restored, j, err := OpenJournaled(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if value, _ := restored.Get("a"); value != "6" {
+		t.Errorf("restored a=%q, expected 6", value)
+	}
+	if second.Number != 4 {
+		t.Errorf("generations aren't numbered in order: %v", second)
+	}
+}
+
+func TestStats(t *tst.T) {
+	stats := NewStats("sessions")
+	cm := NewWithOptions(Options{Stats: stats})
+	cm.Set("a", "1")
+	cm.Set("b", "1")
+	cm.Get("a")
+	cm.SetIfAbsent("a", "2")
+	cm.CompareAndSwap("a", "1", "2")
+	cm.Del("b")
+	// a copy neither counts towards the map nor replaces it.
+	cm.Copy().Set("c", "1")
+
+	// a write holding a's shard makes a read of it wait.
+	held := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		cm.Update("a", func(old string, ok bool) (string, bool) {
+			close(held)
+			time.Sleep(20 * time.Millisecond)
+			return old, ok
+		})
+		close(done)
+	}()
+	<-held
+	cm.Get("a")
+	<-done
+
+	data := stats.Export()
+	expected := map[string]int{
+		"sessions-op-get": 2,
+		"sessions-op-set": 2,
+		"sessions-op-del": 1,
+		"sessions-op-cas": 3,
+		"sessions-size":   1,
+	}
+	for key, value := range expected {
+		if data[key] != value {
+			t.Errorf("%s is %d, expected %d: %v", key, data[key], value, data)
+		}
+	}
+	if data["sessions-lock-wait-max-us"] < 10000 {
+		t.Errorf("a read waiting on a 20ms write only waited %dus",
+			data["sessions-lock-wait-max-us"])
+	}
+	if data["sessions-lock-hold-us"] < data["sessions-lock-wait-max-us"] {
+		t.Errorf("locks held for %dus, less than a read waited",
+			data["sessions-lock-hold-us"])
+	}
+}
@@ -0,0 +1,161 @@
+package concurrentmap
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+/*
+A Keyring encrypts dumpfiles and journals at rest with AES-GCM. The first key
+in the keyring is the primary key, used for everything written; the rest are
+only used to read what was written before the primary key changed.
+
+To rotate keys, put the new key first and keep the old key after it. The
+dumpfile is re-encrypted with the new key the next time it is written, and
+the journal as soon as it is compacted, after which the old key can be
+dropped.
+
+Everything encrypted is prefixed with the id of its key, the first four bytes
+of the key's SHA-256, so a missing key can be told apart from corrupt data.
+*/
+type Keyring struct {
+	keys []aesKey
+}
+
+type aesKey struct {
+	id   [keyIDLen]byte
+	aead cipher.AEAD
+}
+
+const (
+	keyIDLen = 4
+	nonceLen = 12
+)
+
+var (
+	ErrNoKey   = errors.New("concurrentmap: data is encrypted, but no key was given")
+	ErrDecrypt = errors.New("concurrentmap: could not decrypt data, it is corrupt or was tampered with")
+)
+
+// ErrUnknownKey is returned when data was encrypted with a key that isn't in
+// the keyring.
+type ErrUnknownKey struct {
+	ID string
+}
+
+func (e ErrUnknownKey) Error() string {
+	return fmt.Sprintf("concurrentmap: data was encrypted with key %s, "+
+		"which isn't in the keyring", e.ID)
+}
+
+// NewKeyring creates a keyring from raw AES keys of 16, 24 or 32 bytes, the
+// primary key first.
+func NewKeyring(keys ...[]byte) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("concurrentmap: a keyring needs at least one key")
+	}
+	keyring := &Keyring{}
+	for _, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k := aesKey{aead: aead}
+		sum := sha256.Sum256(key)
+		copy(k.id[:], sum[:])
+		keyring.keys = append(keyring.keys, k)
+	}
+	return keyring, nil
+}
+
+/*
+ParseKeyring creates a keyring from text holding keys in hex or base64,
+separated by newlines or commas, the primary key first. Blank lines and lines
+starting with # are ignored.
+*/
+func ParseKeyring(text string) (*Keyring, error) {
+	var keys [][]byte
+	fields := strings.FieldsFunc(text, func(r rune) bool {
+		return r == '\n' || r == ','
+	})
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if len(field) == 0 || strings.HasPrefix(field, "#") {
+			continue
+		}
+		key, err := hex.DecodeString(field)
+		if err != nil {
+			key, err = base64.StdEncoding.DecodeString(field)
+		}
+		if err != nil {
+			return nil, errors.New("concurrentmap: keys must be hex or base64")
+		}
+		keys = append(keys, key)
+	}
+	return NewKeyring(keys...)
+}
+
+// LoadKeyring reads a keyring in the format of ParseKeyring from a file.
+func LoadKeyring(path string) (*Keyring, error) {
+	text, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeyring(string(text))
+}
+
+// PrimaryID returns the id of the primary key in hex.
+func (k *Keyring) PrimaryID() string {
+	return hex.EncodeToString(k.keys[0].id[:])
+}
+
+// seal encrypts plaintext with the primary key, binding it to
+// additionalData. The result is the key id, the nonce and the ciphertext.
+func (k *Keyring) seal(plaintext []byte, additionalData []byte) ([]byte, error) {
+	primary := k.keys[0]
+	sealed := make([]byte, keyIDLen+nonceLen, keyIDLen+nonceLen+
+		len(plaintext)+primary.aead.Overhead())
+	copy(sealed, primary.id[:])
+	nonce := sealed[keyIDLen:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return primary.aead.Seal(sealed, nonce, plaintext, additionalData), nil
+}
+
+// open decrypts the output of seal with whichever key sealed it.
+func (k *Keyring) open(sealed []byte, additionalData []byte) ([]byte, error) {
+	if k == nil {
+		return nil, ErrNoKey
+	}
+	if len(sealed) < keyIDLen+nonceLen {
+		return nil, ErrTruncated
+	}
+	id := sealed[:keyIDLen]
+	for _, key := range k.keys {
+		if !bytes.Equal(key.id[:], id) {
+			continue
+		}
+		nonce := sealed[keyIDLen : keyIDLen+nonceLen]
+		plaintext, err := key.aead.Open(nil, nonce, sealed[keyIDLen+nonceLen:],
+			additionalData)
+		if err != nil {
+			return nil, ErrDecrypt
+		}
+		return plaintext, nil
+	}
+	return nil, ErrUnknownKey{ID: hex.EncodeToString(id)}
+}
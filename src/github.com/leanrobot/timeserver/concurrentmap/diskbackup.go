@@ -1,12 +1,13 @@
 package concurrentmap
 
 import (
-	"encoding/json"
+	"bytes"
 	"fmt"
 	log "github.com/cihub/seelog"
+	"io"
 	"io/ioutil"
 	"os"
-	"time"
+	"path"
 )
 
 /*
@@ -14,109 +15,194 @@ LoadFromDisk receives a filepath and attempts to load it into a new CMap that
 it returns.
 */
 func LoadFromDisk(filepath string) (*CMap, error) {
-	// get a file object.
-	file, err := os.Open(filepath)
-	if err != nil {
-		return nil, err
-	}
+	return LoadFromDiskWithOptions(filepath, Options{})
+}
 
+/*
+LoadFromDiskWithOptions is like LoadFromDisk, but the returned CMap is created
+with opts. Entries which expired while the map was on disk are not loaded.
+*/
+func LoadFromDiskWithOptions(filepath string, opts Options) (*CMap, error) {
 	/*
-		Creates a new cmap, then loads the file and unmarshals the json into
-		a map. The map is then loaded into the cmap and returned.
+		Reads the file, verifies its checksum and decodes it into a map,
+		whatever format it was written in. The map is then loaded into a
+		new cmap and returned.
 	*/
-	bytes, err := ioutil.ReadAll(file)
+	raw, err := ioutil.ReadFile(filepath)
 	if err != nil {
 		return nil, err
 	}
-	data := New()
-
-	mapData := make(map[string]string)
-	err = json.Unmarshal(bytes, &mapData)
-	data.values = mapData
+	entries, err := decodeDumpfile(raw, opts.Keyring)
 	if err != nil {
-		// couldn't decode json
-		return nil, err
+		// couldn't decode the dumpfile
+		return nil, fmt.Errorf("%s: %s", filepath, err)
 	}
+	data := NewWithOptions(opts)
+	data.load(entries)
 
 	return data, nil
 }
 
+/*
+RecoverFromDisk loads the dumpfile at filepath, falling back to the backup
+WriteToDisk keeps at filepath.bak when the dumpfile is missing or damaged. If
+neither file exists the error satisfies os.IsNotExist. Any other error means
+both files exist but neither could be read, and nothing should be written over
+them until someone has looked.
+*/
+func RecoverFromDisk(filepath string, opts Options) (*CMap, error) {
+	data, err := LoadFromDiskWithOptions(filepath, opts)
+	if err == nil {
+		return data, nil
+	}
+	if !os.IsNotExist(err) {
+		log.Errorf("could not load dumpfile, trying backup: %s", err)
+	}
+
+	backupPath := filepath + ".bak"
+	data, backupErr := LoadFromDiskWithOptions(backupPath, opts)
+	if backupErr == nil {
+		log.Warnf("recovered from backup dumpfile %s", backupPath)
+		return data, nil
+	}
+	if os.IsNotExist(backupErr) {
+		return nil, err
+	}
+	return nil, fmt.Errorf("could not recover dumpfile: %s; backup: %s",
+		err, backupErr)
+}
+
+/*
+WriteToDisk atomically replaces the dumpfile at filepath with the contents of
+data. The new dumpfile is written to a temporary file and fsynced before it is
+renamed into place, so a crash leaves either the old dumpfile or the new one,
+never a mix. The previous dumpfile is kept at filepath.bak. The dumpfile is
+written in the Format of data's Options, and encrypted with the primary key of
+its Keyring if it has one.
+*/
 func WriteToDisk(filepath string, data *CMap) error {
-	// write to dumpfile
-	file, err := os.Create(filepath)
+	dump, err := encodeDumpfile(data.snapshot(), data.opts.Format,
+		data.opts.Keyring)
 	if err != nil {
 		return err
 	}
-	bytes, err := json.Marshal(data.values)
+
+	tmp, err := writeTemp(filepath, dump)
 	if err != nil {
 		return err
 	}
-	_, err = file.Write(bytes)
-	if err != nil {
+	// the temp file is gone once renamed, so this only cleans up failures.
+	defer os.Remove(tmp)
+
+	// keep the previous dumpfile as the backup.
+	err = os.Rename(filepath, filepath+".bak")
+	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
-	err = file.Close()
-	if err != nil {
+	if err = os.Rename(tmp, filepath); err != nil {
 		return err
 	}
-
+	if err = syncDir(dirOf(filepath)); err != nil {
+		return err
+	}
+	if data.opts.Keyring != nil {
+		// the backup may be from before encryption was turned on.
+		return sealDumpfile(filepath+".bak", data.opts)
+	}
 	return nil
 }
 
-func BackupAtInterval(data *CMap, filepath string, interval time.Duration) {
-	var err error
-	backupFilepath := filepath + ".bak"
+// writeTemp writes raw to a new temporary file beside filepath and fsyncs
+// it, returning its name.
+func writeTemp(filepath string, raw []byte) (string, error) {
+	tmp, err := ioutil.TempFile(dirOf(filepath), path.Base(filepath)+".tmp")
+	if err != nil {
+		return "", err
+	}
+	_, err = tmp.Write(raw)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+func dirOf(filepath string) string {
+	if dir, _ := path.Split(filepath); dir != "" {
+		return dir
+	}
+	return "."
+}
 
-	// create the dumpefile if it doesn't exist.
-	err = WriteToDisk(filepath, data.Copy())
+/*
+sealDumpfile encrypts the dumpfile at path with the primary key of opts'
+Keyring if it isn't encrypted already, so copies of a map kept from before
+encryption was turned on, like its backup and generations, don't leave it
+readable on disk. A copy which is unencrypted but can't be read can't be
+encrypted either, so it is left as it is and reported, since it may still be
+all there is of what it holds. A missing dumpfile is left missing.
+*/
+func sealDumpfile(filepath string, opts Options) error {
+	file, err := os.Open(filepath)
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
-		panic(err)
-	}
-
-	// set up ticker at interval.
-	ticker := time.Tick(interval)
-	var backup *CMap
-	for {
-		<-ticker
-		log.Info("Saving Dumpfile to disk...")
-		// copy into backup
-		backup = data.Copy()
-		fmt.Printf("%v\n", backup.values)
-
-		// backup old dumpfile if it exists
-		err = os.Rename(filepath, backupFilepath)
-		if err != nil {
-			panic(err)
-		}
+		return err
+	}
+	raw, err := ioutil.ReadAll(io.LimitReader(file, int64(headerLenV3)))
+	file.Close()
+	if err != nil {
+		return err
+	}
+	if sealed(raw) {
+		return nil
+	}
 
-		// write to file
-		err = WriteToDisk(filepath, backup)
-		if err != nil {
-			panic(err)
-		}
+	raw, err = ioutil.ReadFile(filepath)
+	if err != nil {
+		return err
+	}
+	entries, err := decodeDumpfile(raw, opts.Keyring)
+	if err != nil {
+		return fmt.Errorf("concurrentmap: can't encrypt %s, which is unencrypted and unreadable: %w",
+			filepath, err)
+	}
+	dump, err := encodeDumpfile(entries, opts.Format, opts.Keyring)
+	if err != nil {
+		return err
+	}
+	tmp, err := writeTemp(filepath, dump)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if err = os.Rename(tmp, filepath); err != nil {
+		return err
+	}
+	return syncDir(dirOf(filepath))
+}
 
-		// compare file data to backup in memory
-		fileData, err := LoadFromDisk(filepath)
-		if err != nil {
-			panic(err)
-		}
+// sealed reports whether raw, the start of a dumpfile, is encrypted.
+func sealed(raw []byte) bool {
+	return len(raw) >= headerLenV3 && bytes.HasPrefix(raw, []byte(dumpMagic)) &&
+		raw[4] == 3 && Encryption(raw[7]) == AES_GCM
+}
 
-		// if the back up was unsuccesful, restore the old bak file.
-		if !backup.Equals(fileData) {
-			log.Info("Backup Unsuccessful, restoring old version of backup.")
-			err = os.Remove(filepath)
-			err = os.Rename(backupFilepath, filepath)
-			if err != nil {
-				panic(err)
-			}
-		} else { // backup was successful delete old backup.
-			err = os.Remove(backupFilepath)
-			if err != nil {
-				panic(err)
-			}
-			log.Info("Backup Successful.")
-		}
+// syncDir fsyncs a directory so renames within it are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
 	}
+	defer d.Close()
+	return d.Sync()
 }
 
 // Exists reports whether the named file or directory exists.
@@ -1,6 +1,7 @@
 /*
 Concurrent map contains an implementation of a key-value store which is
-thread-safe. The underlying implementation is a map[string] string which is
-locked with a sync.Mutex.
+thread-safe. Keys are hashed across a fixed number of shards, each of which is
+a map[string]string locked with its own sync.RWMutex, so lookups of different
+keys rarely contend and concurrent lookups of the same key never do.
 */
 package concurrentmap
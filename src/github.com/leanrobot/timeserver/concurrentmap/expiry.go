@@ -0,0 +1,84 @@
+package concurrentmap
+
+import (
+	"time"
+)
+
+// now returns the current time in Unix nanoseconds. It is a variable so tests
+// can control the clock.
+var now = func() int64 {
+	return time.Now().UnixNano()
+}
+
+// now returns the time by the map's Clock, in Unix nanoseconds.
+func (cm *CMap) now() int64 {
+	if cm.opts.Clock != nil {
+		return cm.opts.Clock().UnixNano()
+	}
+	return now()
+}
+
+// expiresAt converts a time to live into an absolute expiry time in Unix
+// nanoseconds. A ttl of zero or less never expires.
+func (cm *CMap) expiresAt(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return cm.now() + int64(ttl)
+}
+
+/*
+StartReaper starts a background goroutine which evicts expired entries every
+interval. If a reaper is already running it is replaced by the new one.
+*/
+func (cm *CMap) StartReaper(interval time.Duration) {
+	cm.reaperLock.Lock()
+	defer cm.reaperLock.Unlock()
+
+	if cm.stopReaper != nil {
+		close(cm.stopReaper)
+	}
+	stop := make(chan bool)
+	cm.stopReaper = stop
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				cm.Reap()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the background reaper, if one is running. The map itself is
+// still usable after Close.
+func (cm *CMap) Close() {
+	cm.reaperLock.Lock()
+	defer cm.reaperLock.Unlock()
+
+	if cm.stopReaper != nil {
+		close(cm.stopReaper)
+		cm.stopReaper = nil
+	}
+}
+
+// Reap removes every expired entry from the map, as the reaper does every
+// ReapInterval. Shards are locked one at a time so it never blocks the whole
+// map.
+func (cm *CMap) Reap() {
+	for _, s := range cm.shards {
+		s.lock.Lock()
+		current := cm.now()
+		for key, e := range s.values {
+			if e.expired(current) {
+				cm.delLocked(s, key, OpExpire)
+			}
+		}
+		s.lock.Unlock()
+	}
+}
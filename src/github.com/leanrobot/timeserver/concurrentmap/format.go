@@ -0,0 +1,299 @@
+package concurrentmap
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"strings"
+)
+
+/*
+Dumpfiles are written as a small header followed by the encoded entries:
+
+	magic        4 bytes  "CMAP"
+	version      1 byte   FORMAT_VERSION
+	codec        1 byte   how the entries are encoded, a Codec
+	compression  1 byte   how the encoded entries are compressed, a Compression
+	encryption   1 byte   how the compressed entries are encrypted, an Encryption
+	checksum     4 bytes  big endian CRC-32 (Castagnoli) of the payload
+	payload      the rest of the file
+
+An AES_GCM payload is sealed by a Keyring, with the header before the checksum
+as additional data. Version 2 dumpfiles have no encryption byte and are never
+encrypted. Version 1 dumpfiles have no codec or compression bytes either; their
+payload is always uncompressed JSON. Dumpfiles written before the header
+existed are bare JSON. LoadFromDisk reads all of these.
+*/
+const (
+	dumpMagic      = "CMAP"
+	FORMAT_VERSION = 3
+
+	headerLenV1 = len(dumpMagic) + 1 + 4
+	headerLenV2 = len(dumpMagic) + 1 + 1 + 1 + 4
+	headerLenV3 = len(dumpMagic) + 1 + 1 + 1 + 1 + 4
+)
+
+var (
+	ErrChecksum  = errors.New("concurrentmap: dumpfile checksum mismatch")
+	ErrTruncated = errors.New("concurrentmap: dumpfile is truncated")
+	ErrVersion   = errors.New("concurrentmap: unsupported dumpfile version")
+
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// Codec is how the entries in a dumpfile are encoded.
+type Codec byte
+
+const (
+	// JSON encodes entries as the JSON dumpFile layout.
+	JSON Codec = 1
+	// GOB encodes entries as a gob of the dumpFile layout.
+	GOB Codec = 2
+)
+
+// Compression is how the encoded entries in a dumpfile are compressed.
+type Compression byte
+
+const (
+	NO_COMPRESSION Compression = 0
+	GZIP           Compression = 1
+)
+
+// Encryption is how the compressed entries in a dumpfile are encrypted.
+type Encryption byte
+
+const (
+	NO_ENCRYPTION Encryption = 0
+	AES_GCM       Encryption = 1
+)
+
+// Format is how WriteToDisk writes a CMap. The zero value writes uncompressed
+// JSON.
+type Format struct {
+	Codec       Codec
+	Compression Compression
+}
+
+// String returns the format as accepted by ParseFormat, e.g. "gob+gzip".
+func (f Format) String() string {
+	name := "json"
+	if f.Codec == GOB {
+		name = "gob"
+	}
+	if f.Compression == GZIP {
+		name += "+gzip"
+	}
+	return name
+}
+
+// ParseFormat parses a format name: "json" or "gob", optionally followed by
+// "+gzip".
+func ParseFormat(name string) (Format, error) {
+	var f Format
+	codec, compression := name, ""
+	if i := strings.Index(name, "+"); i >= 0 {
+		codec, compression = name[:i], name[i+1:]
+	}
+	switch codec {
+	case "json":
+		f.Codec = JSON
+	case "gob":
+		f.Codec = GOB
+	default:
+		return f, fmt.Errorf("concurrentmap: unknown codec %q", codec)
+	}
+	switch compression {
+	case "":
+		f.Compression = NO_COMPRESSION
+	case "gzip":
+		f.Compression = GZIP
+	default:
+		return f, fmt.Errorf("concurrentmap: unknown compression %q", compression)
+	}
+	return f, nil
+}
+
+// dumpFile is the layout of the entries in a dumpfile. Legacy dumpfiles are a
+// bare JSON map[string]string of keys to values, with no expiry times.
+type dumpFile struct {
+	Entries map[string]dumpEntry `json:"entries"`
+}
+
+type dumpEntry struct {
+	Value string `json:"value"`
+	// ExpiresAt is the expiry time in Unix nanoseconds, omitted if the entry
+	// never expires.
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+}
+
+// encodeDumpfile lays out entries as a dumpfile in the given format,
+// encrypted with the primary key of keyring unless it is nil.
+func encodeDumpfile(entries map[string]entry, format Format,
+	keyring *Keyring) ([]byte, error) {
+	if format.Codec == 0 {
+		format.Codec = JSON
+	}
+	dump := dumpFile{Entries: make(map[string]dumpEntry, len(entries))}
+	for key, e := range entries {
+		dump.Entries[key] = dumpEntry{Value: e.value, ExpiresAt: e.expires}
+	}
+
+	var payload bytes.Buffer
+	var err error
+	switch format.Codec {
+	case JSON:
+		err = json.NewEncoder(&payload).Encode(dump)
+	case GOB:
+		err = gob.NewEncoder(&payload).Encode(dump)
+	default:
+		err = fmt.Errorf("concurrentmap: unknown codec %d", format.Codec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if format.Compression == GZIP {
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		if _, err = writer.Write(payload.Bytes()); err == nil {
+			err = writer.Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+		payload = compressed
+	}
+
+	header := make([]byte, headerLenV3)
+	copy(header, dumpMagic)
+	header[4] = FORMAT_VERSION
+	header[5] = byte(format.Codec)
+	header[6] = byte(format.Compression)
+	sealed := payload.Bytes()
+	if keyring != nil {
+		header[7] = byte(AES_GCM)
+		if sealed, err = keyring.seal(sealed, header[:8]); err != nil {
+			return nil, err
+		}
+	}
+	binary.BigEndian.PutUint32(header[8:], crc32.Checksum(sealed, castagnoli))
+	return append(header, sealed...), nil
+}
+
+/*
+decodeDumpfile reads entries from a dumpfile in any format, detecting the
+format from its header. Encrypted dumpfiles are decrypted with whichever key
+in keyring they were written with.
+*/
+func decodeDumpfile(raw []byte, keyring *Keyring) (map[string]entry, error) {
+	if !bytes.HasPrefix(raw, []byte(dumpMagic)) {
+		return decodeJSON(raw)
+	}
+	if len(raw) < headerLenV1 {
+		return nil, ErrTruncated
+	}
+
+	var format Format
+	var encryption Encryption
+	var checksum uint32
+	var payload []byte
+	switch raw[4] {
+	case 1:
+		format = Format{Codec: JSON}
+		checksum = binary.BigEndian.Uint32(raw[5:])
+		payload = raw[headerLenV1:]
+	case 2:
+		if len(raw) < headerLenV2 {
+			return nil, ErrTruncated
+		}
+		format = Format{Codec: Codec(raw[5]), Compression: Compression(raw[6])}
+		checksum = binary.BigEndian.Uint32(raw[7:])
+		payload = raw[headerLenV2:]
+	case 3:
+		if len(raw) < headerLenV3 {
+			return nil, ErrTruncated
+		}
+		format = Format{Codec: Codec(raw[5]), Compression: Compression(raw[6])}
+		encryption = Encryption(raw[7])
+		checksum = binary.BigEndian.Uint32(raw[8:])
+		payload = raw[headerLenV3:]
+	default:
+		return nil, ErrVersion
+	}
+	if crc32.Checksum(payload, castagnoli) != checksum {
+		return nil, ErrChecksum
+	}
+
+	switch encryption {
+	case NO_ENCRYPTION:
+	case AES_GCM:
+		var err error
+		if payload, err = keyring.open(payload, raw[:8]); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("concurrentmap: unknown encryption %d", encryption)
+	}
+
+	switch format.Compression {
+	case NO_COMPRESSION:
+	case GZIP:
+		reader, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		if payload, err = ioutil.ReadAll(reader); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("concurrentmap: unknown compression %d",
+			format.Compression)
+	}
+
+	switch format.Codec {
+	case JSON:
+		return decodeJSON(payload)
+	case GOB:
+		var dump dumpFile
+		if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&dump); err != nil {
+			return nil, err
+		}
+		return dumpEntries(dump), nil
+	}
+	return nil, fmt.Errorf("concurrentmap: unknown codec %d", format.Codec)
+}
+
+// decodeJSON unmarshals either JSON layout of the entries.
+func decodeJSON(payload []byte) (map[string]entry, error) {
+	// a legacy dumpfile is a map of strings, which the current layout can
+	// never be since its only key holds an object.
+	legacy := make(map[string]string)
+	if err := json.Unmarshal(payload, &legacy); err == nil {
+		entries := make(map[string]entry, len(legacy))
+		for key, value := range legacy {
+			entries[key] = entry{value: value}
+		}
+		return entries, nil
+	}
+
+	var dump dumpFile
+	if err := json.Unmarshal(payload, &dump); err != nil {
+		return nil, err
+	}
+	return dumpEntries(dump), nil
+}
+
+// dumpEntries returns the entries of dump, expired or not, since only the map
+// they are loaded into knows what time it is.
+func dumpEntries(dump dumpFile) map[string]entry {
+	entries := make(map[string]entry, len(dump.Entries))
+	for key, de := range dump.Entries {
+		entries[key] = entry{value: de.Value, expires: de.ExpiresAt}
+	}
+	return entries
+}
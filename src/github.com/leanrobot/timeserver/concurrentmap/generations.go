@@ -0,0 +1,256 @@
+package concurrentmap
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+A generation is a copy of a dumpfile as it was right after a checkpoint, kept
+beside it as
+
+	<dumpfile>.gen-<number>-<time>
+
+where number counts up from one with every generation kept, and time is when
+the checkpoint was written, in GENERATION_TIME_LAYOUT. A generation is in
+whatever format, and encrypted with whichever key, its dumpfile was, except
+that generations kept before encryption was turned on are encrypted by the
+first checkpoint after.
+*/
+const (
+	GENERATION_TIME_LAYOUT = "20060102T150405.000Z"
+
+	generationInfix = ".gen-"
+)
+
+// Retention is how many generations of a dumpfile a Checkpointer keeps.
+type Retention struct {
+	// Generations is the most generations kept. Zero keeps none.
+	Generations int
+	// MaxAge is how long a generation is kept. The newest generation is
+	// kept whatever its age. Zero keeps generations until there are too
+	// many.
+	MaxAge time.Duration
+}
+
+// Generation is one retained generation of a dumpfile.
+type Generation struct {
+	Number int
+	Time   time.Time
+	Path   string
+}
+
+// Generations returns the retained generations of the dumpfile at path,
+// oldest first.
+func Generations(path string) ([]Generation, error) {
+	matches, err := filepath.Glob(globEscape(path) + generationInfix + "*")
+	if err != nil {
+		return nil, err
+	}
+	var generations []Generation
+	for _, match := range matches {
+		// the suffix is "<number>-<time>"; anything else isn't ours.
+		fields := strings.SplitN(strings.TrimPrefix(match, path+generationInfix), "-", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		number, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		written, err := time.Parse(GENERATION_TIME_LAYOUT, fields[1])
+		if err != nil {
+			continue
+		}
+		generations = append(generations, Generation{
+			Number: number, Time: written, Path: match,
+		})
+	}
+	sort.Slice(generations, func(i, j int) bool {
+		return generations[i].Number < generations[j].Number
+	})
+	return generations, nil
+}
+
+// globEscape escapes the glob metacharacters in path.
+func globEscape(path string) string {
+	var escaped strings.Builder
+	for _, r := range path {
+		if strings.ContainsRune(`*?[\`, r) {
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
+
+/*
+FindGeneration finds a generation of the dumpfile at path from spec, which is
+either a generation number, or a time in RFC 3339 or GENERATION_TIME_LAYOUT
+which finds the newest generation written at or before it.
+*/
+func FindGeneration(path string, spec string) (Generation, error) {
+	generations, err := Generations(path)
+	if err != nil {
+		return Generation{}, err
+	}
+	if len(generations) == 0 {
+		return Generation{}, fmt.Errorf("%s has no generations", path)
+	}
+	first, last := generations[0], generations[len(generations)-1]
+
+	if number, err := strconv.Atoi(spec); err == nil {
+		for _, generation := range generations {
+			if generation.Number == number {
+				return generation, nil
+			}
+		}
+		return Generation{}, fmt.Errorf("%s has no generation %d, only %d to %d",
+			path, number, first.Number, last.Number)
+	}
+
+	at, err := time.Parse(time.RFC3339Nano, spec)
+	if err != nil {
+		at, err = time.Parse(GENERATION_TIME_LAYOUT, spec)
+	}
+	if err != nil {
+		return Generation{}, fmt.Errorf(
+			"%q is neither a generation number nor a time", spec)
+	}
+	for i := len(generations) - 1; i >= 0; i-- {
+		if !generations[i].Time.After(at) {
+			return generations[i], nil
+		}
+	}
+	return Generation{}, fmt.Errorf("%s has no generation from before %s, "+
+		"the oldest is from %s", path, at.Format(time.RFC3339),
+		first.Time.Format(time.RFC3339))
+}
+
+// keepGeneration saves the dumpfile at path as its next generation. The
+// dumpfile is hard linked where possible, since it is never written in place.
+func keepGeneration(path string) (Generation, error) {
+	generations, err := Generations(path)
+	if err != nil {
+		return Generation{}, err
+	}
+	generation := Generation{Number: 1, Time: time.Unix(0, now()).UTC()}
+	if len(generations) > 0 {
+		generation.Number = generations[len(generations)-1].Number + 1
+	}
+	generation.Path = fmt.Sprintf("%s%s%d-%s", path, generationInfix,
+		generation.Number, generation.Time.Format(GENERATION_TIME_LAYOUT))
+
+	if err := os.Link(path, generation.Path); err != nil {
+		if err = copyFile(path, generation.Path); err != nil {
+			return Generation{}, err
+		}
+	}
+	return generation, syncDir(filepath.Dir(path))
+}
+
+func copyFile(from string, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(to)
+	}
+	return err
+}
+
+// pruneGenerations removes the generations of the dumpfile at path which
+// retention no longer keeps.
+func pruneGenerations(path string, retention Retention) error {
+	generations, err := Generations(path)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Unix(0, now()).Add(-retention.MaxAge)
+	for i, generation := range generations {
+		newest := i == len(generations)-1
+		keep := len(generations)-i <= retention.Generations &&
+			(newest || retention.MaxAge == 0 || !generation.Time.Before(cutoff))
+		if keep {
+			continue
+		}
+		if err := os.Remove(generation.Path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// sealGenerations encrypts every generation of the dumpfile at path which
+// isn't encrypted, with the primary key of opts' Keyring.
+func sealGenerations(path string, opts Options) error {
+	generations, err := Generations(path)
+	if err != nil {
+		return err
+	}
+	for _, generation := range generations {
+		if err := sealDumpfile(generation.Path, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+RestoreGeneration rolls the journaled map stored at path back to the
+generation found by spec, as described by FindGeneration. The map as it was
+before the restore, journal included, is first kept as a generation of its
+own, so a restore can be undone by restoring that. The restored map is written
+with opts, re-encrypting it with the primary key if opts has a Keyring.
+
+RestoreGeneration must be called before the map is opened, and fails if the
+current map can't be read, rather than throwing it away.
+*/
+func RestoreGeneration(path string, spec string, opts Options) (Generation, error) {
+	opts.ReapInterval = 0
+	generation, err := FindGeneration(path, spec)
+	if err != nil {
+		return generation, err
+	}
+	restored, err := LoadFromDiskWithOptions(generation.Path, opts)
+	if err != nil {
+		return generation, err
+	}
+
+	// fold the journal into the dumpfile, and keep it.
+	_, journal, err := OpenJournaled(path, opts)
+	if err != nil {
+		return generation, err
+	}
+	err = journal.Compact()
+	if closeErr := journal.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return generation, err
+	}
+	if _, err = keepGeneration(path); err != nil {
+		return generation, err
+	}
+
+	return generation, WriteToDisk(path, restored)
+}
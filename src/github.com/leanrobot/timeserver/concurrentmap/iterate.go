@@ -0,0 +1,98 @@
+package concurrentmap
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+The methods in this file read the whole map. Each one works from a consistent
+point-in-time snapshot: every shard is read locked while the snapshot is
+taken, so the snapshot reflects every write that completed before it and none
+that started after it. No locks are held once the snapshot is taken, so writes
+made while a caller is working through the results, including writes made by
+a Range callback, are never visible to it.
+
+Expired entries are never included, even if the reaper hasn't removed them yet.
+*/
+
+// Len returns the number of unexpired entries in the map.
+func (cm *CMap) Len() int {
+	cm.rlockAll()
+	defer cm.runlockAll()
+
+	current := cm.now()
+	count := 0
+	for _, s := range cm.shards {
+		for _, e := range s.values {
+			if !e.expired(current) {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// Keys returns every key in the map in sorted order.
+func (cm *CMap) Keys() []string {
+	return sortedKeys(cm.snapshot())
+}
+
+/*
+Range calls fn for every key-value in the map, in sorted key order, stopping
+early if fn returns false. fn may read and write the map freely, but sees the
+map as it was when Range was called.
+*/
+func (cm *CMap) Range(fn func(key string, value string) bool) {
+	entries := cm.snapshot()
+	for _, key := range sortedKeys(entries) {
+		if !fn(key, entries[key].value) {
+			return
+		}
+	}
+}
+
+/*
+RangeWithExpiry is Range, but fn is also given when each entry expires, the
+zero time if it never does.
+*/
+func (cm *CMap) RangeWithExpiry(fn func(key string, value string, expires time.Time) bool) {
+	entries := cm.snapshot()
+	for _, key := range sortedKeys(entries) {
+		e := entries[key]
+		var expires time.Time
+		if e.expires != 0 {
+			expires = time.Unix(0, e.expires)
+		}
+		if !fn(key, e.value, expires) {
+			return
+		}
+	}
+}
+
+// ScanPrefix returns every key-value whose key starts with prefix.
+func (cm *CMap) ScanPrefix(prefix string) map[string]string {
+	cm.rlockAll()
+	defer cm.runlockAll()
+
+	current := cm.now()
+	values := make(map[string]string)
+	for _, s := range cm.shards {
+		for key, e := range s.values {
+			if strings.HasPrefix(key, prefix) && !e.expired(current) {
+				values[key] = e.value
+			}
+		}
+	}
+	return values
+}
+
+func sortedKeys(entries map[string]entry) []string {
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
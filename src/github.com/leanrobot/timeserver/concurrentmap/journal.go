@@ -0,0 +1,332 @@
+package concurrentmap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/cihub/seelog"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	journalSet = "set"
+	journalDel = "del"
+)
+
+// journalRecord is a single Set or Del appended to a journal.
+type journalRecord struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+	// ExpiresAt is the expiry time in Unix nanoseconds, omitted if the entry
+	// never expires.
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+}
+
+/*
+Journal is a write-ahead log of every Set and Del made to a CMap, kept next to
+the map's dumpfile. Every record is fsynced before the write it records
+returns, so a crash loses at most the write that was in flight.
+
+The journal is periodically compacted: its records are folded into a fresh
+dumpfile snapshot and it starts over empty. On disk a journaled map is made of
+up to three files:
+
+	<dumpfile>               the last compacted snapshot
+	<dumpfile>.journal.old   records being folded into the snapshot
+	<dumpfile>.journal       records made since the last compaction began
+
+Each journal line is the CRC-32 of a JSON record in hex, a space, and the
+record itself. If the map's Options have a Keyring, the record is instead
+sealed with its primary key and written in base64.
+*/
+type Journal struct {
+	data         *CMap
+	snapshotPath string
+	path         string
+
+	lock sync.Mutex
+	file *os.File
+	// err is the first error encountered appending to the journal, or
+	// replacing its file.
+	err error
+}
+
+/*
+OpenJournaled loads the map stored at dumpfile by replaying its snapshot and
+journals, then attaches a journal to it so every following Set and Del is
+recorded. The snapshot doesn't need to exist yet, but if it exists and can't be
+recovered, OpenJournaled fails rather than start over empty.
+*/
+func OpenJournaled(dumpfile string, opts Options) (*CMap, *Journal, error) {
+	data, err := RecoverFromDisk(dumpfile, opts)
+	if os.IsNotExist(err) {
+		data, err = NewWithOptions(opts), nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	j := &Journal{
+		data:         data,
+		snapshotPath: dumpfile,
+		path:         dumpfile + ".journal",
+	}
+
+	// a compaction was interrupted, its records may not be in the snapshot.
+	oldPath := j.oldPath()
+	if exists(oldPath) {
+		if _, err := replayJournal(oldPath, data); err != nil {
+			return nil, nil, err
+		}
+	}
+	valid, err := replayJournal(j.path, data)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	j.file, err = os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	// drop any torn record at the end so new records follow valid ones.
+	if err = j.file.Truncate(valid); err == nil {
+		_, err = j.file.Seek(valid, io.SeekStart)
+	}
+	if err != nil {
+		j.file.Close()
+		return nil, nil, err
+	}
+	data.attachJournal(j)
+
+	if exists(oldPath) {
+		// finish the interrupted compaction before accepting writes.
+		if err := j.writeSnapshot(); err != nil {
+			j.Close()
+			return nil, nil, err
+		}
+	}
+	return data, j, nil
+}
+
+/*
+Compact folds the journal into a new snapshot of the map. Writes made while
+the snapshot is being written go to a fresh journal, so they are never lost.
+If the last compaction failed to write its snapshot, its old journal holds
+records which are in no snapshot yet, so Compact writes that snapshot first,
+and fails without touching the journal if it still can't.
+*/
+func (j *Journal) Compact() error {
+	if exists(j.oldPath()) {
+		if err := j.writeSnapshot(); err != nil {
+			return err
+		}
+	}
+
+	j.lock.Lock()
+	if j.file == nil {
+		j.lock.Unlock()
+		if err := j.Err(); err != nil {
+			return err
+		}
+		return errors.New("concurrentmap: journal is closed")
+	}
+	err := j.file.Close()
+	if err == nil {
+		err = os.Rename(j.path, j.oldPath())
+	}
+	if err == nil {
+		j.file, err = os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	}
+	if err != nil {
+		// with no journal file every later write would go unrecorded, so
+		// they all report the failure.
+		log.Errorf("journal compaction failed: %s", err)
+		j.file = nil
+		if j.err == nil {
+			j.err = err
+		}
+		j.lock.Unlock()
+		return err
+	}
+	j.lock.Unlock()
+
+	return j.writeSnapshot()
+}
+
+// Err returns the first error encountered appending to the journal, or
+// starting a new one in Compact, if any. Once there is one, writes to the map
+// are no longer durable.
+func (j *Journal) Err() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.err
+}
+
+// Close detaches the journal from its map and closes the journal file.
+func (j *Journal) Close() error {
+	j.data.attachJournal(nil)
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
+
+func (j *Journal) closed() bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.file == nil
+}
+
+func (j *Journal) oldPath() string {
+	return j.path + ".old"
+}
+
+// writeSnapshot writes the whole map to the snapshot file, after which the
+// old journal is no longer needed.
+func (j *Journal) writeSnapshot() error {
+	if err := WriteToDisk(j.snapshotPath, j.data.Copy()); err != nil {
+		return err
+	}
+	err := os.Remove(j.oldPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+/*
+append writes a record to the journal and fsyncs it. It is called with the
+shard of the record's key locked, so records for a key are always in the same
+order as the writes they record.
+*/
+func (j *Journal) append(record journalRecord) {
+	payload, err := json.Marshal(record)
+	if keyring := j.data.opts.Keyring; err == nil && keyring != nil {
+		var sealed []byte
+		if sealed, err = keyring.seal(payload, journalAdditionalData); err == nil {
+			payload = []byte(base64.StdEncoding.EncodeToString(sealed))
+		}
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.file == nil {
+		return
+	}
+	if err == nil {
+		line := fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(payload), payload)
+		if _, err = io.WriteString(j.file, line); err == nil {
+			err = j.file.Sync()
+		}
+	}
+	if err != nil && j.err == nil {
+		log.Errorf("journal append failed: %s", err)
+		j.err = err
+	}
+}
+
+/*
+replayJournal applies every record in the journal at path to data. Replay
+stops at a final record that is incomplete or fails its checksum, which can
+only be the record being written when the process died. A corrupt record with
+more after it is an error, since the records after it were written after the
+write it records returned, as is a record that passes its checksum but can't
+be decrypted. It returns the length of the valid prefix of the journal.
+*/
+func replayJournal(path string, data *CMap) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var valid int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// an unterminated final line is a torn write.
+			return valid, nil
+		}
+		if err != nil {
+			return valid, err
+		}
+		record, ok, err := parseJournalLine(line, data.opts.Keyring)
+		if err != nil {
+			return valid, fmt.Errorf("journal %s: %w", path, err)
+		}
+		if !ok {
+			if _, err := reader.Peek(1); err != io.EOF {
+				return valid, fmt.Errorf("journal %s is corrupt at offset %d",
+					path, valid)
+			}
+			log.Warnf("journal %s: ignoring corrupt final record at offset %d",
+				path, valid)
+			return valid, nil
+		}
+		data.applyRecord(record)
+		valid += int64(len(line))
+	}
+}
+
+// ErrUnsealed is returned when a journal of a map with a Keyring has an
+// unencrypted record. A journal written before encryption was turned on must
+// be compacted without the keyring first.
+var ErrUnsealed = errors.New("concurrentmap: the journal has an unencrypted " +
+	"record, but the map has a keyring")
+
+// journalAdditionalData binds sealed journal records to the journal, so they
+// can't be passed off as a dumpfile payload.
+var journalAdditionalData = []byte("journal")
+
+/*
+parseJournalLine parses a journal line, reporting whether it is intact. The
+error is only set for intact records which can't be decrypted, or which aren't
+encrypted although there is a keyring: anyone able to append to the journal
+could otherwise write any session they liked into an encrypted map.
+*/
+func parseJournalLine(line []byte, keyring *Keyring) (journalRecord, bool, error) {
+	var record journalRecord
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	fields := bytes.SplitN(line, []byte(" "), 2)
+	if len(fields) != 2 {
+		return record, false, nil
+	}
+	var checksum uint32
+	if _, err := fmt.Sscanf(string(fields[0]), "%08x", &checksum); err != nil {
+		return record, false, nil
+	}
+	payload := fields[1]
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return record, false, nil
+	}
+	// a JSON record always starts with a brace, which base64 never has.
+	if bytes.HasPrefix(payload, []byte("{")) && keyring != nil {
+		return record, false, ErrUnsealed
+	}
+	if !bytes.HasPrefix(payload, []byte("{")) {
+		sealed, err := base64.StdEncoding.DecodeString(string(payload))
+		if err != nil {
+			return record, false, nil
+		}
+		if payload, err = keyring.open(sealed, journalAdditionalData); err != nil {
+			return record, false, err
+		}
+	}
+	if err := json.Unmarshal(payload, &record); err != nil {
+		return record, false, nil
+	}
+	return record, true, nil
+}
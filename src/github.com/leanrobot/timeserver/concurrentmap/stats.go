@@ -0,0 +1,148 @@
+package concurrentmap
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The operations Stats counts. Every single key method of a CMap is one of
+// them; SetIfAbsent, CompareAndSwap, CompareAndDelete and Update are all opCas.
+const (
+	opGet = iota
+	opSet
+	opDel
+	opCas
+	opCount
+)
+
+var opNames = [opCount]string{"get", "set", "del", "cas"}
+
+/*
+Stats records how a CMap is used: how many of each operation it serves, how
+long they wait for their shard's lock and how long they hold it, and how many
+entries the map holds. A map records into the Stats in its Options, if any, so
+the Stats is the sink the caller reads the map's instrumentation from.
+
+Timing locks costs a couple of clock reads per operation, which is why maps
+without Stats don't do it. Whole-map operations like Copy and the reaper
+aren't counted.
+*/
+type Stats struct {
+	// counters are first so they are 64-bit aligned for atomic access.
+	ops        [opCount]uint64
+	waitNanos  uint64
+	holdNanos  uint64
+	maxWait    uint64
+	prefix     string
+	sizeLock   sync.Mutex
+	sizeSource *CMap
+}
+
+// NewStats creates a Stats whose Export names every value with prefix.
+func NewStats(prefix string) *Stats {
+	return &Stats{prefix: prefix}
+}
+
+// attach makes cm the map whose size Export reports. The map most recently
+// created with the Stats wins, which is the live one when a map is replaced
+// by one loaded from disk.
+func (st *Stats) attach(cm *CMap) {
+	if st == nil {
+		return
+	}
+	st.sizeLock.Lock()
+	st.sizeSource = cm
+	st.sizeLock.Unlock()
+}
+
+/*
+Export returns the counts so far, named <prefix>-<name>:
+
+	op-get, op-set, op-del, op-cas  operations served
+	lock-wait-us                    total time spent waiting for shard locks
+	lock-wait-max-us                the longest single wait
+	lock-hold-us                    total time shard locks were held
+	size                            unexpired entries in the map
+
+Times are in microseconds.
+*/
+func (st *Stats) Export() map[string]int {
+	data := make(map[string]int)
+	for op, name := range opNames {
+		data[st.prefix+"-op-"+name] = int(atomic.LoadUint64(&st.ops[op]))
+	}
+	micros := func(nanos *uint64) int {
+		return int(time.Duration(atomic.LoadUint64(nanos)) / time.Microsecond)
+	}
+	data[st.prefix+"-lock-wait-us"] = micros(&st.waitNanos)
+	data[st.prefix+"-lock-wait-max-us"] = micros(&st.maxWait)
+	data[st.prefix+"-lock-hold-us"] = micros(&st.holdNanos)
+
+	data[st.prefix+"-size"] = st.Size()
+	return data
+}
+
+// Size returns the number of unexpired entries in the map, as Len counts
+// them, or zero if no map has been created with the Stats.
+func (st *Stats) Size() int {
+	st.sizeLock.Lock()
+	source := st.sizeSource
+	st.sizeLock.Unlock()
+	if source == nil {
+		return 0
+	}
+	return source.Len()
+}
+
+/*
+lock locks l, for writing if write is set, and returns when it was acquired
+for unlock. A nil Stats just locks.
+
+The pair is used as
+
+	start := cm.opts.Stats.lock(&s.lock, true)
+	defer cm.opts.Stats.unlock(&s.lock, true, start, opSet)
+
+rather than returning an unlock function, so maps without Stats allocate
+nothing.
+*/
+func (st *Stats) lock(l *sync.RWMutex, write bool) time.Time {
+	if st == nil {
+		if write {
+			l.Lock()
+		} else {
+			l.RLock()
+		}
+		return time.Time{}
+	}
+	requested := time.Now()
+	if write {
+		l.Lock()
+	} else {
+		l.RLock()
+	}
+	acquired := time.Now()
+	wait := uint64(acquired.Sub(requested))
+	atomic.AddUint64(&st.waitNanos, wait)
+	for {
+		max := atomic.LoadUint64(&st.maxWait)
+		if wait <= max || atomic.CompareAndSwapUint64(&st.maxWait, max, wait) {
+			break
+		}
+	}
+	return acquired
+}
+
+// unlock unlocks l, locked by lock at acquired, counting one op.
+func (st *Stats) unlock(l *sync.RWMutex, write bool, acquired time.Time, op int) {
+	if st != nil {
+		atomic.AddUint64(&st.holdNanos, uint64(time.Since(acquired)))
+		atomic.AddUint64(&st.ops[op], 1)
+	}
+	if write {
+		l.Unlock()
+	} else {
+		l.RUnlock()
+	}
+}
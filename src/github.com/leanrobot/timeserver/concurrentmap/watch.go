@@ -0,0 +1,190 @@
+package concurrentmap
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Op is the kind of change an Event describes.
+type Op int
+
+const (
+	// OpSet is a key being set, whether or not it existed before.
+	OpSet Op = iota
+	// OpDel is a key being deleted by Del.
+	OpDel
+	// OpExpire is an expired key being removed by the reaper.
+	OpExpire
+	// OpEvict is a key being evicted to keep the map within capacity.
+	OpEvict
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpSet:
+		return "set"
+	case OpDel:
+		return "del"
+	case OpExpire:
+		return "expire"
+	case OpEvict:
+		return "evict"
+	}
+	return "unknown"
+}
+
+// Event describes a single change to a CMap.
+type Event struct {
+	Op  Op
+	Key string
+
+	// OldValue is the value before the change. Existed is false, and
+	// OldValue empty, if the key wasn't in the map.
+	OldValue string
+	Existed  bool
+
+	// NewValue is the value after the change, empty unless Op is OpSet.
+	NewValue string
+	// ExpiresAt is when NewValue expires, the zero time if it never does.
+	ExpiresAt time.Time
+}
+
+// OverflowPolicy decides what happens to an event when a watcher's buffer is
+// full.
+type OverflowPolicy int
+
+const (
+	// Drop discards the event and counts it in Dropped. Writers are never
+	// slowed down by a slow watcher.
+	Drop OverflowPolicy = iota
+	// Block makes the writer wait until the watcher has room. Every event is
+	// delivered, but a slow watcher stalls writes to the keys it is behind
+	// on.
+	Block
+)
+
+/*
+Watcher receives the changes made to a CMap on C. Events for a key arrive in
+the order the changes were made; events for different keys may arrive in any
+order relative to each other.
+*/
+type Watcher struct {
+	// dropped is first so it is 64 bit aligned for atomic access.
+	dropped uint64
+
+	C <-chan Event
+
+	events chan Event
+	done   chan bool
+	policy OverflowPolicy
+	// ops are the kinds of change watched, every kind if empty.
+	ops []Op
+	cm  *CMap
+}
+
+/*
+Watch subscribes to the changes made to the map from now on, of the kinds in
+ops, or of every kind if there are none. buffer is the number of events the
+watcher holds before policy applies; changes of other kinds never take up
+room in it. Call Stop once the watcher is no longer needed; an unstopped Block
+watcher that nobody reads will eventually stall every writer.
+*/
+func (cm *CMap) Watch(buffer int, policy OverflowPolicy, ops ...Op) *Watcher {
+	events := make(chan Event, buffer)
+	w := &Watcher{
+		C:      events,
+		events: events,
+		done:   make(chan bool),
+		policy: policy,
+		ops:    ops,
+		cm:     cm,
+	}
+
+	cm.watchLock.Lock()
+	defer cm.watchLock.Unlock()
+	cm.watchers = append(cm.watchers, w)
+	atomic.AddInt32(&cm.watcherCount, 1)
+	return w
+}
+
+// Dropped returns the number of events discarded because the buffer was full.
+func (w *Watcher) Dropped() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
+
+// Stop unsubscribes the watcher and closes C. Events already buffered can
+// still be read. Stop must only be called once.
+func (w *Watcher) Stop() {
+	// release any writer blocked sending to this watcher before waiting for
+	// writers to finish with it.
+	close(w.done)
+
+	cm := w.cm
+	cm.watchLock.Lock()
+	for i, other := range cm.watchers {
+		if other == w {
+			cm.watchers = append(cm.watchers[:i], cm.watchers[i+1:]...)
+			atomic.AddInt32(&cm.watcherCount, -1)
+			break
+		}
+	}
+	cm.watchLock.Unlock()
+
+	close(w.events)
+}
+
+// notify sends an event to every watcher. It is called with the shard of key
+// write locked.
+func (cm *CMap) notify(op Op, key string, old entry, existed bool, e entry) {
+	if atomic.LoadInt32(&cm.watcherCount) == 0 {
+		return
+	}
+	event := Event{
+		Op:       op,
+		Key:      key,
+		Existed:  existed,
+		NewValue: e.value,
+	}
+	if existed {
+		event.OldValue = old.value
+	}
+	if e.expires != 0 {
+		event.ExpiresAt = time.Unix(0, e.expires)
+	}
+
+	cm.watchLock.RLock()
+	defer cm.watchLock.RUnlock()
+	for _, w := range cm.watchers {
+		if w.watches(op) {
+			w.send(event)
+		}
+	}
+}
+
+// watches reports whether the watcher wants changes of kind op.
+func (w *Watcher) watches(op Op) bool {
+	if len(w.ops) == 0 {
+		return true
+	}
+	for _, watched := range w.ops {
+		if watched == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Watcher) send(event Event) {
+	if w.policy == Block {
+		select {
+		case w.events <- event:
+		case <-w.done:
+		}
+		return
+	}
+	select {
+	case w.events <- event:
+	default:
+		atomic.AddUint64(&w.dropped, 1)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	log "github.com/cihub/seelog"
 	"os"
+	"time"
 )
 
 const (
@@ -14,14 +15,32 @@ const (
 	DEFAULT_LOG_FILE      = "etc/timeserver_seelog.xml"
 	DEFAULT_TEMPLATES_DIR = "src/github.com/leanrobot/timeserver/templates"
 
-	DEFAULT_CHECKPOINT_INTERVAL = 10
+	DEFAULT_CHECKPOINT_INTERVAL = 60000
 	DEFAULT_AVG_RESPONSE        = 5000
 	DEFAULT_DEVIATION           = 500
 	DEFAULT_AUTH_TIMEOUT        = 1000
 
+	DEFAULT_SNAPSHOT_GENERATIONS = 24
+	DEFAULT_SNAPSHOT_MAX_AGE     = 7 * 24 * time.Hour
+
+	DEFAULT_SESSION_TTL           = 7 * 24 * time.Hour
+	DEFAULT_SESSION_REAP_INTERVAL = time.Minute
+
 	SESSION_NAME = "timeserver_css490_tompetit"
 
 	DEFAULT_MAX_REQUESTS = 0
+
+	// the environment variable holding the dumpfile keys if there is no
+	// key file.
+	DUMPFILE_KEY_ENV = "AUTHSERVER_DUMPFILE_KEY"
+
+	// the environment variable holding the replication secret if there is
+	// no secret file.
+	REPLICATION_SECRET_ENV = "AUTHSERVER_REPLICATION_SECRET"
+
+	// the environment variable holding the cluster secret if there is no
+	// secret file.
+	CLUSTER_SECRET_ENV = "AUTHSERVER_CLUSTER_SECRET"
 )
 
 var (
@@ -29,8 +48,9 @@ var (
 	Port int
 
 	// Flags related to communicating with the authserver.
-	AuthPort int
-	AuthUrl  string
+	AuthPort    int
+	AuthUrl     string
+	AuthServers string
 
 	// Flags related to simulating load.
 	AvgResponse  int
@@ -40,12 +60,39 @@ var (
 	//Flags related to saving the authserver map to disk
 	DumpFile           string
 	CheckpointInterval int
+	StoreKind          string
+	DumpFormat         string
+	DumpKeyFile        string
+
+	// Flags related to keeping and restoring snapshot generations.
+	SnapshotGenerations int
+	SnapshotMaxAge      time.Duration
+	RestoreFrom         string
+
+	// Flags related to expiring authserver sessions.
+	SessionTTL          time.Duration
+	SessionReapInterval time.Duration
+
+	// Flags related to limiting the authserver's session store.
+	MaxSessions     int
+	MaxSessionBytes int
 
 	VersionPrint  bool
 	TemplatesDir  string
 	LogConfigFile string
 
 	AuthTimeout int
+
+	// Flags related to replicating sessions between authservers.
+	Replicate             bool
+	ReplicateFrom         string
+	ReplicationSecretFile string
+
+	// Flags related to running the authserver as a consensus cluster.
+	Cluster           string
+	ClusterSelf       string
+	ClusterDir        string
+	ClusterSecretFile string
 )
 
 func init() {
@@ -70,6 +117,10 @@ func initFlags() {
 		"The network address for the auth server")
 	flag.IntVar(&AuthPort, "authport", 9090,
 		"The port which to connect to the authserver on.")
+	flag.StringVar(&AuthServers, "authservers", "",
+		`The comma separated addresses of several authservers, e.g.
+		localhost:9091,localhost:9092, to shard sessions across by
+		consistent hashing. Overrides -authhost and -authport.`)
 
 	// Flags related to simulating load.
 	flag.IntVar(&AvgResponse, "avg-response-ms", DEFAULT_AVG_RESPONSE,
@@ -88,7 +139,65 @@ func initFlags() {
 		`The location of the dumpfile for user data.`)
 	flag.IntVar(&CheckpointInterval, "checkpoint-interval-ms",
 		DEFAULT_CHECKPOINT_INTERVAL,
-		"Performs a save to dumpfile every checkpoint-interval.")
+		"Compacts the session store dumpfile every checkpoint-interval.")
+	flag.StringVar(&DumpFormat, "dumpfile-format", "json",
+		"How the json store writes its dumpfile: json, gob, json+gzip or gob+gzip.")
+	flag.StringVar(&DumpKeyFile, "dumpfile-key-file", "",
+		`A file of AES keys in hex or base64, one per line, which the json store
+		encrypts its dumpfile with. The first key encrypts, the rest only
+		decrypt. Turning encryption on needs a clean shutdown first, so the
+		journal is empty. Defaults to the keys in $`+DUMPFILE_KEY_ENV+`, if set.`)
+	flag.StringVar(&StoreKind, "store", "",
+		`The authserver session store: memory, json or disk. Defaults to json
+		if a dumpfile is given, otherwise memory.`)
+
+	// Flags related to keeping and restoring snapshot generations.
+	flag.IntVar(&SnapshotGenerations, "snapshot-generations",
+		DEFAULT_SNAPSHOT_GENERATIONS,
+		"How many timestamped generations of the dumpfile the json store keeps. 0 keeps none.")
+	flag.DurationVar(&SnapshotMaxAge, "snapshot-max-age", DEFAULT_SNAPSHOT_MAX_AGE,
+		"How long the json store keeps dumpfile generations. 0 keeps them until there are too many.")
+	flag.StringVar(&RestoreFrom, "restore-from", "",
+		`Rolls the json store back to a dumpfile generation before starting,
+		given by its number or a time in RFC 3339.`)
+
+	flag.BoolVar(&Replicate, "replicate", false,
+		"Serve sessions to followers as a replication primary.")
+	flag.StringVar(&ReplicateFrom, "replicate-from", "",
+		`The URL of a primary authserver, e.g. http://localhost:9090, to follow.
+		A follower is read only until promoted with a POST to /promote.`)
+	flag.StringVar(&ReplicationSecretFile, "replication-secret-file", "",
+		`A file holding the secret a primary and its followers share, which
+		-replicate and -replicate-from need. Defaults to
+		$`+REPLICATION_SECRET_ENV+`, if set.`)
+
+	// Flags related to running the authserver as a consensus cluster.
+	flag.StringVar(&Cluster, "cluster", "",
+		`The comma separated URLs of every authserver in a consensus cluster,
+		this one included. Writes to a node which isn't the leader are
+		redirected to the leader.`)
+	flag.StringVar(&ClusterSelf, "cluster-self", "",
+		`This authserver's URL in -cluster. Defaults to
+		http://localhost:<authport>.`)
+	flag.StringVar(&ClusterDir, "cluster-dir", "",
+		`Where the authserver keeps its cluster log and snapshots. Defaults to
+		cluster-<authport>.`)
+	flag.StringVar(&ClusterSecretFile, "cluster-secret-file", "",
+		`A file holding the secret every node of -cluster shares. Defaults to
+		$`+CLUSTER_SECRET_ENV+`, if set.`)
+
+	// Flags related to expiring authserver sessions.
+	flag.DurationVar(&SessionTTL, "session-ttl", DEFAULT_SESSION_TTL,
+		"How long a session lasts before the authserver forgets it. 0 never expires.")
+	flag.DurationVar(&SessionReapInterval, "session-reap-interval",
+		DEFAULT_SESSION_REAP_INTERVAL,
+		"How often the authserver evicts expired sessions.")
+
+	// Flags related to limiting the authserver's session store.
+	flag.IntVar(&MaxSessions, "max-sessions", 0,
+		"The most sessions the authserver holds before evicting the least recently used. 0 is unlimited.")
+	flag.IntVar(&MaxSessionBytes, "max-session-bytes", 0,
+		"The most bytes of sessions the authserver holds before evicting the least recently used. 0 is unlimited.")
 
 	//Flags for request limiting
 	flag.IntVar(&RequestLimit, "max-inflight", 0,
@@ -0,0 +1,537 @@
+/*
+diskkv package is a small embedded key-value store kept on disk in a single
+append-only data file, in the style of Bitcask.
+
+Every write appends a record to the data file and fsyncs it. An in-memory
+index maps every live key to the location of its latest record, so a Get is
+one read from the file and values never need to fit in memory. Overwritten
+and deleted records stay in the file as garbage until Compact rewrites it
+with only the live records.
+
+The data file starts with FILE_MAGIC, so nothing else is ever taken for one,
+and each record after it is laid out as:
+
+	checksum  4 bytes  big endian CRC-32 (Castagnoli) of the rest of the record
+	expires   8 bytes  expiry time in Unix nanoseconds, zero if never
+	keyLen    4 bytes
+	valueLen  4 bytes
+	flags     1 byte   FLAG_TOMBSTONE for deletes
+	key
+	value
+
+Only the last record can be torn by a crash, so a record running past the end
+of the file, or a corrupt last record, is cut off when the file is opened. A
+corrupt record anywhere else fails Open rather than lose every record after
+it.
+*/
+package diskkv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	FLAG_TOMBSTONE = 1
+
+	// FILE_MAGIC starts every data file.
+	FILE_MAGIC = "DKV\x01"
+
+	recordHeaderLen = 4 + 8 + 4 + 4 + 1
+)
+
+var (
+	ErrClosed    = errors.New("diskkv: database is closed")
+	ErrNotDiskKV = errors.New("diskkv: not a diskkv data file")
+
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// Options configures a DB opened with Open.
+type Options struct {
+	// DefaultTTL is the time to live given to values stored with Set. Zero
+	// means values never expire.
+	DefaultTTL time.Duration
+}
+
+// DB is an open data file. It is safe for concurrent use.
+type DB struct {
+	path string
+	opts Options
+
+	lock sync.RWMutex
+	file *os.File
+	// size is the length of the valid part of the data file, where the
+	// next record is written.
+	size int64
+	// index holds the location of the latest record of every live key.
+	index map[string]location
+	// garbage is the number of bytes of records which are no longer live.
+	garbage int64
+}
+
+// location is where the value of a key is stored in the data file.
+type location struct {
+	offset   int64 // of the whole record
+	length   int64 // of the whole record
+	valueAt  int64
+	valueLen int
+	expires  int64
+}
+
+func (l location) expired(now int64) bool {
+	return l.expires != 0 && l.expires <= now
+}
+
+/*
+Open opens the data file at path, creating it if it doesn't exist, and builds
+the index by reading every record. A record that was only partly written when
+the process died is cut off the end of the file. A file which isn't a data
+file fails with ErrNotDiskKV, and is left as it is.
+*/
+func Open(path string, opts Options) (*DB, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	db := &DB{
+		path: path,
+		opts: opts,
+		file: file,
+	}
+	if err = db.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// load rebuilds the index from the data file and truncates any torn record.
+// An empty file is given the FILE_MAGIC.
+func (db *DB) load() error {
+	db.index = make(map[string]location)
+	db.size = int64(len(FILE_MAGIC))
+	db.garbage = 0
+
+	info, err := db.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		if _, err = db.file.WriteAt([]byte(FILE_MAGIC), 0); err == nil {
+			err = db.file.Sync()
+		}
+		return err
+	}
+	magic := make([]byte, len(FILE_MAGIC))
+	if _, err = db.file.ReadAt(magic, 0); err != nil || string(magic) != FILE_MAGIC {
+		return ErrNotDiskKV
+	}
+
+	if _, err = db.file.Seek(db.size, io.SeekStart); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(db.file)
+	for {
+		key, loc, tombstone, err := readRecord(reader, db.size, info.Size()-db.size)
+		if err == io.EOF || err == errTorn {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if old, ok := db.index[key]; ok {
+			db.garbage += old.length
+		}
+		if tombstone {
+			delete(db.index, key)
+			db.garbage += loc.length
+		} else {
+			db.index[key] = loc
+		}
+		db.size += loc.length
+	}
+	return db.file.Truncate(db.size)
+}
+
+var errTorn = errors.New("diskkv: torn record")
+
+/*
+readRecord reads the record starting at offset from reader, with remaining
+bytes of the file left from there. It returns errTorn if the record runs past
+the end of the file, or is the last and corrupt, and an error if it is corrupt
+with more records after it.
+*/
+func readRecord(reader io.Reader, offset int64, remaining int64) (string, location, bool, error) {
+	if remaining == 0 {
+		return "", location{}, false, io.EOF
+	}
+	if remaining < recordHeaderLen {
+		return "", location{}, false, errTorn
+	}
+	header := make([]byte, recordHeaderLen)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", location{}, false, err
+	}
+	keyLen := int64(binary.BigEndian.Uint32(header[12:]))
+	valueLen := int64(binary.BigEndian.Uint32(header[16:]))
+	length := recordHeaderLen + keyLen + valueLen
+	if length > remaining {
+		return "", location{}, false, errTorn
+	}
+	body := make([]byte, keyLen+valueLen)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return "", location{}, false, err
+	}
+
+	checksum := crc32.Checksum(header[4:], castagnoli)
+	checksum = crc32.Update(checksum, castagnoli, body)
+	if checksum != binary.BigEndian.Uint32(header) {
+		if length == remaining {
+			return "", location{}, false, errTorn
+		}
+		return "", location{}, false, fmt.Errorf("diskkv: corrupt record at %d", offset)
+	}
+
+	loc := location{
+		offset:   offset,
+		length:   length,
+		valueAt:  offset + int64(recordHeaderLen) + int64(keyLen),
+		valueLen: int(valueLen),
+		expires:  int64(binary.BigEndian.Uint64(header[4:])),
+	}
+	tombstone := header[20]&FLAG_TOMBSTONE != 0
+	return string(body[:keyLen]), loc, tombstone, nil
+}
+
+// encodeRecord lays out a record as it is stored in the data file.
+func encodeRecord(key string, value string, expires int64, flags byte) []byte {
+	record := make([]byte, recordHeaderLen+len(key)+len(value))
+	binary.BigEndian.PutUint64(record[4:], uint64(expires))
+	binary.BigEndian.PutUint32(record[12:], uint32(len(key)))
+	binary.BigEndian.PutUint32(record[16:], uint32(len(value)))
+	record[20] = flags
+	copy(record[recordHeaderLen:], key)
+	copy(record[recordHeaderLen+len(key):], value)
+	binary.BigEndian.PutUint32(record, crc32.Checksum(record[4:], castagnoli))
+	return record
+}
+
+// Get returns the value of key. Expired values are treated as missing.
+func (db *DB) Get(key string) (string, bool, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return db.getLocked(key)
+}
+
+func (db *DB) getLocked(key string) (string, bool, error) {
+	if db.file == nil {
+		return "", false, ErrClosed
+	}
+	loc, ok := db.index[key]
+	if !ok || loc.expired(time.Now().UnixNano()) {
+		return "", false, nil
+	}
+	value := make([]byte, loc.valueLen)
+	if _, err := db.file.ReadAt(value, loc.valueAt); err != nil {
+		return "", false, err
+	}
+	return string(value), true, nil
+}
+
+// GetWithExpiry is Get, also returning when the value expires, the zero time
+// if it never does.
+func (db *DB) GetWithExpiry(key string) (string, time.Time, bool, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	value, ok, err := db.getLocked(key)
+	if !ok || err != nil {
+		return "", time.Time{}, false, err
+	}
+	var expires time.Time
+	if loc := db.index[key]; loc.expires != 0 {
+		expires = time.Unix(0, loc.expires)
+	}
+	return value, expires, true, nil
+}
+
+// Set stores value under key, expiring after the DefaultTTL if there is one.
+func (db *DB) Set(key string, value string) error {
+	return db.SetWithTTL(key, value, db.opts.DefaultTTL)
+}
+
+// SetWithTTL stores value under key, expiring once ttl has passed. A ttl of
+// zero or less never expires.
+func (db *DB) SetWithTTL(key string, value string, ttl time.Duration) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	return db.setLocked(key, value, expiresAt(ttl))
+}
+
+// SetWithExpiry stores value under key, expiring at expires, or never if it
+// is the zero time.
+func (db *DB) SetWithExpiry(key string, value string, expires time.Time) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	var at int64
+	if !expires.IsZero() {
+		at = expires.UnixNano()
+	}
+	return db.setLocked(key, value, at)
+}
+
+// SetIfAbsent stores value under key only if key doesn't exist, reporting
+// whether it was stored.
+func (db *DB) SetIfAbsent(key string, value string) (bool, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if _, ok, err := db.getLocked(key); ok || err != nil {
+		return false, err
+	}
+	return true, db.setLocked(key, value, expiresAt(db.opts.DefaultTTL))
+}
+
+// CompareAndSwap stores new under key only if its current value is old,
+// reporting whether it was stored.
+func (db *DB) CompareAndSwap(key string, old string, new string) (bool, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	current, ok, err := db.getLocked(key)
+	if !ok || err != nil || current != old {
+		return false, err
+	}
+	return true, db.setLocked(key, new, expiresAt(db.opts.DefaultTTL))
+}
+
+// Del removes key. Deleting a missing key is a no-op.
+func (db *DB) Del(key string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if db.file == nil {
+		return ErrClosed
+	}
+	old, ok := db.index[key]
+	if !ok {
+		return nil
+	}
+	loc, err := db.append(encodeRecord(key, "", 0, FLAG_TOMBSTONE))
+	if err != nil {
+		return err
+	}
+	delete(db.index, key)
+	db.garbage += old.length + loc.length
+	return nil
+}
+
+// expiresAt returns when a value stored now with ttl expires, in Unix
+// nanoseconds, zero if it never does.
+func expiresAt(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return time.Now().Add(ttl).UnixNano()
+}
+
+// setLocked stores value under key, expiring at expires in Unix nanoseconds.
+func (db *DB) setLocked(key string, value string, expires int64) error {
+	if db.file == nil {
+		return ErrClosed
+	}
+	loc, err := db.append(encodeRecord(key, value, expires, 0))
+	if err != nil {
+		return err
+	}
+	loc.valueAt = loc.offset + int64(recordHeaderLen+len(key))
+	loc.valueLen = len(value)
+	loc.expires = expires
+	if old, ok := db.index[key]; ok {
+		db.garbage += old.length
+	}
+	db.index[key] = loc
+	return nil
+}
+
+// append writes a record at the end of the data file and fsyncs it.
+func (db *DB) append(record []byte) (location, error) {
+	if _, err := db.file.WriteAt(record, db.size); err != nil {
+		// don't leave a partial record for the next write to follow.
+		db.file.Truncate(db.size)
+		return location{}, err
+	}
+	if err := db.file.Sync(); err != nil {
+		return location{}, err
+	}
+	loc := location{offset: db.size, length: int64(len(record))}
+	db.size += loc.length
+	return loc, nil
+}
+
+/*
+Range calls fn for every live key-value in sorted key order, stopping early if
+fn returns false. The keys are read from a snapshot of the index taken when
+Range is called; each value is read when fn is about to be called with it, so
+a key deleted in the meantime is skipped.
+*/
+func (db *DB) Range(fn func(key string, value string) bool) error {
+	return db.RangeWithExpiry(func(key string, value string, _ time.Time) bool {
+		return fn(key, value)
+	})
+}
+
+// RangeWithExpiry is Range, but fn is also given when each value expires, the
+// zero time if it never does.
+func (db *DB) RangeWithExpiry(fn func(key string, value string, expires time.Time) bool) error {
+	db.lock.RLock()
+	if db.file == nil {
+		db.lock.RUnlock()
+		return ErrClosed
+	}
+	keys := make([]string, 0, len(db.index))
+	for key := range db.index {
+		keys = append(keys, key)
+	}
+	db.lock.RUnlock()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value, expires, ok, err := db.GetWithExpiry(key)
+		if err != nil {
+			return err
+		}
+		if ok && !fn(key, value, expires) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Len returns the number of live keys.
+func (db *DB) Len() int {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	current := time.Now().UnixNano()
+	count := 0
+	for _, loc := range db.index {
+		if !loc.expired(current) {
+			count++
+		}
+	}
+	return count
+}
+
+// Garbage returns the number of bytes in the data file Compact would free.
+func (db *DB) Garbage() int64 {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	garbage := db.garbage
+	current := time.Now().UnixNano()
+	for _, loc := range db.index {
+		if loc.expired(current) {
+			garbage += loc.length
+		}
+	}
+	return garbage
+}
+
+/*
+Compact rewrites the data file with only the latest record of every live key,
+dropping overwritten, deleted and expired records. The new file is written
+beside the old one and renamed over it, so a crash during Compact leaves the
+old file intact. Writes wait until Compact is done.
+*/
+func (db *DB) Compact() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if db.file == nil {
+		return ErrClosed
+	}
+	compactPath := db.path + ".compact"
+	out, err := os.OpenFile(compactPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(compactPath)
+
+	writer := bufio.NewWriter(out)
+	_, err = writer.WriteString(FILE_MAGIC)
+	current := time.Now().UnixNano()
+	for _, loc := range db.index {
+		if err != nil {
+			break
+		}
+		if loc.expired(current) {
+			continue
+		}
+		record := make([]byte, loc.length)
+		if _, err = db.file.ReadAt(record, loc.offset); err != nil {
+			break
+		}
+		if _, err = writer.Write(record); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if err == nil {
+		err = os.Rename(compactPath, db.path)
+	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	// the new file is the data file from the rename on, so writes go to it
+	// even if the rename couldn't be made durable.
+	db.file.Close()
+	db.file = out
+	if err = db.load(); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(db.path))
+}
+
+// syncDir fsyncs a directory so renames within it are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Close closes the data file. Every write has already been fsynced.
+func (db *DB) Close() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if db.file == nil {
+		return nil
+	}
+	err := db.file.Close()
+	db.file = nil
+	return err
+}
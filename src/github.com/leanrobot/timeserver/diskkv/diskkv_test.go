@@ -0,0 +1,158 @@
+package diskkv
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	tst "testing"
+	"time"
+)
+
+func open(t *tst.T, path string) *DB {
+	db, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func expect(t *tst.T, db *DB, key string, value string, exists bool) {
+	got, ok, err := db.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != value || ok != exists {
+		t.Errorf("Get(%s) = %q, %v, expected %q, %v", key, got, ok, value, exists)
+	}
+}
+
+func TestPersistence(t *tst.T) {
+	path := filepath.Join(t.TempDir(), "data.kv")
+	db := open(t, path)
+	db.Set("a", "1")
+	db.Set("b", "2")
+	db.Set("a", "3")
+	db.Del("b")
+	db.SetWithTTL("c", "4", time.Nanosecond)
+	db.Close()
+
+	// simulate a crash part way through appending a record.
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(encodeRecord("d", "5", 0, 0)[:10])
+	file.Close()
+
+	db = open(t, path)
+	expect(t, db, "a", "3", true)
+	expect(t, db, "b", "", false)
+	expect(t, db, "c", "", false)
+	expect(t, db, "d", "", false)
+
+	// the torn record is gone, so new records can be read back.
+	db.Set("e", "6")
+	db.Close()
+	db = open(t, path)
+	expect(t, db, "e", "6", true)
+}
+
+func TestCorruption(t *tst.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.kv")
+	db := open(t, path)
+	db.Set("a", "1")
+	db.Set("b", "2")
+	db.Close()
+	good, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := len(FILE_MAGIC)
+
+	// a file which isn't a data file is refused and left alone.
+	other := filepath.Join(dir, "other")
+	ioutil.WriteFile(other, []byte("not a data file at all"), 0600)
+	if _, err := Open(other, Options{}); err != ErrNotDiskKV {
+		t.Errorf("opening another file returned %v, expected ErrNotDiskKV", err)
+	}
+	if raw, _ := ioutil.ReadFile(other); string(raw) != "not a data file at all" {
+		t.Errorf("opening another file changed it to %q", raw)
+	}
+
+	// a corrupt record with more after it fails Open.
+	bad := append([]byte(nil), good...)
+	bad[first+recordHeaderLen] ^= 0xff
+	ioutil.WriteFile(path, bad, 0600)
+	if _, err := Open(path, Options{}); err == nil {
+		t.Errorf("opened a data file corrupt before its last record")
+	}
+
+	// but a corrupt last record is cut off, as is a last record claiming
+	// more than the file holds.
+	bad = append([]byte(nil), good...)
+	bad[len(bad)-1] ^= 0xff
+	huge := append(append([]byte(nil), good...), encodeRecord("c", "3", 0, 0)...)
+	binary.BigEndian.PutUint32(huge[len(good)+16:], 1<<31)
+	for i, raw := range [][]byte{bad, huge} {
+		ioutil.WriteFile(path, raw, 0600)
+		db = open(t, path)
+		expect(t, db, "a", "1", true)
+		if i == 0 {
+			expect(t, db, "b", "", false)
+		} else {
+			expect(t, db, "b", "2", true)
+		}
+		expect(t, db, "c", "", false)
+		db.Close()
+	}
+}
+
+func TestConditionalWrites(t *tst.T) {
+	db := open(t, filepath.Join(t.TempDir(), "data.kv"))
+	if ok, _ := db.SetIfAbsent("a", "1"); !ok {
+		t.Errorf("SetIfAbsent didn't store a new key")
+	}
+	if ok, _ := db.SetIfAbsent("a", "2"); ok {
+		t.Errorf("SetIfAbsent stored over an existing key")
+	}
+	if ok, _ := db.CompareAndSwap("a", "2", "3"); ok {
+		t.Errorf("CompareAndSwap stored with the wrong old value")
+	}
+	if ok, _ := db.CompareAndSwap("a", "1", "3"); !ok {
+		t.Errorf("CompareAndSwap didn't store with the right old value")
+	}
+	expect(t, db, "a", "3", true)
+}
+
+func TestCompact(t *tst.T) {
+	path := filepath.Join(t.TempDir(), "data.kv")
+	db := open(t, path)
+	for i := 0; i < 100; i++ {
+		db.Set(fmt.Sprintf("key%d", i%10), fmt.Sprint(i))
+	}
+	db.Del("key0")
+	before, _ := os.Stat(path)
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := os.Stat(path)
+	if after.Size() >= before.Size() || db.Garbage() != 0 {
+		t.Errorf("compaction went from %d to %d bytes, with %d garbage left",
+			before.Size(), after.Size(), db.Garbage())
+	}
+
+	var seen []string
+	db.Range(func(key string, value string) bool {
+		seen = append(seen, key+"="+value)
+		return true
+	})
+	if len(seen) != 9 || seen[0] != "key1=91" || db.Len() != 9 {
+		t.Errorf("after compaction Range saw %v", seen)
+	}
+	db.Set("key1", "new")
+	expect(t, db, "key1", "new", true)
+}
@@ -0,0 +1,126 @@
+/*
+hashring package spreads keys across a set of nodes with a consistent hash
+ring, so that adding or removing one of N nodes moves only about 1/N of the
+keys.
+
+Every node is hashed onto the ring at a number of virtual points, and a key
+belongs to the node of the first point at or after the key's own hash. The
+more virtual points each node has, the more evenly the keys are spread.
+*/
+package hashring
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// DEFAULT_VIRTUAL_NODES is how many points each node gets on the ring if New
+// is given no more than zero.
+const DEFAULT_VIRTUAL_NODES = 160
+
+type point struct {
+	hash uint64
+	node string
+}
+
+// Ring is a consistent hash ring. It is safe for concurrent use.
+type Ring struct {
+	virtualNodes int
+
+	lock   sync.RWMutex
+	nodes  map[string]bool
+	points []point
+}
+
+// New creates a ring of nodes, each with virtualNodes points.
+func New(virtualNodes int, nodes ...string) *Ring {
+	if virtualNodes <= 0 {
+		virtualNodes = DEFAULT_VIRTUAL_NODES
+	}
+	r := &Ring{virtualNodes: virtualNodes, nodes: make(map[string]bool)}
+	for _, node := range nodes {
+		r.Add(node)
+	}
+	return r
+}
+
+// hash places key on the ring. It is MD5, as ketama uses, since the names of
+// a node's virtual points differ by a character or two and cheaper hashes
+// bunch them up.
+func hash(key string) uint64 {
+	sum := md5.Sum([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// Add adds node to the ring. Adding a node twice is a no-op.
+func (r *Ring) Add(node string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.nodes[node] {
+		return
+	}
+	r.nodes[node] = true
+	for i := 0; i < r.virtualNodes; i++ {
+		r.points = append(r.points, point{hash(fmt.Sprintf("%s#%d", node, i)), node})
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		// ties are vanishingly rare, but must still break the same way
+		// whatever order the nodes were added in.
+		if r.points[i].hash == r.points[j].hash {
+			return r.points[i].node < r.points[j].node
+		}
+		return r.points[i].hash < r.points[j].hash
+	})
+}
+
+// Remove removes node from the ring. Its keys move to the nodes after its
+// points.
+func (r *Ring) Remove(node string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.nodes[node] {
+		return
+	}
+	delete(r.nodes, node)
+	points := r.points[:0]
+	for _, p := range r.points {
+		if p.node != node {
+			points = append(points, p)
+		}
+	}
+	r.points = points
+}
+
+// Get returns the node key belongs to, or an empty string if the ring is
+// empty.
+func (r *Ring) Get(key string) string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= h
+	})
+	if i == len(r.points) {
+		// past the last point, round to the first.
+		i = 0
+	}
+	return r.points[i].node
+}
+
+// Nodes returns the nodes on the ring, in sorted order.
+func (r *Ring) Nodes() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	nodes := make([]string, 0, len(r.nodes))
+	for node := range r.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
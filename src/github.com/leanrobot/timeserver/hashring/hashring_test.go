@@ -0,0 +1,76 @@
+package hashring
+
+import (
+	"fmt"
+	tst "testing"
+)
+
+func keys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("session-%d", i)
+	}
+	return keys
+}
+
+func TestEmptyRing(t *tst.T) {
+	if node := New(0).Get("a"); node != "" {
+		t.Errorf("empty ring returned %q", node)
+	}
+}
+
+func TestDistribution(t *tst.T) {
+	nodes := []string{"a:9090", "b:9090", "c:9090", "d:9090"}
+	r := New(0, nodes...)
+	counts := make(map[string]int)
+	for _, key := range keys(40000) {
+		counts[r.Get(key)]++
+	}
+	for _, node := range nodes {
+		// a quarter each, give or take a fifth.
+		if counts[node] < 8000 || counts[node] > 12000 {
+			t.Errorf("node %s got %d of 40000 keys: %v", node, counts[node], counts)
+		}
+	}
+
+	// the same nodes in any order make the same ring.
+	other := New(0, "d:9090", "c:9090", "b:9090", "a:9090")
+	for _, key := range keys(1000) {
+		if r.Get(key) != other.Get(key) {
+			t.Fatalf("rings of the same nodes disagree on %s", key)
+		}
+	}
+}
+
+func TestAddMovesOnlyItsShare(t *tst.T) {
+	r := New(0, "a", "b", "c", "d")
+	before := make(map[string]string)
+	for _, key := range keys(10000) {
+		before[key] = r.Get(key)
+	}
+
+	r.Add("e")
+	moved := 0
+	for key, node := range before {
+		if now := r.Get(key); now != node {
+			if now != "e" {
+				t.Fatalf("%s moved from %s to %s, not to the new node", key, node, now)
+			}
+			moved++
+		}
+	}
+	// about a fifth of the keys move.
+	if moved < 1500 || moved > 2500 {
+		t.Errorf("adding a fifth node moved %d of 10000 keys", moved)
+	}
+
+	r.Remove("e")
+	for key, node := range before {
+		if r.Get(key) != node {
+			t.Fatalf("removing the new node didn't put %s back on %s", key, node)
+		}
+	}
+	if nodes := r.Nodes(); len(nodes) != 4 {
+		t.Errorf("nodes %v after removing e", nodes)
+	}
+}
@@ -5,21 +5,39 @@ import (
 	"fmt"
 	log "github.com/cihub/seelog"
 	"github.com/leanrobot/timeserver/config"
+	"github.com/leanrobot/timeserver/hashring"
+	"github.com/leanrobot/timeserver/record"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
 	"time"
 )
 
+// AUTH_KEY is the query parameter the authserver expects session ids in.
+const AUTH_KEY = "cookie"
+
+// ErrConflict is returned by SetSession when the session id is already taken.
+var ErrConflict = errors.New("Session id already exists.")
+
 var (
-	httpAuthUrl string
-	client      http.Client
+	// ring shards session ids across the authservers, by their URLs.
+	ring   *hashring.Ring
+	client http.Client
 )
 
 func init() {
-	httpAuthUrl = fmt.Sprintf("http://%s:%d", config.AuthUrl, config.AuthPort)
-	log.Debug(httpAuthUrl)
+	urls := authUrls()
+	if len(urls) == 0 {
+		log.Criticalf("-authservers %q names no authservers", config.AuthServers)
+		log.Flush()
+		os.Exit(1)
+	}
+	ring = hashring.New(0, urls...)
+	log.Debug(ring.Nodes())
 
 	// setup the timeout transport for get200
 
@@ -33,30 +51,71 @@ func init() {
 		Transport: &transport,
 	}
 
-	// test that the authserver is running.
-	statusUrl := fmt.Sprintf(httpAuthUrl + "/status")
-	// causes a panic if communication cannot be established with the
-	// authserver.
-	get200(statusUrl)
+	// test that the authservers are running.
+	for _, authUrl := range ring.Nodes() {
+		statusUrl := authUrl + "/status"
+		// causes a panic if communication cannot be established with the
+		// authserver.
+		get200(statusUrl)
+	}
 }
 
-func Name(uuid string) (string, error) {
-	url := fmt.Sprintf("%s/get?cookie=%s", httpAuthUrl, uuid)
+// authUrls returns the URLs of the authservers in -authservers, or of the
+// single authserver at -authhost and -authport if there are none.
+func authUrls() []string {
+	if config.AuthServers == "" {
+		return []string{fmt.Sprintf("http://%s:%d", config.AuthUrl, config.AuthPort)}
+	}
+	var urls []string
+	for _, server := range strings.Split(config.AuthServers, ",") {
+		server = strings.TrimRight(strings.TrimSpace(server), "/")
+		if server == "" {
+			continue
+		}
+		if !strings.Contains(server, "://") {
+			server = "http://" + server
+		}
+		urls = append(urls, server)
+	}
+	return urls
+}
+
+// authUrl returns the URL of the authserver which holds the session uuid.
+func authUrl(uuid string) string {
+	return ring.Get(uuid)
+}
+
+// Session returns the session record the authserver holds for uuid.
+func Session(uuid string) (*record.Session, error) {
+	url := fmt.Sprintf("%s/get?%s", authUrl(uuid), uuidQuery(uuid).Encode())
 
 	resp, err := get200(url)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	name := getBodyAsString(resp.Body)
-	if len(name) < 1 {
-		return "", errors.New("No name returned")
+	value := getBodyAsString(resp.Body)
+	if len(value) < 1 {
+		return nil, errors.New("No session returned")
 	}
-	return name, nil
+	return record.Decode(value)
 }
 
-func SetName(uuid string, name string) error {
-	url := fmt.Sprintf("%s/set?cookie=%s&name=%s",
-		httpAuthUrl, uuid, name)
+// Name returns the username of the session uuid.
+func Name(uuid string) (string, error) {
+	session, err := Session(uuid)
+	if err != nil {
+		return "", err
+	}
+	return session.Username, nil
+}
+
+// SetSession stores a session record for uuid. The authserver sets the
+// timestamps of the record itself. If uuid is already in use the existing
+// session is left alone and ErrConflict is returned.
+func SetSession(uuid string, session *record.Session) error {
+	query := session.Form()
+	query.Set(AUTH_KEY, uuid)
+	url := fmt.Sprintf("%s/set?%s", authUrl(uuid), query.Encode())
 
 	_, err := get200(url)
 	if err != nil {
@@ -65,8 +124,13 @@ func SetName(uuid string, name string) error {
 	return nil
 }
 
+// SetName stores a new session record for uuid with only a username.
+func SetName(uuid string, name string) error {
+	return SetSession(uuid, record.New(name))
+}
+
 func ClearName(uuid string) error {
-	url := fmt.Sprintf("%s/clear?cookie=%s", httpAuthUrl, uuid)
+	url := fmt.Sprintf("%s/clear?%s", authUrl(uuid), uuidQuery(uuid).Encode())
 
 	if _, err := get200(url); err != nil {
 		return err
@@ -76,6 +140,10 @@ func ClearName(uuid string) error {
 
 // PRIVATE HELPERS ==========
 
+func uuidQuery(uuid string) url.Values {
+	return url.Values{AUTH_KEY: []string{uuid}}
+}
+
 func get200(url string) (res *http.Response, err error) {
 	log.Debugf("making request to: %s", url)
 
@@ -88,6 +156,10 @@ func get200(url string) (res *http.Response, err error) {
 	if 200 <= status && status < 300 {
 		return resp, nil
 	}
+	resp.Body.Close()
+	if status == http.StatusConflict {
+		return nil, ErrConflict
+	}
 	return nil, errors.New("Not a 2xx response.")
 }
 
@@ -0,0 +1,991 @@
+/*
+raft package keeps a concurrentmap consistent across a cluster of authservers
+with the Raft consensus algorithm.
+
+Every node of the cluster holds a log of writes to the map. One node is elected
+leader; every write goes through it, is appended to its log, and is replicated
+to the logs of the others. Once a majority of nodes have a write on disk it is
+committed, and every node applies it to its copy of the map. So long as a
+majority of the nodes are up, one of them is the leader and no committed write
+is ever lost; a minority of nodes can be lost, and come back, at any time.
+
+Nodes which aren't the leader refuse writes with ErrNotLeader, naming the
+leader if they know it, so the client can retry there. Reads are served from
+the node's own copy of the map, which may be behind the leader's.
+
+Every SnapshotThreshold applied entries a node writes its map to disk with
+WriteToDisk and drops the entries before it from its log. A follower which
+falls behind the start of the leader's log is sent the leader's snapshot.
+
+Every request between nodes carries the Secret they share in SECRET_HEADER,
+and names a node among the Peers; any other request is refused.
+
+Applying the same entries must leave every node with the same map, so nothing
+in the map may depend on the node it is on. Every entry carries the leader's
+clock, and entries of the map expire by the clock of the last entry applied
+rather than by the node's own. Nor does any node reap or evict on its own: the
+leader appends an entry every MaintenanceInterval which removes whatever has
+expired, and evicts what is over the map's capacity with another, the entries
+expiring soonest first. Until then a read may return an entry which has just
+expired, and the map may hold a little more than its capacity.
+*/
+package raft
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/cihub/seelog"
+	"github.com/leanrobot/counter"
+	cmap "github.com/leanrobot/timeserver/concurrentmap"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The roles of a node.
+const (
+	FOLLOWER  = "follower"
+	CANDIDATE = "candidate"
+	LEADER    = "leader"
+)
+
+// The operations of a Command.
+const (
+	OP_SET           = "set"
+	OP_SET_IF_ABSENT = "set-if-absent"
+	OP_CAS           = "cas"
+	OP_DEL           = "del"
+	// OP_NOOP is appended by every new leader, since it can only commit
+	// entries from earlier terms by committing one of its own.
+	OP_NOOP = "noop"
+	// OP_EXPIRE removes every entry expired at the command's time.
+	OP_EXPIRE = "expire"
+	// OP_EVICT removes the command's keys to keep the map within capacity.
+	OP_EVICT = "evict"
+)
+
+const (
+	DEFAULT_ELECTION_TIMEOUT     = 300 * time.Millisecond
+	DEFAULT_HEARTBEAT_INTERVAL   = 50 * time.Millisecond
+	DEFAULT_SNAPSHOT_THRESHOLD   = 10000
+	DEFAULT_PROPOSE_TIMEOUT      = 5 * time.Second
+	DEFAULT_MAX_SNAPSHOT_BYTES   = 1 << 30
+	DEFAULT_MAINTENANCE_INTERVAL = time.Second
+
+	// the most entries sent in a single AppendEntries.
+	maxBatch = 500
+)
+
+var (
+	ErrTimeout = errors.New("raft: the write wasn't committed in time; it may yet be")
+	ErrClosed  = errors.New("raft: node is closed")
+)
+
+// ErrNotLeader is returned for writes to a node which isn't the leader.
+// Leader is the URL of the leader, if the node knows it.
+type ErrNotLeader struct {
+	Leader string
+}
+
+func (e ErrNotLeader) Error() string {
+	if e.Leader == "" {
+		return "raft: not the leader, and no leader is known"
+	}
+	return fmt.Sprintf("raft: not the leader, the leader is %s", e.Leader)
+}
+
+// Command is a write to the map.
+type Command struct {
+	Op    string `json:"op"`
+	Key   string `json:"key,omitempty"`
+	Value string `json:"value,omitempty"`
+	// Old is the value a OP_CAS expects.
+	Old string `json:"old,omitempty"`
+	// Keys are the keys an OP_EVICT removes.
+	Keys []string `json:"keys,omitempty"`
+	// Time is the leader's clock when it appended the command, in Unix
+	// nanoseconds. It never goes back from one entry to the next.
+	Time int64 `json:"time,omitempty"`
+}
+
+// Entry is a command in the log, with the term of the leader which appended
+// it.
+type Entry struct {
+	Index   uint64  `json:"index"`
+	Term    uint64  `json:"term"`
+	Command Command `json:"command"`
+}
+
+// Config configures a node.
+type Config struct {
+	// ID is the URL the node serves the raft paths on, which is how the
+	// other nodes know it, e.g. http://localhost:9090.
+	ID string
+	// Peers are the IDs of every node in the cluster, this one included.
+	Peers []string
+	// Dir is where the node keeps its log and snapshots.
+	Dir string
+	// Map configures the map. Every node must be able to read the others'
+	// snapshots, so they must share any Keyring. Its ReapInterval is
+	// ignored, and its MaxEntries and MaxBytes are kept by the leader
+	// through the log.
+	Map cmap.Options
+	// MaintenanceInterval is how often the leader expires and evicts
+	// entries. Zero uses DEFAULT_MAINTENANCE_INTERVAL.
+	MaintenanceInterval time.Duration
+
+	// ElectionTimeout is the least time a follower waits to hear from a
+	// leader before standing for election; each wait is randomly up to
+	// twice as long. Zero uses DEFAULT_ELECTION_TIMEOUT.
+	ElectionTimeout time.Duration
+	// HeartbeatInterval is how often the leader contacts each follower
+	// when there is nothing new. Zero uses DEFAULT_HEARTBEAT_INTERVAL.
+	HeartbeatInterval time.Duration
+	// SnapshotThreshold is how many entries are applied between snapshots.
+	// Zero uses DEFAULT_SNAPSHOT_THRESHOLD.
+	SnapshotThreshold int
+	// ProposeTimeout is how long a write waits to be committed. Zero uses
+	// DEFAULT_PROPOSE_TIMEOUT.
+	ProposeTimeout time.Duration
+	// Client sends requests to the other nodes. Nil uses a client which
+	// times out after a second.
+	Client *http.Client
+	// Secret is shared by every node, which send it with every request. A
+	// node with no Secret refuses every request.
+	Secret string
+	// MaxSnapshotBytes is the largest snapshot a node accepts from a leader.
+	// Zero uses DEFAULT_MAX_SNAPSHOT_BYTES.
+	MaxSnapshotBytes int64
+}
+
+// result is the outcome of applying a command, for the write waiting on it.
+type result struct {
+	ok  bool
+	err error
+}
+
+// Node is one node of the cluster. It is a store.Store.
+type Node struct {
+	// clock is the Time of the last command applied, which the map tells
+	// the time by. First so it is 64-bit aligned for atomic access; only
+	// changed with lock held.
+	clock int64
+
+	config  Config
+	storage *storage
+
+	// lock guards everything below.
+	lock     sync.Mutex
+	role     string
+	term     uint64
+	votedFor string
+	leader   string
+
+	// log holds the entries after the snapshot, which is of every entry up
+	// to and including snapshotIndex.
+	log           []Entry
+	snapshotIndex uint64
+	snapshotTerm  uint64
+	snapshotTime  int64
+	// snapshotting is set while a snapshot is being written.
+	snapshotting bool
+	commitIndex  uint64
+	lastApplied  uint64
+	data         *cmap.CMap
+
+	// when the node last heard from a leader or voted, and how long it
+	// waits from then before standing for election.
+	heard           time.Time
+	electionTimeout time.Duration
+
+	// the leader's progress replicating to each follower.
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	// durable is the last entry the leader knows to be on its own disk,
+	// since it syncs its log without the lock.
+	durable uint64
+	// lastContact is when each follower last responded to the leader.
+	lastContact map[string]time.Time
+	// wake tells the replicator of each follower there are new entries.
+	wake map[string]chan bool
+	// waiters are the writes waiting for the entry at an index to apply.
+	waiters map[uint64]chan result
+
+	stop   chan bool
+	closed bool
+	wg     sync.WaitGroup
+}
+
+/*
+Open starts a node with the log and snapshot in its Dir, as a follower. It
+takes part in the cluster as soon as its raft paths are served at its ID.
+*/
+func Open(config Config) (*Node, error) {
+	if config.ElectionTimeout <= 0 {
+		config.ElectionTimeout = DEFAULT_ELECTION_TIMEOUT
+	}
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = DEFAULT_HEARTBEAT_INTERVAL
+	}
+	if config.SnapshotThreshold <= 0 {
+		config.SnapshotThreshold = DEFAULT_SNAPSHOT_THRESHOLD
+	}
+	if config.ProposeTimeout <= 0 {
+		config.ProposeTimeout = DEFAULT_PROPOSE_TIMEOUT
+	}
+	if config.MaintenanceInterval <= 0 {
+		config.MaintenanceInterval = DEFAULT_MAINTENANCE_INTERVAL
+	}
+	if config.MaxSnapshotBytes <= 0 {
+		config.MaxSnapshotBytes = DEFAULT_MAX_SNAPSHOT_BYTES
+	}
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: time.Second}
+	}
+	member := false
+	for _, peer := range config.Peers {
+		member = member || peer == config.ID
+	}
+	if !member {
+		return nil, fmt.Errorf("raft: %s isn't one of the peers %v", config.ID,
+			config.Peers)
+	}
+
+	s, err := openStorage(config.Dir)
+	if err != nil {
+		return nil, err
+	}
+	state, err := s.loadState()
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	n := &Node{
+		config:   config,
+		storage:  s,
+		role:     FOLLOWER,
+		term:     state.Term,
+		votedFor: state.VotedFor,
+		wake:     make(map[string]chan bool),
+		waiters:  make(map[uint64]chan result),
+		stop:     make(chan bool),
+	}
+	meta, data, err := s.loadSnapshot(n.mapOptions(), func(at int64) {
+		atomic.StoreInt64(&n.clock, at)
+	})
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	entries, err := s.loadLog()
+	if err != nil {
+		s.close()
+		data.Close()
+		return nil, err
+	}
+	n.snapshotIndex, n.snapshotTerm, n.snapshotTime = meta.Index, meta.Term, meta.Time
+	n.commitIndex, n.lastApplied = meta.Index, meta.Index
+	n.data = data
+	// the log may still hold entries the snapshot already covers. the rest
+	// must follow on from the snapshot, or the node has lost entries it
+	// may have acknowledged.
+	for _, entry := range entries {
+		if entry.Index <= meta.Index {
+			continue
+		}
+		if entry.Index != n.lastIndex()+1 {
+			s.close()
+			data.Close()
+			return nil, fmt.Errorf("raft: log entry %d follows %d, after the snapshot at %d",
+				entry.Index, n.lastIndex(), meta.Index)
+		}
+		n.log = append(n.log, entry)
+	}
+	n.resetElectionTimer()
+
+	for _, peer := range config.Peers {
+		if peer == config.ID {
+			continue
+		}
+		n.wake[peer] = make(chan bool, 1)
+	}
+	for peer := range n.wake {
+		n.wg.Add(1)
+		go n.replicator(peer)
+	}
+	n.wg.Add(2)
+	go n.ticker()
+	go n.maintainer()
+	return n, nil
+}
+
+/*
+mapOptions returns the options of the node's map: those of the Config, but
+telling the time by the clock of the log, and with no reaper or capacity of
+its own, so every node's map is only ever changed by the log.
+*/
+func (n *Node) mapOptions() cmap.Options {
+	opts := n.config.Map
+	opts.ReapInterval = 0
+	opts.MaxEntries = 0
+	opts.MaxBytes = 0
+	opts.Clock = func() time.Time {
+		return time.Unix(0, atomic.LoadInt64(&n.clock))
+	}
+	return opts
+}
+
+// Close stops the node. The rest of the cluster carries on without it.
+func (n *Node) Close() error {
+	n.lock.Lock()
+	if n.closed {
+		n.lock.Unlock()
+		return nil
+	}
+	n.closed = true
+	close(n.stop)
+	n.failWaiters(ErrClosed)
+	n.lock.Unlock()
+
+	n.wg.Wait()
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.data.Close()
+	return n.storage.close()
+}
+
+// Leader returns the URL of the leader, empty if the node doesn't know it.
+func (n *Node) Leader() string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.leader
+}
+
+// Role returns FOLLOWER, CANDIDATE or LEADER.
+func (n *Node) Role() string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.role
+}
+
+// Stats returns the state of the node for the monitor.
+func (n *Node) Stats() map[string]int {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	leader := 0
+	if n.role == LEADER {
+		leader = 1
+	}
+	return map[string]int{
+		"raft-leader":         leader,
+		"raft-term":           int(n.term),
+		"raft-commit-index":   int(n.commitIndex),
+		"raft-applied-index":  int(n.lastApplied),
+		"raft-snapshot-index": int(n.snapshotIndex),
+		"raft-log-entries":    len(n.log),
+	}
+}
+
+// The log ====
+
+func (n *Node) lastIndex() uint64 {
+	if len(n.log) == 0 {
+		return n.snapshotIndex
+	}
+	return n.log[len(n.log)-1].Index
+}
+
+// lastTime returns the Time of the last entry in the log.
+func (n *Node) lastTime() int64 {
+	if len(n.log) == 0 {
+		return n.snapshotTime
+	}
+	return n.log[len(n.log)-1].Command.Time
+}
+
+func (n *Node) lastTerm() uint64 {
+	if len(n.log) == 0 {
+		return n.snapshotTerm
+	}
+	return n.log[len(n.log)-1].Term
+}
+
+// termAt returns the term of the entry at index, which must be in the log or
+// be the snapshot's.
+func (n *Node) termAt(index uint64) uint64 {
+	if index == n.snapshotIndex {
+		return n.snapshotTerm
+	}
+	return n.log[index-n.snapshotIndex-1].Term
+}
+
+// entriesFrom returns the entries from index onwards, at most max of them.
+func (n *Node) entriesFrom(index uint64, max int) []Entry {
+	from := index - n.snapshotIndex - 1
+	entries := n.log[from:]
+	if len(entries) > max {
+		entries = entries[:max]
+	}
+	return append([]Entry(nil), entries...)
+}
+
+// Roles and elections ====
+
+func (n *Node) resetElectionTimer() {
+	n.heard = time.Now()
+	timeout := n.config.ElectionTimeout
+	n.electionTimeout = timeout + time.Duration(rand.Int63n(int64(timeout)))
+}
+
+func (n *Node) saveState() error {
+	return n.storage.saveState(persistentState{Term: n.term, VotedFor: n.votedFor})
+}
+
+// stepDown makes the node a follower in term, which is at least its current
+// one.
+func (n *Node) stepDown(term uint64) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		n.leader = ""
+		if err := n.saveState(); err != nil {
+			log.Errorf("raft: could not save state: %s", err)
+		}
+	}
+	if n.role != FOLLOWER {
+		log.Infof("raft: %s stepping down in term %d", n.config.ID, n.term)
+		n.role = FOLLOWER
+		// a deposed leader can't know what becomes of its entries.
+		n.failWaiters(ErrNotLeader{Leader: n.leader})
+	}
+}
+
+func (n *Node) failWaiters(err error) {
+	for index, waiter := range n.waiters {
+		waiter <- result{err: err}
+		delete(n.waiters, index)
+	}
+}
+
+// ticker stands for election whenever the node goes too long without
+// hearing from a leader.
+func (n *Node) ticker() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.config.ElectionTimeout / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		}
+		n.lock.Lock()
+		if n.role != LEADER && time.Since(n.heard) > n.electionTimeout {
+			n.startElection()
+		} else if n.role == LEADER && !n.hasQuorum() {
+			// a leader cut off from the majority can't commit anything,
+			// so stops taking writes until it hears from them again.
+			log.Warnf("raft: %s lost touch with a majority of the cluster", n.config.ID)
+			n.stepDown(n.term)
+		}
+		n.lock.Unlock()
+	}
+}
+
+// hasQuorum reports whether a majority of the cluster have responded to the
+// leader within the election timeout.
+func (n *Node) hasQuorum() bool {
+	count := 1
+	for _, contact := range n.lastContact {
+		if time.Since(contact) < n.config.ElectionTimeout {
+			count++
+		}
+	}
+	return count > len(n.config.Peers)/2
+}
+
+// startElection stands for election in the next term, asking every other
+// node for its vote.
+func (n *Node) startElection() {
+	n.term++
+	n.role = CANDIDATE
+	n.votedFor = n.config.ID
+	n.leader = ""
+	n.resetElectionTimer()
+	if err := n.saveState(); err != nil {
+		log.Errorf("raft: could not save state: %s", err)
+		return
+	}
+	log.Infof("raft: %s standing for election in term %d", n.config.ID, n.term)
+
+	request := voteRequest{
+		Term:      n.term,
+		Candidate: n.config.ID,
+		LastIndex: n.lastIndex(),
+		LastTerm:  n.lastTerm(),
+	}
+	votes := 1
+	if votes > len(n.config.Peers)/2 {
+		n.becomeLeader()
+		return
+	}
+	for peer := range n.wake {
+		go func(peer string) {
+			var response voteResponse
+			if err := n.call(peer, VOTE_PATH, request, &response); err != nil {
+				return
+			}
+			n.lock.Lock()
+			defer n.lock.Unlock()
+			if response.Term > n.term {
+				n.stepDown(response.Term)
+				return
+			}
+			if n.role != CANDIDATE || n.term != request.Term || !response.Granted {
+				return
+			}
+			votes++
+			if votes > len(n.config.Peers)/2 {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// becomeLeader makes a candidate which has won its election the leader.
+func (n *Node) becomeLeader() {
+	log.Infof("raft: %s is the leader in term %d", n.config.ID, n.term)
+	n.role = LEADER
+	n.leader = n.config.ID
+	n.nextIndex = make(map[string]uint64)
+	n.matchIndex = make(map[string]uint64)
+	n.lastContact = make(map[string]time.Time)
+	// a follower syncs every entry before acknowledging it.
+	n.durable = n.lastIndex()
+	for peer := range n.wake {
+		n.nextIndex[peer] = n.lastIndex() + 1
+		n.matchIndex[peer] = 0
+		// give every follower an election timeout to respond.
+		n.lastContact[peer] = time.Now()
+	}
+	index, err := n.appendLocked(Command{Op: OP_NOOP})
+	if err != nil {
+		log.Errorf("raft: could not append to the log: %s", err)
+		n.stepDown(n.term)
+		return
+	}
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		if err := n.syncLog(index); err != nil {
+			log.Errorf("raft: could not sync the log: %s", err)
+		}
+	}()
+}
+
+// Replication ====
+
+/*
+appendLocked appends a command to the leader's log and wakes the replicators
+to send it. The command is given the leader's time, or the last entry's if the
+leader's clock is behind it. The entry isn't durable until syncLog, which is
+called without the lock so votes and appends aren't held up by the disk; the
+followers may have it first, which is safe since it isn't committed until the
+leader has it too.
+*/
+func (n *Node) appendLocked(command Command) (uint64, error) {
+	command.Time = time.Now().UnixNano()
+	if last := n.lastTime(); command.Time < last {
+		command.Time = last
+	}
+	entry := Entry{Index: n.lastIndex() + 1, Term: n.term, Command: command}
+	if err := n.storage.writeLog([]Entry{entry}); err != nil {
+		return 0, err
+	}
+	n.log = append(n.log, entry)
+	for _, wake := range n.wake {
+		select {
+		case wake <- true:
+		default:
+		}
+	}
+	return entry.Index, nil
+}
+
+// syncLog makes the leader's log durable up to at least index, then counts
+// the leader's own copy of the entries towards committing them. It must be
+// called without the lock. Entries appended meanwhile are synced along with
+// it, so one sync serves every write waiting on it.
+func (n *Node) syncLog(index uint64) error {
+	n.lock.Lock()
+	if n.durable >= index || n.role != LEADER {
+		n.lock.Unlock()
+		return nil
+	}
+	term, last := n.term, n.lastIndex()
+	n.lock.Unlock()
+
+	if err := n.storage.syncLog(); err != nil {
+		return err
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.term == term && last > n.durable {
+		n.durable = last
+		n.advanceCommit()
+	}
+	return nil
+}
+
+// replicator sends new entries, or a heartbeat, to peer while the node is
+// the leader.
+func (n *Node) replicator(peer string) {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.config.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		case <-n.wake[peer]:
+		}
+		n.replicateTo(peer)
+	}
+}
+
+// replicateTo brings peer's log up to date with the leader's, or as close as
+// a single request gets it.
+func (n *Node) replicateTo(peer string) {
+	n.lock.Lock()
+	if n.role != LEADER {
+		n.lock.Unlock()
+		return
+	}
+	term := n.term
+	next := n.nextIndex[peer]
+	if next <= n.snapshotIndex {
+		n.lock.Unlock()
+		n.sendSnapshot(peer, term)
+		return
+	}
+	request := appendRequest{
+		Term:         term,
+		Leader:       n.config.ID,
+		PrevIndex:    next - 1,
+		PrevTerm:     n.termAt(next - 1),
+		Entries:      n.entriesFrom(next, maxBatch),
+		LeaderCommit: n.commitIndex,
+	}
+	n.lock.Unlock()
+
+	var response appendResponse
+	if err := n.call(peer, APPEND_PATH, request, &response); err != nil {
+		return
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if response.Term > n.term {
+		n.stepDown(response.Term)
+		return
+	}
+	if n.role != LEADER || n.term != term {
+		return
+	}
+	n.lastContact[peer] = time.Now()
+	if response.Success {
+		match := request.PrevIndex + uint64(len(request.Entries))
+		if match > n.matchIndex[peer] {
+			n.matchIndex[peer] = match
+		}
+		n.nextIndex[peer] = n.matchIndex[peer] + 1
+		n.advanceCommit()
+		if n.nextIndex[peer] <= n.lastIndex() {
+			// more to send than fit in one request.
+			select {
+			case n.wake[peer] <- true:
+			default:
+			}
+		}
+		return
+	}
+	// back up to where the follower's log may agree with ours.
+	next = response.ConflictIndex
+	if next < 1 {
+		next = 1
+	}
+	if next > request.PrevIndex {
+		next = request.PrevIndex
+	}
+	n.nextIndex[peer] = next
+	select {
+	case n.wake[peer] <- true:
+	default:
+	}
+}
+
+// advanceCommit commits the newest entry of the leader's term that a
+// majority of the nodes have, and applies everything committed.
+func (n *Node) advanceCommit() {
+	if n.role != LEADER {
+		return
+	}
+	for index := n.lastIndex(); index > n.commitIndex; index-- {
+		if n.termAt(index) != n.term {
+			// entries from earlier terms are only committed along with
+			// one from this term.
+			break
+		}
+		count := 0
+		if n.durable >= index {
+			count++
+		}
+		for _, match := range n.matchIndex {
+			if match >= index {
+				count++
+			}
+		}
+		if count > len(n.config.Peers)/2 {
+			n.commitIndex = index
+			n.applyCommitted()
+			return
+		}
+	}
+}
+
+// applyCommitted applies every committed entry not yet applied to the map,
+// then takes a snapshot if enough have been applied since the last one.
+func (n *Node) applyCommitted() {
+	for n.lastApplied < n.commitIndex {
+		n.lastApplied++
+		entry := n.log[n.lastApplied-n.snapshotIndex-1]
+		ok := n.apply(entry.Command)
+		if waiter, exists := n.waiters[entry.Index]; exists {
+			waiter <- result{ok: ok}
+			delete(n.waiters, entry.Index)
+		}
+	}
+	if n.lastApplied-n.snapshotIndex >= uint64(n.config.SnapshotThreshold) &&
+		!n.snapshotting && !n.closed {
+
+		n.snapshotting = true
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			if err := n.takeSnapshot(); err != nil {
+				log.Errorf("raft: could not take a snapshot: %s", err)
+			}
+			n.lock.Lock()
+			n.snapshotting = false
+			n.lock.Unlock()
+		}()
+	}
+}
+
+func (n *Node) apply(command Command) bool {
+	if command.Time > n.clock {
+		atomic.StoreInt64(&n.clock, command.Time)
+	}
+	switch command.Op {
+	case OP_SET:
+		n.data.Set(command.Key, command.Value)
+	case OP_SET_IF_ABSENT:
+		return n.data.SetIfAbsent(command.Key, command.Value)
+	case OP_CAS:
+		return n.data.CompareAndSwap(command.Key, command.Old, command.Value)
+	case OP_DEL:
+		n.data.Del(command.Key)
+	case OP_EXPIRE:
+		n.data.Reap()
+	case OP_EVICT:
+		for _, key := range command.Keys {
+			n.data.Del(key)
+			counter.Increment(n.evictionCounter())
+		}
+	}
+	return true
+}
+
+func (n *Node) evictionCounter() string {
+	if n.config.Map.EvictionCounter != "" {
+		return n.config.Map.EvictionCounter
+	}
+	return cmap.DEFAULT_EVICTION_COUNTER
+}
+
+/*
+takeSnapshot writes the map as of the last applied entry, and drops the
+entries up to it from the log. It holds the lock to copy the map and to drop
+the entries, but not while writing the copy, so the node carries on meanwhile.
+*/
+func (n *Node) takeSnapshot() error {
+	n.lock.Lock()
+	meta := snapshotMeta{
+		Index: n.lastApplied, Term: n.termAt(n.lastApplied), Time: n.clock,
+	}
+	data := n.data.Copy()
+	n.lock.Unlock()
+	if err := n.storage.saveSnapshot(meta, data); err != nil {
+		return err
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if meta.Index <= n.snapshotIndex {
+		// the leader sent a newer snapshot meanwhile.
+		return nil
+	}
+	n.log = append([]Entry(nil), n.log[meta.Index-n.snapshotIndex:]...)
+	n.snapshotIndex, n.snapshotTerm, n.snapshotTime = meta.Index, meta.Term, meta.Time
+	return n.storage.rewriteLog(n.log)
+}
+
+// Maintenance ====
+
+// maintainer expires and evicts entries every MaintenanceInterval while the
+// node is the leader.
+func (n *Node) maintainer() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.config.MaintenanceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		}
+		if n.Role() != LEADER {
+			continue
+		}
+		if n.config.Map.DefaultTTL > 0 {
+			if _, err := n.propose(Command{Op: OP_EXPIRE}); err != nil {
+				continue
+			}
+		}
+		if keys := n.overCapacity(); len(keys) > 0 {
+			n.propose(Command{Op: OP_EVICT, Keys: keys})
+		}
+	}
+}
+
+// overCapacity returns the keys to evict to bring the map within the
+// capacity of the Config's Map: those expiring soonest, and those which
+// never expire last, each in key order.
+func (n *Node) overCapacity() []string {
+	maxEntries, maxBytes := n.config.Map.MaxEntries, n.config.Map.MaxBytes
+	if maxEntries <= 0 && maxBytes <= 0 {
+		return nil
+	}
+	type sized struct {
+		key     string
+		size    int
+		expires time.Time
+	}
+	var entries []sized
+	bytes := 0
+	n.currentMap().RangeWithExpiry(func(key string, value string, expires time.Time) bool {
+		entries = append(entries, sized{key, len(key) + len(value), expires})
+		bytes += len(key) + len(value)
+		return true
+	})
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i].expires, entries[j].expires
+		return !a.IsZero() && (b.IsZero() || a.Before(b))
+	})
+	var keys []string
+	for len(entries) > 0 && (maxEntries > 0 && len(entries) > maxEntries ||
+		maxBytes > 0 && bytes > maxBytes) {
+
+		keys = append(keys, entries[0].key)
+		bytes -= entries[0].size
+		entries = entries[1:]
+	}
+	return keys
+}
+
+// The store ====
+
+/*
+propose appends a command to the log and waits for it to be applied,
+returning the result of applying it. It fails with ErrNotLeader unless the
+node is the leader.
+*/
+func (n *Node) propose(command Command) (bool, error) {
+	n.lock.Lock()
+	if n.closed {
+		n.lock.Unlock()
+		return false, ErrClosed
+	}
+	if n.role != LEADER {
+		n.lock.Unlock()
+		return false, ErrNotLeader{Leader: n.leader}
+	}
+	// the waiter is in place before the entry is appended, since a cluster
+	// of one applies it as soon as it is on disk.
+	waiter := make(chan result, 1)
+	index := n.lastIndex() + 1
+	n.waiters[index] = waiter
+	if _, err := n.appendLocked(command); err != nil {
+		delete(n.waiters, index)
+		n.lock.Unlock()
+		return false, err
+	}
+	n.lock.Unlock()
+	if err := n.syncLog(index); err != nil {
+		n.lock.Lock()
+		delete(n.waiters, index)
+		n.lock.Unlock()
+		return false, err
+	}
+
+	select {
+	case r := <-waiter:
+		return r.ok, r.err
+	case <-time.After(n.config.ProposeTimeout):
+		n.lock.Lock()
+		delete(n.waiters, index)
+		n.lock.Unlock()
+		return false, ErrTimeout
+	}
+}
+
+// currentMap returns the map, which installing a snapshot replaces.
+func (n *Node) currentMap() *cmap.CMap {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.data
+}
+
+func (n *Node) Get(key string) (string, bool, error) {
+	value, ok := n.currentMap().Get(key)
+	return value, ok, nil
+}
+
+func (n *Node) Range(fn func(key string, value string) bool) error {
+	n.currentMap().Range(fn)
+	return nil
+}
+
+func (n *Node) Set(key string, value string) error {
+	_, err := n.propose(Command{Op: OP_SET, Key: key, Value: value})
+	return err
+}
+
+func (n *Node) SetIfAbsent(key string, value string) (bool, error) {
+	return n.propose(Command{Op: OP_SET_IF_ABSENT, Key: key, Value: value})
+}
+
+func (n *Node) CompareAndSwap(key string, old string, new string) (bool, error) {
+	return n.propose(Command{Op: OP_CAS, Key: key, Old: old, Value: new})
+}
+
+func (n *Node) Del(key string) error {
+	_, err := n.propose(Command{Op: OP_DEL, Key: key})
+	return err
+}
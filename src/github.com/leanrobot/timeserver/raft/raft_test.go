@@ -0,0 +1,543 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	cmap "github.com/leanrobot/timeserver/concurrentmap"
+	"github.com/leanrobot/timeserver/store"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync"
+	tst "testing"
+	"time"
+)
+
+var _ store.Store = &Node{}
+
+const testSecret = "s3cret"
+
+// member is a node of a test cluster, which can be cut off from the others.
+type member struct {
+	lock   sync.Mutex
+	node   *Node
+	down   bool
+	dir    string
+	server *httptest.Server
+}
+
+func (m *member) get() (*Node, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.node, m.down
+}
+
+func (m *member) setDown(down bool) {
+	m.lock.Lock()
+	m.down = down
+	m.lock.Unlock()
+}
+
+func (m *member) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	node, down := m.get()
+	if node == nil || down {
+		res.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	switch req.URL.Path {
+	case VOTE_PATH:
+		node.ServeVote(res, req)
+	case APPEND_PATH:
+		node.ServeAppend(res, req)
+	case INSTALL_SNAPSHOT_PATH:
+		node.ServeInstallSnapshot(res, req)
+	default:
+		res.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// partitioned fails the requests a member sends while it is down.
+type partitioned struct {
+	from *member
+}
+
+func (p partitioned) RoundTrip(req *http.Request) (*http.Response, error) {
+	if _, down := p.from.get(); down {
+		return nil, errors.New("partitioned")
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+type cluster struct {
+	t       *tst.T
+	members []*member
+	peers   []string
+	opts    cmap.Options
+}
+
+func newCluster(t *tst.T, size int) *cluster {
+	return newClusterWithOptions(t, size, cmap.Options{})
+}
+
+// newClusterWithOptions creates a cluster whose nodes' maps are configured by
+// opts.
+func newClusterWithOptions(t *tst.T, size int, opts cmap.Options) *cluster {
+	c := &cluster{t: t, opts: opts}
+	for i := 0; i < size; i++ {
+		m := &member{dir: t.TempDir()}
+		m.server = httptest.NewServer(m)
+		c.members = append(c.members, m)
+		c.peers = append(c.peers, m.server.URL)
+	}
+	for i := range c.members {
+		c.start(i)
+	}
+	t.Cleanup(func() {
+		for i, m := range c.members {
+			c.stop(i)
+			m.server.Close()
+		}
+	})
+	return c
+}
+
+// start opens the node of member i from its directory.
+func (c *cluster) start(i int) {
+	m := c.members[i]
+	node, err := Open(Config{
+		ID:                m.server.URL,
+		Peers:             c.peers,
+		Dir:               m.dir,
+		Map:               c.opts,
+		ElectionTimeout:   50 * time.Millisecond,
+		HeartbeatInterval: 10 * time.Millisecond,
+		SnapshotThreshold: 10,
+		ProposeTimeout:    time.Second,
+		// maintenance is quick, to test it.
+		MaintenanceInterval: 20 * time.Millisecond,
+		Secret:              testSecret,
+		MaxSnapshotBytes:    1 << 20,
+		Client: &http.Client{
+			Transport: partitioned{from: m},
+			Timeout:   100 * time.Millisecond,
+		},
+	})
+	if err != nil {
+		c.t.Fatalf("could not open node %d: %s", i, err)
+	}
+	m.lock.Lock()
+	m.node = node
+	m.lock.Unlock()
+}
+
+func (c *cluster) stop(i int) {
+	m := c.members[i]
+	m.lock.Lock()
+	node := m.node
+	m.node = nil
+	m.lock.Unlock()
+	if node != nil {
+		node.Close()
+	}
+}
+
+func (c *cluster) node(i int) *Node {
+	node, _ := c.members[i].get()
+	return node
+}
+
+// leader waits for a reachable member to lead, returning its index.
+func (c *cluster) leader() int {
+	found := -1
+	eventually(c.t, "a leader", func() bool {
+		for i, m := range c.members {
+			if node, down := m.get(); node != nil && !down && node.Role() == LEADER {
+				found = i
+				return true
+			}
+		}
+		return false
+	})
+	return found
+}
+
+// eventually fails the test unless check passes within five seconds.
+func eventually(t *tst.T, what string, check func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !check() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func has(n *Node, key string, value string) bool {
+	got, ok, _ := n.Get(key)
+	return ok && got == value
+}
+
+// everyone waits for every running member to have key set to value.
+func (c *cluster) everyone(key string, value string) {
+	eventually(c.t, fmt.Sprintf("%s=%s everywhere", key, value), func() bool {
+		for i := range c.members {
+			if node := c.node(i); node != nil && !has(node, key, value) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestCluster(t *tst.T) {
+	c := newCluster(t, 3)
+	leader := c.leader()
+	follower := (leader + 1) % 3
+
+	if err := c.node(leader).Set("a", "1"); err != nil {
+		t.Fatalf("leader refused a write: %s", err)
+	}
+	c.everyone("a", "1")
+	if ok, _ := c.node(leader).CompareAndSwap("a", "2", "3"); ok {
+		t.Errorf("swapped a value which didn't match")
+	}
+	if ok, _ := c.node(leader).SetIfAbsent("b", "1"); !ok {
+		t.Errorf("didn't set an absent value")
+	}
+	err := c.node(follower).Set("a", "2")
+	if notLeader, ok := err.(ErrNotLeader); !ok || notLeader.Leader != c.peers[leader] {
+		t.Errorf("follower write returned %v, expected the leader %s", err,
+			c.peers[leader])
+	}
+
+	// losing the leader loses nothing committed, and the rest carry on.
+	c.members[leader].setDown(true)
+	newLeader := c.leader()
+	if newLeader == leader {
+		t.Fatalf("the partitioned leader is still leading")
+	}
+	// it applies them once it commits an entry of its own term.
+	eventually(t, "the new leader to apply committed writes", func() bool {
+		return has(c.node(newLeader), "a", "1") && has(c.node(newLeader), "b", "1")
+	})
+	if err := c.node(newLeader).Set("c", "1"); err != nil {
+		t.Errorf("new leader refused a write: %s", err)
+	}
+	eventually(t, "the old leader to step down", func() bool {
+		return c.node(leader).Role() != LEADER
+	})
+	if _, ok, _ := c.node(leader).Get("c"); ok {
+		t.Errorf("the partitioned node saw a write")
+	}
+
+	// the old leader catches up once it's back.
+	c.members[leader].setDown(false)
+	c.everyone("c", "1")
+}
+
+// contents returns every key-value of n.
+func contents(n *Node) map[string]string {
+	values := make(map[string]string)
+	n.Range(func(key string, value string) bool {
+		values[key] = value
+		return true
+	})
+	return values
+}
+
+// agree waits for every member to hold exactly what the leader holds.
+func (c *cluster) agree(leader int) map[string]string {
+	var values map[string]string
+	eventually(c.t, "every node to hold the same map", func() bool {
+		values = contents(c.node(leader))
+		for i := range c.members {
+			if !reflect.DeepEqual(contents(c.node(i)), values) {
+				return false
+			}
+		}
+		return true
+	})
+	return values
+}
+
+func TestClusterExpiry(t *tst.T) {
+	c := newClusterWithOptions(t, 3, cmap.Options{
+		DefaultTTL: 500 * time.Millisecond,
+		MaxEntries: 3,
+	})
+	leader := c.leader()
+
+	// the entries written first expire first, so are evicted first, on
+	// every node alike.
+	for i := 0; i < 5; i++ {
+		if err := c.node(leader).Set(fmt.Sprint("k", i), fmt.Sprint(i)); err != nil {
+			t.Fatalf("leader refused a write: %s", err)
+		}
+	}
+	eventually(t, "the map to shrink to its capacity", func() bool {
+		return len(contents(c.node(leader))) == 3
+	})
+	values := c.agree(leader)
+	for _, key := range []string{"k2", "k3", "k4"} {
+		if _, ok := values[key]; !ok {
+			t.Errorf("evicted %s rather than the entries expiring first: %v", key, values)
+		}
+	}
+
+	// whether a write sees an entry is up to the leader's clock, not the
+	// node's, so every node applies the same writes.
+	eventually(t, "the entries to expire", func() bool {
+		return len(contents(c.node(leader))) == 0
+	})
+	if ok, _ := c.node(leader).CompareAndSwap("k4", "4", "x"); ok {
+		t.Errorf("swapped an expired entry")
+	}
+	if ok, _ := c.node(leader).SetIfAbsent("k4", "y"); !ok {
+		t.Errorf("didn't set over an expired entry")
+	}
+	if values := c.agree(leader); values["k4"] != "y" || len(values) != 1 {
+		t.Errorf("the nodes hold %v, expected only k4=y", values)
+	}
+}
+
+func TestRestart(t *tst.T) {
+	c := newCluster(t, 3)
+	leader := c.leader()
+	behind := (leader + 1) % 3
+	c.node(leader).Set("before", "1")
+	c.everyone("before", "1")
+
+	// a node which misses more writes than the leader keeps in its log
+	// is sent a snapshot.
+	c.stop(behind)
+	for i := 0; i < 25; i++ {
+		if err := c.node(leader).Set(fmt.Sprint("k", i), fmt.Sprint(i)); err != nil {
+			t.Fatalf("leader refused a write: %s", err)
+		}
+	}
+	c.node(leader).Del("before")
+	eventually(t, "the leader to take a snapshot", func() bool {
+		return c.node(leader).Stats()["raft-snapshot-index"] > 0
+	})
+	c.start(behind)
+	c.everyone("k24", "24")
+	eventually(t, "the deletion", func() bool {
+		_, ok, _ := c.node(behind).Get("before")
+		return !ok
+	})
+
+	// every node keeps what it has through a restart of the whole cluster.
+	for i := range c.members {
+		c.stop(i)
+	}
+	for i := range c.members {
+		c.start(i)
+	}
+	leader = c.leader()
+	if err := c.node(leader).Set("after", "1"); err != nil {
+		t.Fatalf("leader refused a write: %s", err)
+	}
+	c.everyone("after", "1")
+	c.everyone("k0", "0")
+}
+
+// raftPost sends body to path on node as peer from, with secret.
+func raftPost(t *tst.T, node string, path string, secret string, from string,
+	body []byte) int {
+
+	req, err := http.NewRequest("POST", node+path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(SECRET_HEADER, secret)
+	req.Header.Set(termHeader, "1000")
+	req.Header.Set(leaderHeader, from)
+	req.Header.Set(snapshotIndexHeader, "1000")
+	req.Header.Set(snapshotTermHeader, "1000")
+	req.Header.Set(snapshotTimeHeader, "0")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func TestRefused(t *tst.T) {
+	c := newCluster(t, 3)
+	leader := c.leader()
+	target := c.peers[(leader+1)%3]
+	from := c.peers[leader]
+	vote := func(candidate string) []byte {
+		raw, _ := json.Marshal(voteRequest{Term: 1000, Candidate: candidate,
+			LastIndex: 1000, LastTerm: 1000})
+		return raw
+	}
+	appendBody := func(leader string) []byte {
+		raw, _ := json.Marshal(appendRequest{Term: 1000, Leader: leader})
+		return raw
+	}
+
+	for _, r := range []struct {
+		what   string
+		path   string
+		secret string
+		body   []byte
+		status int
+	}{
+		{"a vote without the secret", VOTE_PATH, "", vote(from), 403},
+		{"a vote for an outsider", VOTE_PATH, testSecret, vote("http://evil"), 403},
+		{"an append with the wrong secret", APPEND_PATH, "wrong", appendBody(from), 403},
+		{"an append from an outsider", APPEND_PATH, testSecret, appendBody("http://evil"), 403},
+		{"a snapshot without the secret", INSTALL_SNAPSHOT_PATH, "", nil, 403},
+		{"a snapshot over the limit", INSTALL_SNAPSHOT_PATH, testSecret,
+			make([]byte, 2<<20), http.StatusRequestEntityTooLarge},
+	} {
+		if status := raftPost(t, target, r.path, r.secret, from, r.body); status != r.status {
+			t.Errorf("%s responded %d, expected %d", r.what, status, r.status)
+		}
+	}
+	// none of them disturbed the cluster.
+	if c.node((leader + 1) % 3).Stats()["raft-term"] >= 1000 {
+		t.Errorf("a refused request changed the term")
+	}
+	if err := c.node(c.leader()).Set("a", "1"); err != nil {
+		t.Errorf("leader refused a write: %s", err)
+	}
+}
+
+// openAlone opens a node of a cluster of one in dir.
+func openAlone(dir string) (*Node, error) {
+	return Open(Config{
+		ID: "http://localhost:1", Peers: []string{"http://localhost:1"},
+		Dir: dir, Secret: testSecret,
+	})
+}
+
+func TestLogGap(t *tst.T) {
+	dir := t.TempDir()
+	s, err := openStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := cmap.New()
+	data.Set("a", "1")
+	if err = s.saveSnapshot(snapshotMeta{Index: 5, Term: 1}, data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.loadLog(); err != nil {
+		t.Fatal(err)
+	}
+	// entries the snapshot covers are skipped.
+	entries := []Entry{}
+	for i := uint64(3); i <= 7; i++ {
+		entries = append(entries, Entry{Index: i, Term: 1, Command: Command{Op: OP_NOOP}})
+	}
+	if err = s.appendLog(entries); err != nil {
+		t.Fatal(err)
+	}
+	s.close()
+	node, err := openAlone(dir)
+	if err != nil {
+		t.Fatalf("couldn't open a log overlapping the snapshot: %s", err)
+	}
+	node.Close()
+
+	// but a gap after the snapshot loses entries.
+	if s, err = openStorage(dir); err == nil {
+		_, err = s.loadLog()
+	}
+	if err == nil {
+		err = s.rewriteLog([]Entry{{Index: 8, Term: 1, Command: Command{Op: OP_NOOP}}})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.close()
+	if node, err = openAlone(dir); err == nil {
+		node.Close()
+		t.Errorf("opened a log with a gap after the snapshot")
+	}
+}
+
+func TestBadSnapshot(t *tst.T) {
+	dir := t.TempDir()
+	node, err := openAlone(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+	eventually(t, "a leader", func() bool { return node.Role() == LEADER })
+	for i := 0; i < 10; i++ {
+		node.Set(fmt.Sprint("k", i), "1")
+	}
+	if err = node.takeSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	index := node.Stats()["raft-snapshot-index"]
+
+	// a snapshot from the leader which doesn't load leaves the node as it
+	// was, older snapshot and all.
+	node.lock.Lock()
+	err = node.installSnapshot(snapshotMeta{Index: uint64(index) + 100, Term: 1},
+		[]byte("junk"))
+	node.lock.Unlock()
+	if err == nil {
+		t.Errorf("installed a junk snapshot")
+	}
+	metas, _ := node.storage.snapshots()
+	if len(metas) != 1 || metas[0].Index != uint64(index) {
+		t.Errorf("the snapshots after a junk one are %v, expected only %d", metas, index)
+	}
+	if !has(node, "k0", "1") {
+		t.Errorf("a junk snapshot changed the map")
+	}
+}
+
+func TestCorruptLog(t *tst.T) {
+	entries := []Entry{
+		{Index: 1, Term: 1, Command: Command{Op: OP_SET, Key: "a", Value: "1"}},
+		{Index: 2, Term: 1, Command: Command{Op: OP_SET, Key: "b", Value: "2"}},
+	}
+	lines, err := formatLogLines(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		what   string
+		log    []byte
+		loaded int
+	}{
+		{"a torn last line", append(append([]byte(nil), lines...), "0000"...), 2},
+		{"a corrupt last line", append(append([]byte(nil), lines...), "0 {}\n"...), 2},
+		{"a corrupt line before others", append([]byte("0 {}\n"), lines...), -1},
+	} {
+		dir := t.TempDir()
+		if err := ioutil.WriteFile(filepath.Join(dir, logFile), c.log, 0600); err != nil {
+			t.Fatal(err)
+		}
+		s, err := openStorage(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := s.loadLog()
+		s.close()
+		if c.loaded < 0 {
+			if err == nil {
+				t.Errorf("%s: loaded %d entries, expected an error", c.what, len(loaded))
+			}
+			continue
+		}
+		if err != nil || len(loaded) != c.loaded {
+			t.Errorf("%s: loaded %d entries, %v, expected %d", c.what, len(loaded),
+				err, c.loaded)
+		}
+		if raw, _ := ioutil.ReadFile(filepath.Join(dir, logFile)); !bytes.Equal(raw, lines) {
+			t.Errorf("%s: the log wasn't truncated to its whole entries", c.what)
+		}
+	}
+}
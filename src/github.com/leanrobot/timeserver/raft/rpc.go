@@ -0,0 +1,389 @@
+package raft
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	log "github.com/cihub/seelog"
+	cmap "github.com/leanrobot/timeserver/concurrentmap"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// The paths a node serves the cluster on.
+const (
+	VOTE_PATH             = "/raft/vote"
+	APPEND_PATH           = "/raft/append"
+	INSTALL_SNAPSHOT_PATH = "/raft/install-snapshot"
+)
+
+// SECRET_HEADER carries the secret shared by the nodes of a cluster.
+const SECRET_HEADER = "X-Raft-Secret"
+
+// The headers describing the snapshot in the body of an install-snapshot
+// request.
+const (
+	termHeader          = "X-Raft-Term"
+	leaderHeader        = "X-Raft-Leader"
+	snapshotIndexHeader = "X-Raft-Snapshot-Index"
+	snapshotTermHeader  = "X-Raft-Snapshot-Term"
+	snapshotTimeHeader  = "X-Raft-Snapshot-Time"
+)
+
+type voteRequest struct {
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+	LastIndex uint64 `json:"last_index"`
+	LastTerm  uint64 `json:"last_term"`
+}
+
+type voteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type appendRequest struct {
+	Term   uint64 `json:"term"`
+	Leader string `json:"leader"`
+	// PrevIndex and PrevTerm are of the entry before Entries, which the
+	// follower's log must have for it to take them.
+	PrevIndex    uint64  `json:"prev_index"`
+	PrevTerm     uint64  `json:"prev_term"`
+	Entries      []Entry `json:"entries,omitempty"`
+	LeaderCommit uint64  `json:"leader_commit"`
+}
+
+type appendResponse struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+	// ConflictIndex is where the leader should try again from when the
+	// follower's log doesn't match, so it needn't back up one at a time.
+	ConflictIndex uint64 `json:"conflict_index,omitempty"`
+}
+
+type installResponse struct {
+	Term uint64 `json:"term"`
+}
+
+// call sends request to path on peer as JSON, decoding the response into
+// response.
+func (n *Node) call(peer string, path string, request interface{}, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	return n.post(peer+path, "application/json", body, nil, response)
+}
+
+func (n *Node) post(target string, contentType string, body []byte,
+	header http.Header, response interface{}) error {
+
+	req, err := http.NewRequest("POST", target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(SECRET_HEADER, n.config.Secret)
+	res, err := n.config.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded %s", target, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(response)
+}
+
+// authorized reports whether req carries the cluster's secret, from the
+// peer from, responding 403 if it doesn't.
+func (n *Node) authorized(res http.ResponseWriter, req *http.Request, from string) bool {
+	secret := []byte(req.Header.Get(SECRET_HEADER))
+	ok := n.config.Secret != "" &&
+		subtle.ConstantTimeCompare(secret, []byte(n.config.Secret)) == 1
+	if ok {
+		ok = false
+		for _, peer := range n.config.Peers {
+			ok = ok || peer == from && peer != n.config.ID
+		}
+	}
+	if !ok {
+		log.Warnf("raft: refused %s from %s, as %q", req.URL.Path,
+			req.RemoteAddr, from)
+		res.WriteHeader(http.StatusForbidden)
+	}
+	return ok
+}
+
+func respond(res http.ResponseWriter, response interface{}) {
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(response)
+}
+
+/*
+ServeVote is the view for VOTE_PATH. A node votes for at most one candidate
+in a term, and only for one whose log is at least as up to date as its own, so
+the winner has every committed entry.
+*/
+func (n *Node) ServeVote(res http.ResponseWriter, req *http.Request) {
+	var request voteRequest
+	if req.Method != "POST" || json.NewDecoder(req.Body).Decode(&request) != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !n.authorized(res, req, request.Candidate) {
+		return
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if request.Term > n.term {
+		n.stepDown(request.Term)
+	}
+	response := voteResponse{Term: n.term}
+	upToDate := request.LastTerm > n.lastTerm() ||
+		request.LastTerm == n.lastTerm() && request.LastIndex >= n.lastIndex()
+	if request.Term == n.term && upToDate &&
+		(n.votedFor == "" || n.votedFor == request.Candidate) {
+
+		n.votedFor = request.Candidate
+		if err := n.saveState(); err != nil {
+			log.Errorf("raft: could not save state: %s", err)
+			res.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		n.resetElectionTimer()
+		response.Granted = true
+	}
+	respond(res, response)
+}
+
+/*
+ServeAppend is the view for APPEND_PATH. It appends the leader's entries to
+the log, replacing any which conflict with them, and applies whatever the
+leader has committed. With no entries it is the leader's heartbeat.
+*/
+func (n *Node) ServeAppend(res http.ResponseWriter, req *http.Request) {
+	var request appendRequest
+	if req.Method != "POST" || json.NewDecoder(req.Body).Decode(&request) != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !n.authorized(res, req, request.Leader) {
+		return
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	response, err := n.appendEntries(request)
+	if err != nil {
+		log.Errorf("raft: could not append to the log: %s", err)
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	respond(res, response)
+}
+
+func (n *Node) appendEntries(request appendRequest) (appendResponse, error) {
+	if request.Term < n.term {
+		return appendResponse{Term: n.term}, nil
+	}
+	n.stepDown(request.Term)
+	n.leader = request.Leader
+	n.resetElectionTimer()
+	response := appendResponse{Term: n.term}
+
+	entries := request.Entries
+	if request.PrevIndex < n.snapshotIndex {
+		// the entries up to the snapshot are committed, so match ours.
+		skip := int(n.snapshotIndex - request.PrevIndex)
+		if skip > len(entries) {
+			skip = len(entries)
+		}
+		entries = entries[skip:]
+		request.PrevIndex, request.PrevTerm = n.snapshotIndex, n.snapshotTerm
+	}
+	if request.PrevIndex > n.lastIndex() {
+		response.ConflictIndex = n.lastIndex() + 1
+		return response, nil
+	}
+	if term := n.termAt(request.PrevIndex); term != request.PrevTerm {
+		// skip back past every entry of the conflicting term.
+		conflict := request.PrevIndex
+		for conflict > n.snapshotIndex+1 && n.termAt(conflict-1) == term {
+			conflict--
+		}
+		response.ConflictIndex = conflict
+		return response, nil
+	}
+
+	truncated := false
+	for i, entry := range entries {
+		if entry.Index <= n.lastIndex() {
+			if n.termAt(entry.Index) == entry.Term {
+				continue
+			}
+			n.log = n.log[:entry.Index-n.snapshotIndex-1]
+			truncated = true
+		}
+		entries = entries[i:]
+		n.log = append(n.log, entries...)
+		var err error
+		if truncated {
+			err = n.storage.rewriteLog(n.log)
+		} else {
+			err = n.storage.appendLog(entries)
+		}
+		if err != nil {
+			return response, err
+		}
+		break
+	}
+
+	last := request.PrevIndex + uint64(len(entries))
+	if len(request.Entries) > 0 {
+		last = request.Entries[len(request.Entries)-1].Index
+	}
+	if request.LeaderCommit > n.commitIndex {
+		n.commitIndex = request.LeaderCommit
+		if last < n.commitIndex {
+			n.commitIndex = last
+		}
+		n.applyCommitted()
+	}
+	response.Success = true
+	return response, nil
+}
+
+// sendSnapshot sends the leader's snapshot to a follower whose next entry
+// the leader's log no longer has.
+func (n *Node) sendSnapshot(peer string, term uint64) {
+	n.lock.Lock()
+	meta := snapshotMeta{Index: n.snapshotIndex, Term: n.snapshotTerm, Time: n.snapshotTime}
+	raw, err := ioutil.ReadFile(n.storage.snapshotPath(meta))
+	n.lock.Unlock()
+	if err != nil {
+		log.Errorf("raft: could not read the snapshot: %s", err)
+		return
+	}
+
+	header := http.Header{}
+	header.Set(termHeader, fmt.Sprint(term))
+	header.Set(leaderHeader, n.config.ID)
+	header.Set(snapshotIndexHeader, fmt.Sprint(meta.Index))
+	header.Set(snapshotTermHeader, fmt.Sprint(meta.Term))
+	header.Set(snapshotTimeHeader, fmt.Sprint(meta.Time))
+	var response installResponse
+	err = n.post(peer+INSTALL_SNAPSHOT_PATH, "application/octet-stream", raw,
+		header, &response)
+	if err != nil {
+		return
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if response.Term > n.term {
+		n.stepDown(response.Term)
+		return
+	}
+	if n.role != LEADER || n.term != term {
+		return
+	}
+	log.Infof("raft: sent %s the snapshot at %d", peer, meta.Index)
+	if meta.Index > n.matchIndex[peer] {
+		n.matchIndex[peer] = meta.Index
+	}
+	n.nextIndex[peer] = n.matchIndex[peer] + 1
+	n.lastContact[peer] = time.Now()
+}
+
+/*
+ServeInstallSnapshot is the view for INSTALL_SNAPSHOT_PATH. The body is the
+leader's snapshot, as written by WriteToDisk, which replaces the map and every
+entry of the log it covers. A snapshot over the MaxSnapshotBytes is refused.
+*/
+func (n *Node) ServeInstallSnapshot(res http.ResponseWriter, req *http.Request) {
+	term, err1 := strconv.ParseUint(req.Header.Get(termHeader), 10, 64)
+	index, err2 := strconv.ParseUint(req.Header.Get(snapshotIndexHeader), 10, 64)
+	snapshotTerm, err3 := strconv.ParseUint(req.Header.Get(snapshotTermHeader), 10, 64)
+	snapshotTime, err4 := strconv.ParseInt(req.Header.Get(snapshotTimeHeader), 10, 64)
+	if req.Method != "POST" || err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !n.authorized(res, req, req.Header.Get(leaderHeader)) {
+		return
+	}
+	// read a byte past the limit, so a snapshot over it can be told from one
+	// exactly at it.
+	raw, err := ioutil.ReadAll(io.LimitReader(req.Body, n.config.MaxSnapshotBytes+1))
+	if int64(len(raw)) > n.config.MaxSnapshotBytes {
+		res.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if term < n.term {
+		respond(res, installResponse{Term: n.term})
+		return
+	}
+	n.stepDown(term)
+	n.leader = req.Header.Get(leaderHeader)
+	n.resetElectionTimer()
+	if index > n.commitIndex {
+		meta := snapshotMeta{Index: index, Term: snapshotTerm, Time: snapshotTime}
+		if err := n.installSnapshot(meta, raw); err != nil {
+			log.Errorf("raft: could not install the snapshot: %s", err)
+			res.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log.Infof("raft: installed the snapshot at %d from %s", index, n.leader)
+	}
+	respond(res, installResponse{Term: n.term})
+}
+
+func (n *Node) installSnapshot(meta snapshotMeta, raw []byte) error {
+	index, term := meta.Index, meta.Term
+	if err := n.storage.saveSnapshotFile(meta, raw); err != nil {
+		return err
+	}
+	// the snapshot replaces the older ones only once it is known to load.
+	clock := n.clock
+	atomic.StoreInt64(&n.clock, meta.Time)
+	data, err := cmap.LoadFromDiskWithOptions(n.storage.snapshotPath(meta),
+		n.mapOptions())
+	if err != nil {
+		atomic.StoreInt64(&n.clock, clock)
+		os.Remove(n.storage.snapshotPath(meta))
+		return err
+	}
+
+	// keep the entries after the snapshot only if the log agrees with it.
+	if index < n.lastIndex() && index > n.snapshotIndex && n.termAt(index) == term {
+		n.log = append([]Entry(nil), n.log[index-n.snapshotIndex:]...)
+	} else {
+		n.log = nil
+	}
+	n.snapshotIndex, n.snapshotTerm, n.snapshotTime = index, term, meta.Time
+	n.commitIndex, n.lastApplied = index, index
+	n.data.Close()
+	n.data = data
+	if err := n.storage.rewriteLog(n.log); err != nil {
+		return err
+	}
+	return n.storage.removeSnapshotsBefore(index)
+}
@@ -0,0 +1,362 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/cihub/seelog"
+	cmap "github.com/leanrobot/timeserver/concurrentmap"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+A node keeps everything it must not forget across a restart in its directory:
+
+	state.json                 its current term and vote
+	raft.log                   log entries after the latest snapshot
+	snapshot-<index>-<term>-<time>
+	                           the map as of the entry at index, a dumpfile
+
+Each line of raft.log is the CRC-32 of a JSON entry in hex, a space, and the
+entry, like the lines of a concurrentmap journal. Every write is fsynced
+before the node acts on it. Snapshots are written with WriteToDisk under a new
+name each time, so a snapshot and the entry it was taken at can never
+disagree. A snapshot's time is the cluster's clock as of that entry, which its
+entries expire by.
+*/
+const (
+	stateFile      = "state.json"
+	logFile        = "raft.log"
+	snapshotPrefix = "snapshot-"
+)
+
+// persistentState is the part of a node's state written to state.json.
+type persistentState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for,omitempty"`
+}
+
+type storage struct {
+	dir string
+	// lock guards log, which the leader syncs without holding its node's
+	// lock.
+	lock sync.Mutex
+	log  *os.File
+}
+
+// snapshotMeta locates a snapshot taken at the entry at Index, when the
+// clock read Time.
+type snapshotMeta struct {
+	Index uint64
+	Term  uint64
+	Time  int64
+	Path  string
+}
+
+func openStorage(dir string) (*storage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &storage{dir: dir}, nil
+}
+
+func (s *storage) path(name string) string {
+	return filepath.Join(s.dir, name)
+}
+
+// loadState reads the term and vote, which are zero if never saved.
+func (s *storage) loadState() (persistentState, error) {
+	var state persistentState
+	raw, err := ioutil.ReadFile(s.path(stateFile))
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	return state, json.Unmarshal(raw, &state)
+}
+
+// saveState durably replaces the term and vote.
+func (s *storage) saveState(state persistentState) error {
+	raw, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFileSync(s.path(stateFile), raw)
+}
+
+/*
+loadLog reads the log entries and opens the log for appending. An incomplete
+or corrupt last line can only be the entry being written when the node died,
+so the log is truncated before it. A corrupt line with more after it is
+damage, which fails rather than drop the entries after it.
+*/
+func (s *storage) loadLog() ([]Entry, error) {
+	file, err := os.OpenFile(s.path(logFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	var valid int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		entry, ok := parseLogLine(line)
+		if !ok {
+			if _, err = reader.Peek(1); err != io.EOF {
+				file.Close()
+				return nil, fmt.Errorf("raft: %s is corrupt after %d entries",
+					s.path(logFile), len(entries))
+			}
+			break
+		}
+		entries = append(entries, entry)
+		valid += int64(len(line))
+	}
+	if err = file.Truncate(valid); err == nil {
+		_, err = file.Seek(valid, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	s.lock.Lock()
+	s.log = file
+	s.lock.Unlock()
+	return entries, nil
+}
+
+func parseLogLine(line []byte) (Entry, bool) {
+	var entry Entry
+	fields := bytes.SplitN(bytes.TrimSuffix(line, []byte("\n")), []byte(" "), 2)
+	if len(fields) != 2 {
+		return entry, false
+	}
+	checksum, err := strconv.ParseUint(string(fields[0]), 16, 32)
+	if err != nil || crc32.ChecksumIEEE(fields[1]) != uint32(checksum) {
+		return entry, false
+	}
+	return entry, json.Unmarshal(fields[1], &entry) == nil
+}
+
+func formatLogLines(entries []Entry) ([]byte, error) {
+	var lines bytes.Buffer
+	for _, entry := range entries {
+		payload, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&lines, "%08x %s\n", crc32.ChecksumIEEE(payload), payload)
+	}
+	return lines.Bytes(), nil
+}
+
+// appendLog durably appends entries to the log.
+func (s *storage) appendLog(entries []Entry) error {
+	if err := s.writeLog(entries); err != nil {
+		return err
+	}
+	return s.syncLog()
+}
+
+// writeLog appends entries to the log, which isn't durable until syncLog.
+func (s *storage) writeLog(entries []Entry) error {
+	lines, err := formatLogLines(entries)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.log == nil {
+		return os.ErrClosed
+	}
+	_, err = s.log.Write(lines)
+	return err
+}
+
+// syncLog makes every entry written to the log durable.
+func (s *storage) syncLog() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.log == nil {
+		return os.ErrClosed
+	}
+	return s.log.Sync()
+}
+
+// rewriteLog durably replaces the whole log with entries, when entries are
+// truncated from its end or folded into a snapshot.
+func (s *storage) rewriteLog(entries []Entry) error {
+	lines, err := formatLogLines(entries)
+	if err != nil {
+		return err
+	}
+	if err = writeFileSync(s.path(logFile), lines); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.log != nil {
+		s.log.Close()
+	}
+	s.log, err = os.OpenFile(s.path(logFile), os.O_WRONLY|os.O_APPEND, 0600)
+	return err
+}
+
+// snapshots returns the snapshots in the directory, newest first.
+func (s *storage) snapshots() ([]snapshotMeta, error) {
+	names, err := filepath.Glob(s.path(snapshotPrefix + "*"))
+	if err != nil {
+		return nil, err
+	}
+	var metas []snapshotMeta
+	for _, name := range names {
+		fields := strings.Split(strings.TrimPrefix(filepath.Base(name),
+			snapshotPrefix), "-")
+		// snapshots from before the clock have no time.
+		if len(fields) == 2 {
+			fields = append(fields, "0")
+		}
+		if len(fields) != 3 {
+			continue
+		}
+		index, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		term, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		at, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		metas = append(metas, snapshotMeta{
+			Index: index, Term: term, Time: at, Path: name,
+		})
+	}
+	sort.Slice(metas, func(i, j int) bool {
+		return metas[i].Index > metas[j].Index
+	})
+	return metas, nil
+}
+
+/*
+loadSnapshot loads the newest snapshot which can be read into a map made with
+opts, calling setClock with the snapshot's time first so the map's Clock
+reads it. The meta is zero and the map empty if there is none.
+*/
+func (s *storage) loadSnapshot(opts cmap.Options,
+	setClock func(at int64)) (snapshotMeta, *cmap.CMap, error) {
+
+	metas, err := s.snapshots()
+	if err != nil {
+		return snapshotMeta{}, nil, err
+	}
+	for _, meta := range metas {
+		setClock(meta.Time)
+		data, err := cmap.LoadFromDiskWithOptions(meta.Path, opts)
+		if err == nil {
+			return meta, data, nil
+		}
+		// the newest snapshot is damaged. an older one only does if the
+		// log still holds every entry since it, which Open checks.
+		log.Warnf("raft: could not load snapshot %s: %s", meta.Path, err)
+	}
+	setClock(0)
+	return snapshotMeta{}, cmap.NewWithOptions(opts), nil
+}
+
+// snapshotPath returns where the snapshot described by meta is kept.
+func (s *storage) snapshotPath(meta snapshotMeta) string {
+	return s.path(fmt.Sprintf("%s%d-%d-%d", snapshotPrefix, meta.Index, meta.Term,
+		meta.Time))
+}
+
+// saveSnapshot writes data as the snapshot described by meta, then removes
+// every older snapshot.
+func (s *storage) saveSnapshot(meta snapshotMeta, data *cmap.CMap) error {
+	if err := cmap.WriteToDisk(s.snapshotPath(meta), data); err != nil {
+		return err
+	}
+	return s.removeSnapshotsBefore(meta.Index)
+}
+
+// saveSnapshotFile durably writes a snapshot received from the leader as the
+// raw dumpfile. Unlike saveSnapshot it keeps the older snapshots, since the
+// new one is yet to be read.
+func (s *storage) saveSnapshotFile(meta snapshotMeta, raw []byte) error {
+	return writeFileSync(s.snapshotPath(meta), raw)
+}
+
+func (s *storage) removeSnapshotsBefore(index uint64) error {
+	metas, err := s.snapshots()
+	if err != nil {
+		return err
+	}
+	for _, meta := range metas {
+		if meta.Index < index {
+			os.Remove(meta.Path)
+			os.Remove(meta.Path + ".bak")
+		}
+	}
+	return nil
+}
+
+func (s *storage) close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.log == nil {
+		return nil
+	}
+	err := s.log.Close()
+	s.log = nil
+	return err
+}
+
+// writeFileSync atomically replaces the file at path with data, fsyncing it
+// and its directory.
+func writeFileSync(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
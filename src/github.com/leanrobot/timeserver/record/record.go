@@ -0,0 +1,157 @@
+/*
+record package defines the session record the authserver stores for every
+session id, and its encoding as a concurrentmap value and on the wire.
+*/
+package record
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/leanrobot/timeserver/store"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Form keys used to send a record to the authserver's /set.
+const (
+	FORM_NAME        = "name"
+	FORM_CLIENT_IP   = "ip"
+	FORM_USER_AGENT  = "agent"
+	FORM_ATTR_PREFIX = "attr."
+)
+
+// Session is everything the authserver knows about a single session.
+type Session struct {
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+
+	// The client which created the session.
+	ClientIP  string `json:"client_ip,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+
+	// Attributes holds free-form data about the session.
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// New creates a session record for username, created and last seen now.
+func New(username string) *Session {
+	now := time.Now().UTC()
+	return &Session{
+		Username:  username,
+		CreatedAt: now,
+		LastSeen:  now,
+	}
+}
+
+// Encode returns the record as a JSON string.
+func (s *Session) Encode() string {
+	bytes, err := json.Marshal(s)
+	if err != nil {
+		// a Session is always marshallable.
+		panic(err)
+	}
+	return string(bytes)
+}
+
+/*
+Decode parses a record produced by Encode. Values stored before records
+existed are a bare username; these are decoded as a record with only the
+username set, which Migrate stores as a whole record. A value starting with {
+is always taken for a record, so one which doesn't parse, or has no username,
+is an error rather than a username.
+*/
+func Decode(value string) (*Session, error) {
+	if len(value) == 0 {
+		return nil, errors.New("record: empty session record")
+	}
+	if !strings.HasPrefix(value, "{") {
+		return &Session{Username: value}, nil
+	}
+	var s Session
+	if err := json.Unmarshal([]byte(value), &s); err != nil {
+		return nil, fmt.Errorf("record: corrupt session record: %s", err)
+	}
+	if len(s.Username) == 0 {
+		return nil, errors.New("record: session record has no username")
+	}
+	return &s, nil
+}
+
+// Legacy reports whether the record was decoded from a bare username, and
+// so hasn't been stored as a record yet.
+func (s *Session) Legacy() bool {
+	return s.CreatedAt.IsZero()
+}
+
+/*
+Migrate stores every value in st stored before records existed, a bare
+username, as a record created and last seen now, so that everything reading
+the store finds only records. It returns how many values it migrated. A value
+changed while Migrate runs is left as it was changed, and a corrupt record is
+left alone.
+*/
+func Migrate(st store.Store) (int, error) {
+	legacy := make(map[string]string)
+	err := st.Range(func(key string, value string) bool {
+		if session, err := Decode(value); err == nil && session.Legacy() {
+			legacy[key] = value
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	now := time.Now().UTC()
+	for key, value := range legacy {
+		session, _ := Decode(value)
+		session.CreatedAt = now
+		session.LastSeen = now
+		stored, err := st.CompareAndSwap(key, value, session.Encode())
+		if err != nil {
+			return migrated, err
+		}
+		if stored {
+			migrated++
+		}
+	}
+	return migrated, nil
+}
+
+// Form returns the client supplied fields of the record as form values for
+// the authserver's /set. Timestamps are always set by the authserver.
+func (s *Session) Form() url.Values {
+	form := url.Values{}
+	form.Set(FORM_NAME, s.Username)
+	if len(s.ClientIP) > 0 {
+		form.Set(FORM_CLIENT_IP, s.ClientIP)
+	}
+	if len(s.UserAgent) > 0 {
+		form.Set(FORM_USER_AGENT, s.UserAgent)
+	}
+	for key, value := range s.Attributes {
+		form.Set(FORM_ATTR_PREFIX+key, value)
+	}
+	return form
+}
+
+// FromForm creates a new record, created and last seen now, from form values
+// produced by Form. The username of the record is empty if form has none.
+func FromForm(form url.Values) *Session {
+	s := New(form.Get(FORM_NAME))
+	s.ClientIP = form.Get(FORM_CLIENT_IP)
+	s.UserAgent = form.Get(FORM_USER_AGENT)
+	for key := range form {
+		if strings.HasPrefix(key, FORM_ATTR_PREFIX) {
+			if s.Attributes == nil {
+				s.Attributes = make(map[string]string)
+			}
+			s.Attributes[strings.TrimPrefix(key, FORM_ATTR_PREFIX)] = form.Get(key)
+		}
+	}
+	return s
+}
@@ -0,0 +1,84 @@
+package record
+
+import (
+	cmap "github.com/leanrobot/timeserver/concurrentmap"
+	"github.com/leanrobot/timeserver/store"
+	tst "testing"
+)
+
+func TestEncodeDecode(t *tst.T) {
+	session := New("tom")
+	session.ClientIP = "127.0.0.1"
+	session.Attributes = map[string]string{"theme": "dark"}
+
+	decoded, err := Decode(session.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Encode() != session.Encode() {
+		t.Errorf("got %s, expected %s", decoded.Encode(), session.Encode())
+	}
+	if decoded.Legacy() {
+		t.Errorf("a decoded record is marked as legacy")
+	}
+}
+
+func TestDecodeLegacy(t *tst.T) {
+	for _, name := range []string{"tom", "tom}"} {
+		session, err := Decode(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if session.Username != name || !session.Legacy() {
+			t.Errorf("Decode(%q) = %+v, expected a legacy record", name, session)
+		}
+	}
+	// anything starting with { is a record, or corrupt.
+	for _, value := range []string{"", "{tom}", `{"username":"tom"`, `{"created_at":"x"}`, "{}"} {
+		if session, err := Decode(value); err == nil {
+			t.Errorf("Decode(%q) = %+v, expected an error", value, session)
+		}
+	}
+}
+
+func TestForm(t *tst.T) {
+	session := New("tom")
+	session.UserAgent = "curl"
+	session.Attributes = map[string]string{"theme": "dark"}
+
+	fromForm := FromForm(session.Form())
+	if fromForm.Username != "tom" || fromForm.UserAgent != "curl" ||
+		fromForm.Attributes["theme"] != "dark" {
+		t.Errorf("got %+v, expected %+v", fromForm, session)
+	}
+}
+
+func TestMigrate(t *tst.T) {
+	st := store.NewMemory(cmap.Options{})
+	current := New("ann").Encode()
+	st.Set("a", "tom")
+	st.Set("b", current)
+	st.Set("c", "tom}")
+	st.Set("corrupt", `{"username":"tom"`)
+
+	migrated, err := Migrate(st)
+	if err != nil || migrated != 2 {
+		t.Fatalf("Migrate() = %d, %v, expected 2 migrated", migrated, err)
+	}
+	for key, name := range map[string]string{"a": "tom", "c": "tom}"} {
+		value, _, _ := st.Get(key)
+		session, err := Decode(value)
+		if err != nil || session.Username != name || session.Legacy() {
+			t.Errorf("%s holds %q after migrating, expected a record for %s", key, value, name)
+		}
+	}
+	if value, _, _ := st.Get("b"); value != current {
+		t.Errorf("migrating changed a record to %q", value)
+	}
+	if value, _, _ := st.Get("corrupt"); value != `{"username":"tom"` {
+		t.Errorf("migrating changed a corrupt record to %q", value)
+	}
+	if migrated, _ := Migrate(st); migrated != 0 {
+		t.Errorf("migrated %d values again", migrated)
+	}
+}
@@ -0,0 +1,191 @@
+package replication
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/cihub/seelog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+/*
+follow keeps the store up to date with the primary until stop is closed,
+closing done once it has stopped. Whenever the stream is lost it reconnects
+after the RetryInterval, bootstrapping again if the changes it needs are gone.
+*/
+func (n *Node) follow(stop chan bool, done chan bool) {
+	defer close(done)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	bootstrapped := false
+	for {
+		var err error
+		if !bootstrapped {
+			err = n.bootstrap(ctx)
+			bootstrapped = err == nil
+		}
+		if err == nil {
+			err = n.stream(ctx)
+		}
+		if err == ErrGone {
+			log.Warnf("replication: bootstrapping again from %s", n.primary)
+			bootstrapped = false
+		} else if err != nil && ctx.Err() == nil {
+			log.Errorf("replication: lost primary %s: %s", n.primary, err)
+		}
+		n.stateLock.Lock()
+		n.connected = false
+		n.stateLock.Unlock()
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(n.opts.RetryInterval):
+		}
+	}
+}
+
+// bootstrap replaces the contents of the store with a snapshot of the
+// primary's.
+func (n *Node) bootstrap(ctx context.Context) error {
+	res, err := n.get(ctx, SNAPSHOT_PATH, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	var snapshot Snapshot
+	if err = json.NewDecoder(res.Body).Decode(&snapshot); err != nil {
+		return err
+	}
+
+	var stale []string
+	err = n.store.Range(func(key string, value string) bool {
+		if _, ok := snapshot.Entries[key]; !ok {
+			stale = append(stale, key)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range stale {
+		if err = n.store.Del(key); err != nil {
+			return err
+		}
+	}
+	for key, e := range snapshot.Entries {
+		if err = n.write(key, e.Value, e.Expires); err != nil {
+			return err
+		}
+	}
+
+	n.stateLock.Lock()
+	n.primaryID = snapshot.ID
+	n.applied = snapshot.Seq
+	n.lastTime = time.Now().UnixNano()
+	n.stateLock.Unlock()
+	log.Infof("replication: bootstrapped %d sessions from %s at %d",
+		len(snapshot.Entries), n.primary, snapshot.Seq)
+	return nil
+}
+
+// stream applies the primary's changes to the store until the stream ends.
+func (n *Node) stream(ctx context.Context) error {
+	n.stateLock.Lock()
+	query := url.Values{}
+	query.Set("id", n.primaryID)
+	query.Set("since", fmt.Sprint(n.applied))
+	n.stateLock.Unlock()
+
+	res, err := n.get(ctx, STREAM_PATH, query)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	n.stateLock.Lock()
+	n.connected = true
+	n.stateLock.Unlock()
+
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var change Change
+		if err := json.Unmarshal(scanner.Bytes(), &change); err != nil {
+			return err
+		}
+		if err := n.apply(change); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("stream ended")
+}
+
+// apply applies a single change from the stream to the store.
+func (n *Node) apply(change Change) error {
+	n.stateLock.Lock()
+	applied := n.applied
+	n.stateLock.Unlock()
+
+	var err error
+	switch {
+	case change.Op == OP_HEARTBEAT:
+		if change.Seq != applied {
+			return ErrGone
+		}
+	case change.Seq != applied+1:
+		// a change was missed; only a snapshot can fix that.
+		return ErrGone
+	case change.Op == OP_SET:
+		err = n.write(change.Key, change.Value, change.Expires)
+	case change.Op == OP_DEL:
+		err = n.store.Del(change.Key)
+	default:
+		return fmt.Errorf("unknown change %q", change.Op)
+	}
+	if err != nil {
+		return err
+	}
+
+	n.stateLock.Lock()
+	n.applied = change.Seq
+	n.lastTime = change.Time
+	n.stateLock.Unlock()
+	return nil
+}
+
+// get requests path from the primary, failing with ErrGone on a 410.
+func (n *Node) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	target := n.primary + path
+	if query != nil {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(SECRET_HEADER, n.opts.Secret)
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusGone {
+		res.Body.Close()
+		return nil, ErrGone
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("%s responded %s", target, res.Status)
+	}
+	return res, nil
+}
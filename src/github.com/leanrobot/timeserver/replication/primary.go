@@ -0,0 +1,155 @@
+package replication
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	log "github.com/cihub/seelog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The paths a node serves replication on.
+const (
+	SNAPSHOT_PATH = "/replicate/snapshot"
+	STREAM_PATH   = "/replicate/stream"
+	PROMOTE_PATH  = "/promote"
+)
+
+// authorized reports whether req carries the node's secret, responding 403
+// if it doesn't.
+func (n *Node) authorized(res http.ResponseWriter, req *http.Request) bool {
+	secret := []byte(req.Header.Get(SECRET_HEADER))
+	if n.opts.Secret == "" ||
+		subtle.ConstantTimeCompare(secret, []byte(n.opts.Secret)) != 1 {
+
+		log.Warnf("replication: refused %s %s from %s without the secret",
+			req.Method, req.URL.Path, req.RemoteAddr)
+		res.WriteHeader(http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+/*
+ServeSnapshot is the view for SNAPSHOT_PATH. It responds with a Snapshot of
+the whole store as JSON, blocking writes while the store is read.
+*/
+func (n *Node) ServeSnapshot(res http.ResponseWriter, req *http.Request) {
+	if !n.authorized(res, req) {
+		return
+	}
+	if n.Role() != PRIMARY {
+		res.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	n.lock.Lock()
+	n.logLock.Lock()
+	snapshot := Snapshot{ID: n.id, Seq: n.seq}
+	n.logLock.Unlock()
+	var err error
+	snapshot.Entries, err = n.entries()
+	n.lock.Unlock()
+	if err != nil {
+		log.Errorf("could not snapshot the store: %s", err)
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(snapshot)
+}
+
+/*
+ServeStream is the view for STREAM_PATH. Given the id of a log and the
+sequence number of the last change a follower has, it streams every later
+change as a line of JSON, and a heartbeat whenever there are none, until the
+follower disconnects. It responds 410 if the changes are gone, in which case
+the follower needs a new snapshot.
+*/
+func (n *Node) ServeStream(res http.ResponseWriter, req *http.Request) {
+	if !n.authorized(res, req) {
+		return
+	}
+	if n.Role() != PRIMARY {
+		res.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	id := req.FormValue("id")
+	since, err := strconv.ParseUint(req.FormValue("since"), 10, 64)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	changes, wake, err := n.changesSince(id, since)
+	if err != nil {
+		res.WriteHeader(http.StatusGone)
+		return
+	}
+
+	log.Infof("follower %s streaming changes after %d", req.RemoteAddr, since)
+	n.logLock.Lock()
+	n.followers++
+	n.logLock.Unlock()
+	defer func() {
+		n.logLock.Lock()
+		n.followers--
+		n.logLock.Unlock()
+	}()
+
+	res.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := res.(http.Flusher)
+	writer := bufio.NewWriter(res)
+	encoder := json.NewEncoder(writer)
+	heartbeat := time.NewTicker(n.opts.HeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		for _, change := range changes {
+			encoder.Encode(change)
+			since = change.Seq
+		}
+		if err = writer.Flush(); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		select {
+		case <-wake:
+		case <-heartbeat.C:
+			encoder.Encode(Change{
+				Seq: since, Op: OP_HEARTBEAT, Time: time.Now().UnixNano(),
+			})
+		case <-req.Context().Done():
+			return
+		}
+		if changes, wake, err = n.changesSince(id, since); err != nil {
+			// the follower fell behind the backlog. ending the stream
+			// makes it start over from a snapshot.
+			log.Warnf("follower %s fell behind the backlog", req.RemoteAddr)
+			return
+		}
+	}
+}
+
+// ServePromote is the view for PROMOTE_PATH, which promotes the node to a
+// primary for a manual failover. It only accepts POST.
+func (n *Node) ServePromote(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !n.authorized(res, req) {
+		return
+	}
+	if n.Role() == FOLLOWER {
+		log.Warn("Promoting this follower to primary.")
+	}
+	n.Promote()
+
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(n.Stats())
+}
@@ -0,0 +1,557 @@
+/*
+replication package replicates an authserver session store from a primary
+authserver to any number of followers over HTTP.
+
+The primary numbers every write to its store with a sequence number and keeps
+the most recent ones in a backlog. A follower bootstraps from a full snapshot
+of the primary's store, taken at some sequence number, then streams every
+change after it in order. If the follower falls so far behind that the changes
+it needs have left the backlog, or it loses track of the sequence, it
+bootstraps again.
+
+Every change carries the time its value expires, as does every entry of a
+snapshot, so a follower expires a session when the primary does, give or take
+the difference between their clocks, rather than a whole TTL after copying
+it. Sessions a Watchable store expires or evicts of its own accord are
+changes too: the primary hears of them from a concurrentmap Watcher and
+records the key as it then is. The watcher hears of nothing else, since the
+writes through the node are recorded as they are made, and drops events rather
+than slow the store down, so a primary which misses one starts a new log, and
+its followers bootstrap again. A follower's store should be no smaller than the primary's,
+since a follower evicting sessions of its own loses them until it bootstraps.
+
+Followers are read only until they are promoted, which makes them a primary of
+their own. Promotion is manual; the old primary should be stopped first, since
+nothing stops two primaries taking writes at once.
+
+A snapshot holds every session, and a promotion can split the sessions between
+two primaries, so every request to the replication paths must carry the
+Secret the nodes share in SECRET_HEADER. A node with no Secret refuses them
+all.
+*/
+package replication
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	log "github.com/cihub/seelog"
+	cmap "github.com/leanrobot/timeserver/concurrentmap"
+	"github.com/leanrobot/timeserver/store"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// The roles a Node can have.
+const (
+	PRIMARY  = "primary"
+	FOLLOWER = "follower"
+)
+
+// The operations of a Change.
+const (
+	OP_SET = "set"
+	OP_DEL = "del"
+	// OP_HEARTBEAT changes nothing. It is streamed when there are no
+	// changes, so a follower knows the primary is still there.
+	OP_HEARTBEAT = "heartbeat"
+)
+
+const (
+	DEFAULT_BACKLOG            = 10000
+	DEFAULT_HEARTBEAT_INTERVAL = time.Second
+	DEFAULT_RETRY_INTERVAL     = time.Second
+
+	// SECRET_HEADER carries the secret shared by a primary and its
+	// followers.
+	SECRET_HEADER = "X-Replication-Secret"
+
+	// writes to the same key are serialized on one of this many locks, so
+	// the backlog holds them in the order they were made.
+	stripes = 64
+)
+
+var (
+	ErrReadOnly = errors.New("replication: a follower is read only until promoted")
+	ErrGone     = errors.New("replication: the changes are no longer in the primary's backlog")
+)
+
+// Change is a single write to the primary's store, as streamed to followers.
+type Change struct {
+	Seq   uint64 `json:"seq"`
+	Op    string `json:"op"`
+	Key   string `json:"key,omitempty"`
+	Value string `json:"value,omitempty"`
+	// Expires is when Value expires, in Unix nanoseconds, zero if never.
+	Expires int64 `json:"expires,omitempty"`
+	// Time is when the primary made the change, or sent the heartbeat, in
+	// Unix nanoseconds.
+	Time int64 `json:"time"`
+}
+
+// Snapshot is the whole of the primary's store as of the change numbered
+// Seq, in the log identified by ID.
+type Snapshot struct {
+	ID      string           `json:"id"`
+	Seq     uint64           `json:"seq"`
+	Entries map[string]Entry `json:"entries"`
+}
+
+// Entry is a value in a Snapshot, with when it expires in Unix nanoseconds,
+// zero if never.
+type Entry struct {
+	Value   string `json:"value"`
+	Expires int64  `json:"expires,omitempty"`
+}
+
+// Options configures a Node.
+type Options struct {
+	// Backlog is how many changes a primary keeps for followers which fall
+	// behind. Zero uses DEFAULT_BACKLOG.
+	Backlog int
+	// HeartbeatInterval is how often a primary streams a heartbeat when
+	// there are no changes. Zero uses DEFAULT_HEARTBEAT_INTERVAL.
+	HeartbeatInterval time.Duration
+	// RetryInterval is how long a follower waits to reconnect after losing
+	// the primary. Zero uses DEFAULT_RETRY_INTERVAL.
+	RetryInterval time.Duration
+	// Secret is shared by the primary and its followers, which send it
+	// with every request. A primary with no Secret serves no one.
+	Secret string
+}
+
+/*
+Node is a store.Store which is either the primary, recording every write for
+its followers, or a follower, applying the primary's writes and refusing its
+own with ErrReadOnly.
+*/
+type Node struct {
+	store store.Store
+	opts  Options
+
+	// writes hold lock for reading and the stripe of their key, so a
+	// snapshot holding lock for writing sees no write half done.
+	lock    sync.RWMutex
+	stripes [stripes]sync.Mutex
+
+	// logLock guards the log of changes a primary streams to followers.
+	logLock sync.Mutex
+	// id identifies the log, which starts over whenever a node becomes a
+	// primary, so a follower can't resume from a sequence number of
+	// another primary's log.
+	id      string
+	seq     uint64
+	backlog []Change
+	// wake is closed, and replaced, whenever a change is recorded.
+	wake      chan bool
+	followers int
+
+	// watcher reports the keys a Watchable store expires or evicts itself,
+	// and watchDone is closed once they have all been recorded. Both are
+	// nil for other stores, and once the node is closed.
+	watcher   *cmap.Watcher
+	watchDone chan bool
+
+	// promoteLock serializes Promote and Close, which wait for the follower
+	// to stop without holding stateLock, since following needs it.
+	promoteLock sync.Mutex
+	// stateLock guards the role, and the follower state.
+	stateLock sync.Mutex
+	role      string
+	following
+}
+
+// following is the state of a follower.
+type following struct {
+	primary   string
+	primaryID string
+	applied   uint64
+	// lastTime is the primary's time of the last change or heartbeat
+	// received, in Unix nanoseconds.
+	lastTime  int64
+	connected bool
+
+	stop chan bool
+	done chan bool
+}
+
+// NewPrimary creates a primary node replicating s.
+func NewPrimary(s store.Store, opts Options) *Node {
+	n := newNode(s, opts)
+	n.becomePrimary()
+	return n
+}
+
+/*
+NewFollower creates a follower node, which replaces the contents of s with
+those of the primary at the URL primary, then keeps it up to date until the
+follower is promoted or closed.
+*/
+func NewFollower(s store.Store, primary string, opts Options) *Node {
+	n := newNode(s, opts)
+	n.role = FOLLOWER
+	n.primary = primary
+	n.stop = make(chan bool)
+	n.done = make(chan bool)
+	go n.follow(n.stop, n.done)
+	return n
+}
+
+func newNode(s store.Store, opts Options) *Node {
+	if opts.Backlog <= 0 {
+		opts.Backlog = DEFAULT_BACKLOG
+	}
+	if opts.HeartbeatInterval <= 0 {
+		opts.HeartbeatInterval = DEFAULT_HEARTBEAT_INTERVAL
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = DEFAULT_RETRY_INTERVAL
+	}
+	n := &Node{store: s, opts: opts, wake: make(chan bool)}
+	if watchable, ok := s.(store.Watchable); ok {
+		n.watcher = watchable.Watch(opts.Backlog, cmap.Drop,
+			cmap.OpExpire, cmap.OpEvict)
+		n.watchDone = make(chan bool)
+		go n.watch(n.watcher, n.watchDone)
+	}
+	return n
+}
+
+// newLogID returns a random id for a new log.
+func newLogID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// becomePrimary starts a new log, following on from the changes applied
+// so far.
+func (n *Node) becomePrimary() {
+	n.logLock.Lock()
+	n.id = newLogID()
+	n.seq = n.applied
+	n.backlog = nil
+	n.logLock.Unlock()
+
+	n.role = PRIMARY
+}
+
+/*
+Promote makes a follower a primary. It stops following, and starts a new log
+of its own from the last change it applied. Promoting a primary is a no-op.
+*/
+func (n *Node) Promote() {
+	n.promoteLock.Lock()
+	defer n.promoteLock.Unlock()
+
+	n.stopFollowing()
+	n.stateLock.Lock()
+	defer n.stateLock.Unlock()
+	if n.role == PRIMARY {
+		return
+	}
+	n.connected = false
+	n.becomePrimary()
+}
+
+// stopFollowing stops a follower following its primary, and waits for it to
+// stop applying changes.
+func (n *Node) stopFollowing() {
+	n.stateLock.Lock()
+	stop, done := n.stop, n.done
+	n.stop, n.done = nil, nil
+	n.stateLock.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// Role returns PRIMARY or FOLLOWER.
+func (n *Node) Role() string {
+	n.stateLock.Lock()
+	defer n.stateLock.Unlock()
+	return n.role
+}
+
+/*
+Stats returns the replication state for the monitor. Every node reports its
+role and sequence number; a follower also reports whether it is connected, and
+its lag: how long ago the primary sent the last change or heartbeat received.
+The lag includes any difference between the clocks of the two servers.
+*/
+func (n *Node) Stats() map[string]int {
+	n.stateLock.Lock()
+	defer n.stateLock.Unlock()
+
+	stats := make(map[string]int)
+	if n.role == PRIMARY {
+		n.logLock.Lock()
+		stats["replication-primary"] = 1
+		stats["replication-seq"] = int(n.seq)
+		stats["replication-followers"] = n.followers
+		n.logLock.Unlock()
+		return stats
+	}
+	stats["replication-primary"] = 0
+	stats["replication-seq"] = int(n.applied)
+	stats["replication-connected"] = 0
+	if n.connected {
+		stats["replication-connected"] = 1
+	}
+	if n.lastTime > 0 {
+		lag := time.Since(time.Unix(0, n.lastTime))
+		stats["replication-lag-ms"] = int(lag / time.Millisecond)
+	}
+	return stats
+}
+
+func (n *Node) Get(key string) (string, bool, error) {
+	return n.store.Get(key)
+}
+
+func (n *Node) Range(fn func(key string, value string) bool) error {
+	return n.store.Range(fn)
+}
+
+func (n *Node) Set(key string, value string) error {
+	unlock, err := n.lockWrite(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err = n.store.Set(key, value); err == nil {
+		n.recordKey(key)
+	}
+	return err
+}
+
+func (n *Node) SetIfAbsent(key string, value string) (bool, error) {
+	unlock, err := n.lockWrite(key)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	stored, err := n.store.SetIfAbsent(key, value)
+	if stored {
+		n.recordKey(key)
+	}
+	return stored, err
+}
+
+func (n *Node) CompareAndSwap(key string, old string, new string) (bool, error) {
+	unlock, err := n.lockWrite(key)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	stored, err := n.store.CompareAndSwap(key, old, new)
+	if stored {
+		n.recordKey(key)
+	}
+	return stored, err
+}
+
+func (n *Node) Del(key string) error {
+	unlock, err := n.lockWrite(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err = n.store.Del(key); err == nil {
+		n.record(OP_DEL, key, "", 0)
+	}
+	return err
+}
+
+// Close stops following, if the node is a follower, and watching its store,
+// then closes the store.
+func (n *Node) Close() error {
+	n.promoteLock.Lock()
+	defer n.promoteLock.Unlock()
+
+	n.stopFollowing()
+	if n.watcher != nil {
+		n.watcher.Stop()
+		<-n.watchDone
+		n.watcher, n.watchDone = nil, nil
+	}
+	return n.store.Close()
+}
+
+// lockWrite locks a primary for a write to key, returning the function which
+// unlocks it, or fails with ErrReadOnly on a follower.
+func (n *Node) lockWrite(key string) (func(), error) {
+	if n.Role() != PRIMARY {
+		return nil, ErrReadOnly
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	stripe := &n.stripes[hash.Sum32()%stripes]
+
+	n.lock.RLock()
+	stripe.Lock()
+	return func() {
+		stripe.Unlock()
+		n.lock.RUnlock()
+	}, nil
+}
+
+/*
+recordKey records key as it now is in the store: set, with the time it
+expires, or deleted. Reading the key back rather than recording what was
+written gives followers the expiry the store chose, and, since it is done
+with the key's stripe locked, keeps a removal the store made of its own
+accord in order with the writes to the key around it.
+*/
+func (n *Node) recordKey(key string) {
+	value, expires, ok, err := n.read(key)
+	switch {
+	case err != nil:
+		log.Errorf("replication: could not read back %q, so followers "+
+			"will bootstrap again: %s", key, err)
+		n.restartLog()
+	case ok:
+		n.record(OP_SET, key, value, expires)
+	default:
+		n.record(OP_DEL, key, "", 0)
+	}
+}
+
+// record appends a change to the log, waking any followers streaming it.
+func (n *Node) record(op string, key string, value string, expires int64) {
+	n.logLock.Lock()
+	defer n.logLock.Unlock()
+
+	n.seq++
+	n.backlog = append(n.backlog, Change{
+		Seq: n.seq, Op: op, Key: key, Value: value, Expires: expires,
+		Time: time.Now().UnixNano(),
+	})
+	if len(n.backlog) > n.opts.Backlog {
+		n.backlog = n.backlog[1:]
+	}
+	close(n.wake)
+	n.wake = make(chan bool)
+}
+
+// restartLog starts a new log, following on from the last change recorded,
+// so every follower has to bootstrap again.
+func (n *Node) restartLog() {
+	n.logLock.Lock()
+	defer n.logLock.Unlock()
+
+	n.id = newLogID()
+	n.backlog = nil
+	close(n.wake)
+	n.wake = make(chan bool)
+}
+
+/*
+watch records every key the store expires or evicts of its own accord, until
+the watcher is stopped. A primary whose watcher dropped an event starts a new
+log, since it can't tell its followers what they missed. A follower records
+nothing; its own removals aren't the primary's.
+*/
+func (n *Node) watch(w *cmap.Watcher, done chan bool) {
+	defer close(done)
+	check := time.NewTicker(n.opts.HeartbeatInterval)
+	defer check.Stop()
+	var dropped uint64
+	for {
+		select {
+		case event, ok := <-w.C:
+			if !ok {
+				return
+			}
+			if unlock, err := n.lockWrite(event.Key); err == nil {
+				n.recordKey(event.Key)
+				unlock()
+			}
+		case <-check.C:
+		}
+		if current := w.Dropped(); current != dropped {
+			dropped = current
+			if n.Role() == PRIMARY {
+				log.Warnf("replication: missed a change the store made " +
+					"itself, so followers will bootstrap again")
+				n.restartLog()
+			}
+		}
+	}
+}
+
+// read returns the value of key, and when it expires in Unix nanoseconds,
+// zero if it never does or the store isn't Expiring.
+func (n *Node) read(key string) (string, int64, bool, error) {
+	if s, ok := n.store.(store.Expiring); ok {
+		value, expires, found, err := s.GetWithExpiry(key)
+		return value, unixNano(expires), found, err
+	}
+	value, found, err := n.store.Get(key)
+	return value, 0, found, err
+}
+
+// write stores value under key to expire at expires, in Unix nanoseconds. A
+// store which isn't Expiring gives the value its own time to live instead.
+func (n *Node) write(key string, value string, expires int64) error {
+	if s, ok := n.store.(store.Expiring); ok {
+		var at time.Time
+		if expires != 0 {
+			at = time.Unix(0, expires)
+		}
+		return s.SetWithExpiry(key, value, at)
+	}
+	return n.store.Set(key, value)
+}
+
+// entries returns every value in the store, with when it expires.
+func (n *Node) entries() (map[string]Entry, error) {
+	entries := make(map[string]Entry)
+	if s, ok := n.store.(store.Expiring); ok {
+		err := s.RangeWithExpiry(func(key string, value string, expires time.Time) bool {
+			entries[key] = Entry{Value: value, Expires: unixNano(expires)}
+			return true
+		})
+		return entries, err
+	}
+	err := n.store.Range(func(key string, value string) bool {
+		entries[key] = Entry{Value: value}
+		return true
+	})
+	return entries, err
+}
+
+// unixNano returns t in Unix nanoseconds, or zero for the zero time.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+/*
+changesSince returns the changes in the log identified by id after since, and
+a channel closed once there are more. It fails with ErrGone if some of them
+aren't in the backlog anymore, or since is from another log.
+*/
+func (n *Node) changesSince(id string, since uint64) ([]Change, chan bool, error) {
+	n.logLock.Lock()
+	defer n.logLock.Unlock()
+
+	first := n.seq - uint64(len(n.backlog))
+	if id != n.id || since < first || since > n.seq {
+		return nil, nil, ErrGone
+	}
+	changes := make([]Change, n.seq-since)
+	copy(changes, n.backlog[since-first:])
+	return changes, n.wake, nil
+}
@@ -0,0 +1,204 @@
+package replication
+
+import (
+	"fmt"
+	cmap "github.com/leanrobot/timeserver/concurrentmap"
+	"github.com/leanrobot/timeserver/store"
+	"net/http"
+	"net/http/httptest"
+	tst "testing"
+	"time"
+)
+
+var testOptions = Options{
+	Backlog:           5,
+	HeartbeatInterval: 10 * time.Millisecond,
+	RetryInterval:     10 * time.Millisecond,
+	Secret:            "s3cret",
+}
+
+func serve(n *Node) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc(SNAPSHOT_PATH, n.ServeSnapshot)
+	mux.HandleFunc(STREAM_PATH, n.ServeStream)
+	mux.HandleFunc(PROMOTE_PATH, n.ServePromote)
+	return httptest.NewServer(mux)
+}
+
+// eventually fails the test unless check passes within a second.
+func eventually(t *tst.T, what string, check func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !check() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// post sends an empty POST to target with secret.
+func post(target string, secret string) (*http.Response, error) {
+	req, err := http.NewRequest("POST", target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(SECRET_HEADER, secret)
+	return http.DefaultClient.Do(req)
+}
+
+func has(n *Node, key string, value string) bool {
+	got, ok, _ := n.Get(key)
+	return ok && got == value
+}
+
+func TestReplication(t *tst.T) {
+	primary := NewPrimary(store.NewMemory(cmap.Options{}), testOptions)
+	defer primary.Close()
+	server := serve(primary)
+	defer server.Close()
+	primary.Set("before", "1")
+
+	followerStore := store.NewMemory(cmap.Options{})
+	followerStore.Set("stale", "x")
+	follower := NewFollower(followerStore, server.URL, testOptions)
+	defer follower.Close()
+	eventually(t, "bootstrap", func() bool {
+		return has(follower, "before", "1")
+	})
+	if _, ok, _ := follower.Get("stale"); ok {
+		t.Errorf("bootstrap kept a key the primary doesn't have")
+	}
+	if err := follower.Set("a", "1"); err != ErrReadOnly {
+		t.Errorf("follower write returned %v, expected ErrReadOnly", err)
+	}
+
+	primary.Set("a", "1")
+	primary.CompareAndSwap("a", "1", "2")
+	primary.SetIfAbsent("b", "3")
+	primary.Del("before")
+	eventually(t, "changes", func() bool {
+		_, ok, _ := follower.Get("before")
+		return !ok && has(follower, "a", "2") && has(follower, "b", "3")
+	})
+	eventually(t, "the follower to connect", func() bool {
+		return follower.Stats()["replication-connected"] == 1
+	})
+	if stats := follower.Stats(); stats["replication-seq"] != 5 {
+		t.Errorf("follower stats %v, expected seq 5", stats)
+	}
+
+	// more changes than the backlog holds while the follower is away
+	// makes it bootstrap again.
+	server.CloseClientConnections()
+	for i := 0; i < 20; i++ {
+		primary.Set(fmt.Sprint("k", i), fmt.Sprint(i))
+	}
+	eventually(t, "catching up past the backlog", func() bool {
+		return has(follower, "k19", "19") && has(follower, "k0", "0")
+	})
+
+	// a promoted follower takes writes, and starts a log of its own.
+	followerServer := serve(follower)
+	defer followerServer.Close()
+	res, err := post(followerServer.URL+PROMOTE_PATH, testOptions.Secret)
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("promote responded %v, %v", res, err)
+	}
+	if err := follower.Set("after", "1"); err != nil {
+		t.Errorf("promoted follower refused a write: %s", err)
+	}
+	if _, _, err := follower.changesSince(primary.id, 0); err != ErrGone {
+		t.Errorf("promoted follower kept the primary's log")
+	}
+}
+
+func TestExpiryAndEviction(t *tst.T) {
+	primaryStore := store.NewMemory(cmap.Options{
+		DefaultTTL: time.Hour, MaxEntries: 2, Shards: 1,
+	})
+	primary := NewPrimary(primaryStore, testOptions)
+	defer primary.Close()
+	server := serve(primary)
+	defer server.Close()
+	primary.Set("a", "1")
+
+	// the follower's own TTL mustn't apply to the primary's sessions.
+	followerStore := store.NewMemory(cmap.Options{DefaultTTL: time.Minute})
+	follower := NewFollower(followerStore, server.URL, testOptions)
+	defer follower.Close()
+	eventually(t, "bootstrap", func() bool {
+		return has(follower, "a", "1")
+	})
+	_, bootstrapped, _, _ := followerStore.(store.Expiring).GetWithExpiry("a")
+	_, expected, _, _ := primaryStore.(store.Expiring).GetWithExpiry("a")
+	if !bootstrapped.Equal(expected) {
+		t.Errorf("bootstrapped a expiring %s, expected %s", bootstrapped, expected)
+	}
+
+	// the primary evicts a to make room, and so must the follower.
+	primary.Set("b", "2")
+	primary.Set("c", "3")
+	eventually(t, "the eviction", func() bool {
+		_, ok, _ := follower.Get("a")
+		return !ok && has(follower, "b", "2") && has(follower, "c", "3")
+	})
+	_, streamed, _, _ := followerStore.(store.Expiring).GetWithExpiry("c")
+	_, expected, _, _ = primaryStore.(store.Expiring).GetWithExpiry("c")
+	if !streamed.Equal(expected) {
+		t.Errorf("streamed c expiring %s, expected %s", streamed, expected)
+	}
+
+	// more writes than the watcher holds, with no eviction among them,
+	// mustn't start a new log.
+	primary.logLock.Lock()
+	id := primary.id
+	primary.logLock.Unlock()
+	for i := 0; i < 4*testOptions.Backlog; i++ {
+		primary.Set("c", fmt.Sprint(i))
+	}
+	time.Sleep(5 * testOptions.HeartbeatInterval)
+	primary.logLock.Lock()
+	defer primary.logLock.Unlock()
+	if primary.id != id {
+		t.Errorf("a burst of writes started a new log")
+	}
+}
+
+func TestSecret(t *tst.T) {
+	primary := NewPrimary(store.NewMemory(cmap.Options{}), testOptions)
+	defer primary.Close()
+	server := serve(primary)
+	defer server.Close()
+
+	for _, path := range []string{SNAPSHOT_PATH, STREAM_PATH + "?since=0"} {
+		res, err := http.Get(server.URL + path)
+		if err != nil || res.StatusCode != http.StatusForbidden {
+			t.Errorf("%s without the secret responded %v, %v", path, res, err)
+		}
+	}
+	res, err := post(server.URL+PROMOTE_PATH, "wrong")
+	if err != nil || res.StatusCode != http.StatusForbidden {
+		t.Errorf("promote with the wrong secret responded %v, %v", res, err)
+	}
+
+	// a follower with the wrong secret gets nothing.
+	opts := testOptions
+	opts.Secret = "wrong"
+	primary.Set("a", "1")
+	follower := NewFollower(store.NewMemory(cmap.Options{}), server.URL, opts)
+	defer follower.Close()
+	time.Sleep(50 * time.Millisecond)
+	if _, ok, _ := follower.Get("a"); ok {
+		t.Errorf("a follower with the wrong secret bootstrapped")
+	}
+
+	// nor does anyone from a primary with no secret.
+	open := NewPrimary(store.NewMemory(cmap.Options{}), Options{})
+	defer open.Close()
+	openServer := serve(open)
+	defer openServer.Close()
+	res, err = post(openServer.URL+PROMOTE_PATH, "")
+	if err != nil || res.StatusCode != http.StatusForbidden {
+		t.Errorf("promote of a node with no secret responded %v, %v", res, err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	log "github.com/cihub/seelog"
 	"io/ioutil"
 	"net/http"
+	"time"
 )
 
 var BASE_TEMPLATE = "templates/base.html"
@@ -80,6 +81,7 @@ Url patterns are stored in a list to maintain the register-first match-first
 relationship between resource and views.
 */
 func (sh *StrictHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	defer latency.ObserveSince(time.Now())
 	url := removeTrailingSlash(req.URL.Path)
 	for _, view := range sh.Views {
 		for _, pattern := range view.Patterns {
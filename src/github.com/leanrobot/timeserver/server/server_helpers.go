@@ -2,15 +2,25 @@ package server
 
 import (
 	"encoding/json"
-	"fmt"
 	log "github.com/cihub/seelog"
 	"github.com/leanrobot/counter"
 	"github.com/leanrobot/timeserver/config"
 	"net/http"
+	"strconv"
 	"time"
 )
 
 var (
+	// httpCounters counts the responses LogRequest logs, as
+	// http.status{code=...}.
+	httpCounters = counter.Default.Prefix("http")
+	// inflight is the number of requests LimitRequests is serving.
+	inflight = httpCounters.NewGauge("inflight")
+	// latency is how long StrictHandler takes to serve each request.
+	latency = httpCounters.NewHistogram("latency-ms", counter.DEFAULT_LATENCY_BUCKETS)
+	// deltas remembers what each scraper of /monitor?delta=1 last saw.
+	deltas = counter.NewDeltas(counter.Default, counter.DEFAULT_SCRAPER_TTL)
+
 	max       int
 	featureOn bool
 	// A semaphore channel. When the channel is drained of bool's
@@ -19,6 +29,10 @@ var (
 )
 
 func init() {
+	httpCounters.Describe("status", "Responses logged, by status code.")
+	httpCounters.Describe("inflight", "Requests being served under the request limit.")
+	httpCounters.Describe("latency-ms", "Time taken to serve each request, in milliseconds.")
+
 	max = config.RequestLimit
 	featureOn = true
 
@@ -42,7 +56,9 @@ func LimitRequests(h http.HandlerFunc) http.HandlerFunc {
 		sem := sem
 		select {
 		case <-sem:
+			inflight.Inc()
 			h(res, req)
+			inflight.Dec()
 			sem <- true
 		default:
 			Error502(res, req)
@@ -56,11 +72,27 @@ func Error400(res http.ResponseWriter, req *http.Request) {
 	res.WriteHeader(http.StatusBadRequest)
 }
 
+func Error409(res http.ResponseWriter, req *http.Request) {
+	LogRequest(req, http.StatusConflict)
+	res.WriteHeader(http.StatusConflict)
+}
+
+func Error500(res http.ResponseWriter, req *http.Request) {
+	LogRequest(req, http.StatusInternalServerError)
+	res.WriteHeader(http.StatusInternalServerError)
+}
+
 func Error502(res http.ResponseWriter, req *http.Request) {
 	LogRequest(req, http.StatusServiceUnavailable)
 	res.WriteHeader(http.StatusServiceUnavailable)
 }
 
+// Redirect307 sends the request on to target, method and all.
+func Redirect307(res http.ResponseWriter, req *http.Request, target string) {
+	LogRequest(req, http.StatusTemporaryRedirect)
+	http.Redirect(res, req, target, http.StatusTemporaryRedirect)
+}
+
 // logRequest logs request data to stdout. The format conforms closely to
 // Apache Common Log Format.
 //
@@ -74,13 +106,8 @@ func Error502(res http.ResponseWriter, req *http.Request) {
 func LogRequest(req *http.Request, statusCode int) {
 	var requestTime string = time.Now().Format(time.RFC1123Z)
 
-	// log either the century, or the 404
-	century := (statusCode / 100) * 100
-	if statusCode == 404 {
-		counter.Increment(fmt.Sprintf("%ds", statusCode))
-	} else {
-		counter.Increment(fmt.Sprintf("%ds", century))
-	}
+	httpCounters.Increment(counter.Series("status",
+		map[string]string{"code": strconv.Itoa(statusCode)}))
 
 	log.Infof(`%s - [%s] "%s %s %s" %d -`,
 		req.Host, requestTime, req.Method, req.URL.String(), req.Proto,
@@ -90,10 +117,102 @@ func LogRequest(req *http.Request, statusCode int) {
 /*
 MonitorHandler is a http.HandlerFunc type which uses the counter package
 in order to "export" the contents of the program counter to an external service,
-AKA the monitoring service for assignment 6. The data is displayed in JSON.
+AKA the monitoring service for assignment 6. The data is displayed in JSON, as
+a single object of names to integers; gauges and histograms are flattened into
+it as counter.Export describes, e.g. http.latency-ms{le=100}.
+
+With ?rates=1 the recent rates of the counters are included too, as
+counter.ExportWithRates names them, e.g. http.status.rate{code=200,window=1m}.
+Rates are per second, so not always integers.
+
+With ?delta=1&id=<scraper> the response is a counter.Delta instead: the
+changes since the scraper last asked, under "values", and the gauges under
+"gauges", with the process's start time and the scraper's sequence number so
+it can spot restarts. A delta without an id responds 400.
 */
 func MonitorHandler(res http.ResponseWriter, req *http.Request) {
-	data := counter.Export()
+	MonitorHandlerWith()(res, req)
+}
+
+/*
+MonitorHandlerWith is like MonitorHandler, but also exports the values
+returned by each of sources, which replace any counters of the same name. A
+delta has them under "gauges", as they are: whether a source's value is a
+total or a level is up to the source, so it can't be told what changed.
+*/
+func MonitorHandlerWith(sources ...func() map[string]int) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("delta") != "" {
+			id := req.URL.Query().Get("id")
+			if id == "" {
+				Error400(res, req)
+				return
+			}
+			delta := deltas.Export(id)
+			for _, stats := range sources {
+				for key, value := range stats() {
+					delete(delta.Values, key)
+					delta.Gauges[key] = value
+				}
+			}
+			writeMonitor(res, delta)
+			return
+		}
+		if req.URL.Query().Get("rates") != "" {
+			data := counter.ExportWithRates()
+			for _, stats := range sources {
+				for key, value := range stats() {
+					data[key] = float64(value)
+				}
+			}
+			writeMonitor(res, data)
+			return
+		}
+		data := counter.Export()
+		for _, stats := range sources {
+			for key, value := range stats() {
+				data[key] = value
+			}
+		}
+		writeMonitor(res, data)
+	}
+}
+
+/*
+MetricsHandler is like MonitorHandler, but writes the counters, gauges and
+histograms in the Prometheus text exposition format, for scrapers which
+speak it.
+*/
+func MetricsHandler(res http.ResponseWriter, req *http.Request) {
+	writeMetrics(res, counter.ExportSnapshot())
+}
+
+// MetricsHandlerWith is like MetricsHandler, but also writes the values
+// returned by each of sources, as gauges replacing anything of the same name.
+func MetricsHandlerWith(sources ...func() map[string]int) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		snapshot := counter.ExportSnapshot()
+		for _, stats := range sources {
+			for key, value := range stats() {
+				delete(snapshot.Counters, key)
+				delete(snapshot.Histograms, key)
+				snapshot.Gauges[key] = value
+			}
+		}
+		writeMetrics(res, snapshot)
+	}
+}
+
+func writeMetrics(res http.ResponseWriter, snapshot counter.Snapshot) {
+	res.Header().Set("Content-Type", counter.PROMETHEUS_CONTENT_TYPE)
+	if err := snapshot.WritePrometheus(res); err != nil {
+		log.Errorf("could not write metrics: %s", err)
+	}
+}
+
+// writeMonitor writes data, a map of names to numbers or a counter.Delta, as
+// JSON.
+func writeMonitor(res http.ResponseWriter, data interface{}) {
 	dataJson, err := json.Marshal(data)
 	if err != nil {
 		panic(err)
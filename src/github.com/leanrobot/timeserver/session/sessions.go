@@ -1,14 +1,14 @@
 package session
 
 import (
-	"crypto/md5"
+	"crypto/rand"
 	"fmt"
 	"github.com/leanrobot/timeserver/config"
 	"github.com/leanrobot/timeserver/cookie"
 	"github.com/leanrobot/timeserver/netauth"
-	"io"
+	"github.com/leanrobot/timeserver/record"
+	"net"
 	"net/http"
-	"time"
 )
 
 var (
@@ -19,15 +19,31 @@ func init() {
 	sessionName = config.SESSION_NAME
 }
 
-// TODO error return value?
-func Create(res http.ResponseWriter, name string) error {
-	uuid := uuidGen()
-	err := netauth.SetName(uuid, name)
-	if err != nil {
-		return err
+// how many session ids Create tries before giving up.
+const CREATE_ATTEMPTS = 3
+
+// Create starts a session for name, recording the client that made req. The
+// authserver never replaces an existing session, so if the generated id is
+// already taken a new one is generated.
+func Create(req *http.Request, res http.ResponseWriter, name string) error {
+	session := record.New(name)
+	session.ClientIP = clientIP(req)
+	session.UserAgent = req.UserAgent()
+
+	var err error
+	for i := 0; i < CREATE_ATTEMPTS; i++ {
+		uuid := uuidGen()
+		err = netauth.SetSession(uuid, session)
+		if err == netauth.ErrConflict {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		cookie.Create(res, sessionName, uuid)
+		return nil
 	}
-	cookie.Create(res, sessionName, uuid)
-	return nil
+	return err
 }
 
 func Destroy(req *http.Request, res http.ResponseWriter) error {
@@ -60,11 +76,21 @@ func Username(req *http.Request) (string, error) {
 	return name, nil
 }
 
-func uuidGen() string {
-	idHash := md5.New()
-	io.WriteString(idHash, time.Now().Format(time.UnixDate))
-	io.WriteString(idHash, time.Now().Format(time.UnixDate))
+// clientIP returns the address of the client that made req, without its port.
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
 
-	uuid := fmt.Sprintf("%x", idHash.Sum(nil))
-	return uuid
+// uuidGen returns 128 random bits in hex. Ids used to be derived from the
+// time, so every login within the same second got the same id.
+func uuidGen() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%x", id)
 }
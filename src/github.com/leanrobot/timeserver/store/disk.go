@@ -0,0 +1,55 @@
+package store
+
+import (
+	log "github.com/cihub/seelog"
+	"github.com/leanrobot/timeserver/diskkv"
+	"sync"
+	"time"
+)
+
+// diskStore is the DISK store, a diskkv data file.
+type diskStore struct {
+	*diskkv.DB
+	stop      chan bool
+	closeOnce sync.Once
+}
+
+/*
+OpenDisk opens a DISK store with its data file at path. Values expire after
+ttl, unless it is zero. Garbage is compacted out of the data file every
+compactInterval.
+*/
+func OpenDisk(path string, ttl time.Duration, compactInterval time.Duration) (Store, error) {
+	db, err := diskkv.Open(path, diskkv.Options{DefaultTTL: ttl})
+	if err != nil {
+		return nil, err
+	}
+	ds := &diskStore{DB: db, stop: make(chan bool)}
+	if compactInterval > 0 {
+		go ds.compactAtInterval(compactInterval)
+	}
+	return ds, nil
+}
+
+func (ds *diskStore) compactAtInterval(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if ds.Garbage() == 0 {
+				continue
+			}
+			if err := ds.Compact(); err != nil {
+				log.Errorf("data file compaction failed: %s", err)
+			}
+		case <-ds.stop:
+			return
+		}
+	}
+}
+
+func (ds *diskStore) Close() error {
+	ds.closeOnce.Do(func() { close(ds.stop) })
+	return ds.DB.Close()
+}
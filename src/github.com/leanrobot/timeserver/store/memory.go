@@ -0,0 +1,135 @@
+package store
+
+import (
+	"context"
+	cmap "github.com/leanrobot/timeserver/concurrentmap"
+	"time"
+)
+
+// mapStore is a Store backed by a concurrentmap. On its own it is the MEMORY
+// store; the JSON store adds a journal to it.
+type mapStore struct {
+	data *cmap.CMap
+}
+
+// NewMemory creates a MEMORY store backed by a new concurrentmap.
+func NewMemory(opts cmap.Options) Store {
+	return &mapStore{data: cmap.NewWithOptions(opts)}
+}
+
+func (ms *mapStore) Get(key string) (string, bool, error) {
+	value, ok := ms.data.Get(key)
+	return value, ok, nil
+}
+
+func (ms *mapStore) GetWithExpiry(key string) (string, time.Time, bool, error) {
+	value, expires, ok := ms.data.GetWithExpiry(key)
+	return value, expires, ok, nil
+}
+
+func (ms *mapStore) Set(key string, value string) error {
+	ms.data.Set(key, value)
+	return nil
+}
+
+func (ms *mapStore) SetWithExpiry(key string, value string, expires time.Time) error {
+	ms.data.SetWithExpiry(key, value, expires)
+	return nil
+}
+
+func (ms *mapStore) SetIfAbsent(key string, value string) (bool, error) {
+	return ms.data.SetIfAbsent(key, value), nil
+}
+
+func (ms *mapStore) CompareAndSwap(key string, old string, new string) (bool, error) {
+	return ms.data.CompareAndSwap(key, old, new), nil
+}
+
+func (ms *mapStore) Del(key string) error {
+	ms.data.Del(key)
+	return nil
+}
+
+func (ms *mapStore) Range(fn func(key string, value string) bool) error {
+	ms.data.Range(fn)
+	return nil
+}
+
+func (ms *mapStore) RangeWithExpiry(fn func(key string, value string, expires time.Time) bool) error {
+	ms.data.RangeWithExpiry(fn)
+	return nil
+}
+
+func (ms *mapStore) Watch(buffer int, policy cmap.OverflowPolicy, ops ...cmap.Op) *cmap.Watcher {
+	return ms.data.Watch(buffer, policy, ops...)
+}
+
+func (ms *mapStore) Close() error {
+	ms.data.Close()
+	return nil
+}
+
+// jsonStore is the JSON store, a mapStore whose writes are journaled.
+type jsonStore struct {
+	mapStore
+	journal     *cmap.Journal
+	checkpoints *cmap.Checkpointer
+}
+
+/*
+OpenJSON opens a JSON store with its dumpfile at path, replaying the dumpfile
+and its journal. The journal is compacted into the dumpfile as checkpoints
+configures, whenever there were writes since the last compaction. A zero
+Interval only compacts on Close.
+*/
+func OpenJSON(path string, opts cmap.Options, checkpoints cmap.CheckpointOptions) (Store, error) {
+	data, journal, err := cmap.OpenJournaled(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	checkpointer := journal.NewCheckpointer(checkpoints)
+	if checkpoints.Interval > 0 {
+		checkpointer.Start()
+	}
+	return &jsonStore{
+		mapStore:    mapStore{data: data},
+		journal:     journal,
+		checkpoints: checkpointer,
+	}, nil
+}
+
+// The concurrentmap has no way to report a failed journal write, so the
+// writes report the journal's first error instead.
+
+func (js *jsonStore) Set(key string, value string) error {
+	js.data.Set(key, value)
+	return js.journal.Err()
+}
+
+func (js *jsonStore) SetWithExpiry(key string, value string, expires time.Time) error {
+	js.data.SetWithExpiry(key, value, expires)
+	return js.journal.Err()
+}
+
+func (js *jsonStore) SetIfAbsent(key string, value string) (bool, error) {
+	return js.data.SetIfAbsent(key, value), js.journal.Err()
+}
+
+func (js *jsonStore) CompareAndSwap(key string, old string, new string) (bool, error) {
+	return js.data.CompareAndSwap(key, old, new), js.journal.Err()
+}
+
+func (js *jsonStore) Del(key string) error {
+	js.data.Del(key)
+	return js.journal.Err()
+}
+
+// Close folds the journal into the dumpfile before closing it.
+func (js *jsonStore) Close() error {
+	err := js.checkpoints.Stop(context.Background())
+	if closeErr := js.journal.Close(); err == nil {
+		err = closeErr
+	}
+	js.data.Close()
+	return err
+}
@@ -0,0 +1,115 @@
+/*
+store package defines the Store interface the authserver keeps its sessions
+in, and the implementations it can choose between with the -store flag.
+*/
+package store
+
+import (
+	"fmt"
+	cmap "github.com/leanrobot/timeserver/concurrentmap"
+	"time"
+)
+
+// The kinds of Store Open can create.
+const (
+	// MEMORY keeps sessions in a concurrentmap only. They are lost on exit.
+	MEMORY = "memory"
+	// JSON keeps sessions in a concurrentmap, journals every write, and
+	// compacts the journal into a JSON dumpfile snapshot.
+	JSON = "json"
+	// DISK keeps sessions in an embedded diskkv data file, with only an
+	// index in memory.
+	DISK = "disk"
+)
+
+/*
+Store is a key-value store safe for concurrent use. Writes are durable once
+they return, as far as the implementation is durable at all.
+*/
+type Store interface {
+	// Get returns the value of key, and whether it exists.
+	Get(key string) (string, bool, error)
+	// Set stores value under key, replacing any existing value.
+	Set(key string, value string) error
+	// SetIfAbsent stores value under key only if key doesn't exist, and
+	// reports whether it was stored.
+	SetIfAbsent(key string, value string) (bool, error)
+	// CompareAndSwap stores new under key only if the current value is old,
+	// and reports whether it was stored.
+	CompareAndSwap(key string, old string, new string) (bool, error)
+	// Del removes key. Deleting a missing key is a no-op.
+	Del(key string) error
+	// Range calls fn for every key-value in sorted key order, stopping
+	// early if fn returns false.
+	Range(fn func(key string, value string) bool) error
+	// Close flushes the store and releases its resources.
+	Close() error
+}
+
+/*
+Expiring is a Store which can say when its values expire, and store a value
+to expire at a given time, so a copy of it expires its values when the
+original does rather than a whole time to live after they were copied. Every
+Store Open creates is Expiring.
+*/
+type Expiring interface {
+	Store
+	// GetWithExpiry is Get, also returning when the value expires, the zero
+	// time if it never does.
+	GetWithExpiry(key string) (string, time.Time, bool, error)
+	// SetWithExpiry stores value under key to expire at expires, or never
+	// if it is the zero time.
+	SetWithExpiry(key string, value string, expires time.Time) error
+	// RangeWithExpiry is Range, but fn is also given when each value
+	// expires.
+	RangeWithExpiry(fn func(key string, value string, expires time.Time) bool) error
+}
+
+/*
+Watchable is a Store which removes values of its own accord, expiring or
+evicting them, and can report the changes to it on a concurrentmap Watcher.
+The MEMORY and JSON stores are Watchable; a DISK store never removes a value
+it wasn't asked to, since expired values are only skipped.
+*/
+type Watchable interface {
+	Store
+	Watch(buffer int, policy cmap.OverflowPolicy, ops ...cmap.Op) *cmap.Watcher
+}
+
+// Options configures the Store created by Open.
+type Options struct {
+	// Path is the file the store persists to. Only MEMORY ignores it.
+	Path string
+
+	// Map configures the concurrentmap of MEMORY and JSON stores. DISK only
+	// uses its DefaultTTL.
+	Map cmap.Options
+
+	// CompactInterval is how often a JSON store folds its journal into its
+	// dumpfile, or a DISK store drops garbage from its data file.
+	CompactInterval time.Duration
+
+	// Retention is how many generations of its dumpfile a JSON store keeps.
+	Retention cmap.Retention
+}
+
+// Open creates a Store of the given kind, loading anything already persisted
+// at opts.Path.
+func Open(kind string, opts Options) (Store, error) {
+	if kind != MEMORY && len(opts.Path) == 0 {
+		return nil, fmt.Errorf("store: a %s store needs a path", kind)
+	}
+	switch kind {
+	case MEMORY:
+		return NewMemory(opts.Map), nil
+	case JSON:
+		return OpenJSON(opts.Path, opts.Map, cmap.CheckpointOptions{
+			Interval:  opts.CompactInterval,
+			Retention: opts.Retention,
+		})
+	case DISK:
+		return OpenDisk(opts.Path, opts.Map.DefaultTTL, opts.CompactInterval)
+	}
+	return nil, fmt.Errorf("store: unknown store %q, expected %s, %s or %s",
+		kind, MEMORY, JSON, DISK)
+}
@@ -0,0 +1,125 @@
+package store
+
+import (
+	"fmt"
+	cmap "github.com/leanrobot/timeserver/concurrentmap"
+	"os"
+	"path/filepath"
+	tst "testing"
+	"time"
+)
+
+func TestStores(t *tst.T) {
+	for _, kind := range []string{MEMORY, JSON, DISK} {
+		path := filepath.Join(t.TempDir(), "sessions")
+		opts := Options{Path: path, Map: cmap.Options{}}
+
+		s, err := Open(kind, opts)
+		if err != nil {
+			t.Fatalf("%s: %s", kind, err)
+		}
+		s.Set("a", "1")
+		s.Set("b", "2")
+		s.Del("b")
+		if ok, _ := s.SetIfAbsent("a", "3"); ok {
+			t.Errorf("%s: SetIfAbsent stored over an existing key", kind)
+		}
+		if ok, _ := s.CompareAndSwap("a", "1", "4"); !ok {
+			t.Errorf("%s: CompareAndSwap didn't store", kind)
+		}
+		s.SetIfAbsent("c", "5")
+		if err := s.Close(); err != nil {
+			t.Fatalf("%s: %s", kind, err)
+		}
+		if kind == MEMORY {
+			continue
+		}
+
+		// persistent stores must come back the same.
+		s, err = Open(kind, opts)
+		if err != nil {
+			t.Fatalf("%s: %s", kind, err)
+		}
+		var seen []string
+		s.Range(func(key string, value string) bool {
+			seen = append(seen, key+"="+value)
+			return true
+		})
+		if fmt.Sprint(seen) != "[a=4 c=5]" {
+			t.Errorf("%s: reopened store holds %v", kind, seen)
+		}
+		s.Close()
+		// closing again is harmless.
+		s.Close()
+	}
+
+	if _, err := Open("bogus", Options{Path: "x"}); err == nil {
+		t.Errorf("opened an unknown kind of store")
+	}
+}
+
+func TestExpiring(t *tst.T) {
+	expires := time.Now().Add(time.Hour).Round(0)
+	for _, kind := range []string{MEMORY, JSON, DISK} {
+		path := filepath.Join(t.TempDir(), "sessions")
+		opts := Options{Path: path, Map: cmap.Options{DefaultTTL: time.Minute}}
+		s, err := Open(kind, opts)
+		if err != nil {
+			t.Fatalf("%s: %s", kind, err)
+		}
+		e, ok := s.(Expiring)
+		if !ok {
+			t.Fatalf("%s: the store isn't Expiring", kind)
+		}
+
+		e.SetWithExpiry("a", "1", expires)
+		e.SetWithExpiry("b", "2", time.Time{})
+		e.SetWithExpiry("gone", "3", time.Now().Add(-time.Second))
+		if _, ok, _ := e.Get("gone"); ok {
+			t.Errorf("%s: Get returned a value set to have expired", kind)
+		}
+		var seen []string
+		e.RangeWithExpiry(func(key string, value string, at time.Time) bool {
+			seen = append(seen, fmt.Sprint(key, "=", value, " ", at.Equal(expires), at.IsZero()))
+			return true
+		})
+		if fmt.Sprint(seen) != "[a=1 true false b=2 false true]" {
+			t.Errorf("%s: RangeWithExpiry saw %v", kind, seen)
+		}
+		if value, at, ok, _ := e.GetWithExpiry("a"); value != "1" || !ok || !at.Equal(expires) {
+			t.Errorf("%s: GetWithExpiry(a) = %q, %s, %v", kind, value, at, ok)
+		}
+		s.Close()
+	}
+}
+
+func TestJournalFailure(t *tst.T) {
+	path := filepath.Join(t.TempDir(), "sessions")
+	s, err := OpenJSON(path, cmap.Options{}, cmap.CheckpointOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a journal which can't be renamed leaves compaction without a file to
+	// journal to.
+	if err := os.Remove(path + ".journal"); err != nil {
+		t.Fatal(err)
+	}
+	journal := s.(*jsonStore).journal
+	if err := journal.Compact(); err == nil {
+		t.Fatalf("compacted a journal which wasn't there")
+	}
+	if err := s.Set("b", "2"); err == nil {
+		t.Errorf("a write with no journal reported success")
+	}
+	if err := s.Del("a"); err == nil {
+		t.Errorf("a delete with no journal reported success")
+	}
+	if err := journal.Compact(); err == nil {
+		t.Errorf("compacted a journal which had failed")
+	}
+}